@@ -0,0 +1,94 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+
+	"codeberg.org/pluja/whishper/backup"
+)
+
+// handleIndexStatus reports which of the indexes the database queries rely
+// on exist.
+func (s *Server) handleIndexStatus(c *fiber.Ctx) error {
+	indexes, err := s.Db.IndexStatus(c.UserContext())
+	if err != nil {
+		log.Error().Err(err).Msg("Error getting the database indexes")
+		return dbError(err)
+	}
+	return c.JSON(indexes)
+}
+
+// handleExport streams a backup archive of the whole instance. Since the
+// archive is streamed, an error half way can only cut the download short;
+// it is logged.
+func (s *Server) handleExport(c *fiber.Ctx) error {
+	name := fmt.Sprintf("whishper-%v.tar.gz", time.Now().Format("2006_01_02-150405"))
+	c.Set("Content-Type", "application/gzip")
+	c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	// The stream is written after the handler returns. A client going away
+	// only shows as a failed write, which stops the export.
+	ctx, cancel := context.WithCancel(c.UserContext())
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer cancel()
+		stats, err := backup.Export(ctx, s.Db, os.Getenv("UPLOAD_DIR"), &cancelWriter{w: w, cancel: cancel})
+		if err != nil {
+			log.Error().Err(err).Msg("Error exporting a backup")
+			return
+		}
+		if err := w.Flush(); err != nil {
+			log.Error().Err(err).Msg("Error sending a backup")
+			return
+		}
+		log.Info().Msgf("Exported %v transcriptions, %v revisions and %v media files", stats.Transcriptions, stats.Revisions, stats.Media)
+	})
+	return nil
+}
+
+// cancelWriter cancels its context when a write fails.
+type cancelWriter struct {
+	w      io.Writer
+	cancel context.CancelFunc
+}
+
+func (w *cancelWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil {
+		w.cancel()
+	}
+	return n, err
+}
+
+// handleImport restores the backup archive sent in the file form field.
+func (s *Server) handleImport(c *fiber.Ctx) error {
+	file, err := c.FormFile("file")
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "The archive is missing from the file field")
+	}
+	f, err := file.Open()
+	if err != nil {
+		log.Error().Err(err).Msg("Error opening the uploaded archive")
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+	}
+	defer f.Close()
+
+	stats, err := backup.Import(c.UserContext(), s.Db, os.Getenv("UPLOAD_DIR"), f)
+	if err != nil {
+		log.Error().Err(err).Msgf("Import stopped after %v transcriptions", stats.Transcriptions)
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Import stopped after %v transcriptions: %v", stats.Transcriptions, err))
+	}
+	log.Info().Msgf("Imported %v transcriptions, %v revisions and %v media files", stats.Transcriptions, stats.Revisions, stats.Media)
+	// Imported jobs that are pending wait for the queue.
+	select {
+	case s.NewTranscriptionCh <- true:
+	default:
+		// A wake up is pending already.
+	}
+	return c.JSON(stats)
+}
@@ -1,8 +1,11 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -10,11 +13,22 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/rs/zerolog/log"
 
+	"codeberg.org/pluja/whishper/database"
 	"codeberg.org/pluja/whishper/models"
 )
 
 func (s *Server) handleGetAllTranscriptions(c *fiber.Ctx) error {
-	transcriptions := s.Db.GetAllTranscriptions()
+	all, err := s.Db.GetAllTranscriptions(c.UserContext())
+	if err != nil {
+		log.Error().Err(err).Msg("Error getting transcriptions")
+		return dbError(err)
+	}
+	transcriptions := make([]*models.Transcription, 0, len(all))
+	for _, t := range all {
+		if t.DeletedAt == nil {
+			transcriptions = append(transcriptions, t)
+		}
+	}
 
 	// Convert the transcriptions to JSON.
 	json, err := json.Marshal(transcriptions)
@@ -29,21 +43,35 @@ func (s *Server) handleGetAllTranscriptions(c *fiber.Ctx) error {
 	return nil
 }
 
+// handleListTranscriptions returns a lightweight, filtered and sorted page of
+// transcriptions. The body stays a plain JSON array; the total number of
+// matches and the cursor of the next page are sent in the X-Total-Count and
+// X-Next-Cursor headers.
 func (s *Server) handleListTranscriptions(c *fiber.Ctx) error {
-	transcriptions := s.Db.GetAllTranscriptions()
+	opts, err := listOptionsFromQuery(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
 
-	log.Debug().Msgf("Found %v transcriptions in the database", len(transcriptions))
-	// Convert the transcriptions to a lightweight view and marshal.
-	items := make([]models.TranscriptionListItem, 0, len(transcriptions))
-	for _, t := range transcriptions {
-		if t.WordsCount == 0 && t.Result.Text != "" {
-			count := len(strings.Fields(t.Result.Text))
-			t.WordsCount = count
-			if _, err := s.Db.UpdateTranscription(t); err != nil {
-				log.Error().Err(err).Msgf("Error updating words_count for transcription %v", t.ID.Hex())
-			}
+	page, err := s.Db.ListTranscriptions(c.UserContext(), opts)
+	if err != nil {
+		log.Error().Err(err).Msg("Error listing transcriptions")
+		if errors.Is(err, database.ErrInvalidCursor) {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
 		}
+		return dbError(err)
+	}
 
+	log.Debug().Msgf("Found %v transcriptions in the database, returning %v", page.Total, len(page.Items))
+	return writeListPage(c, page)
+}
+
+// writeListPage writes page as a JSON array of list items, with the total
+// and the next cursor in the X-Total-Count and X-Next-Cursor headers.
+func writeListPage(c *fiber.Ctx, page *database.ListPage) error {
+	// Convert the transcriptions to a lightweight view and marshal.
+	items := make([]models.TranscriptionListItem, 0, len(page.Items))
+	for _, t := range page.Items {
 		item := models.TranscriptionListItem{
 			ID:                      t.ID.Hex(),
 			Status:                  t.Status,
@@ -64,6 +92,12 @@ func (s *Server) handleListTranscriptions(c *fiber.Ctx) error {
 			WordsCount:              t.WordsCount,
 			Progress:                t.Progress,
 			DownloadingModel:        t.DownloadingModel,
+			Priority:                t.Priority,
+			NotBefore:               t.NotBefore,
+			Normalize:               t.Normalize,
+			AudioFilter:             t.AudioFilter,
+			DeletedAt:               t.DeletedAt,
+			Error:                   t.Error,
 			Translations:            make([]models.TranslationListItem, 0, len(t.Translations)),
 		}
 		for _, tr := range t.Translations {
@@ -84,25 +118,88 @@ func (s *Server) handleListTranscriptions(c *fiber.Ctx) error {
 
 	// Write the JSON to the response body.
 	c.Set("Content-Type", "application/json")
+	c.Set("X-Total-Count", strconv.FormatInt(page.Total, 10))
+	if page.NextCursor != "" {
+		c.Set("X-Next-Cursor", page.NextCursor)
+	}
 	c.Write(json)
 	return nil
 }
 
-func (s *Server) handleGetTranscriptionById(c *fiber.Ctx) error {
-	id := c.Params("id")
-	t := s.Db.GetTranscription(id)
-	if t == nil {
-		log.Warn().Msgf("Transcription with id %v not found", id)
-		return fiber.NewError(fiber.StatusNotFound, "Not found")
+// listOptionsFromQuery reads the listing parameters from the query string:
+// limit, cursor, status (comma separated), language, modelSize, device,
+// sourceType (file or url), from and to (RFC 3339 or YYYY-MM-DD), sort and
+// order (asc or desc).
+func listOptionsFromQuery(c *fiber.Ctx) (database.ListOptions, error) {
+	opts := database.ListOptions{
+		Language:   c.Query("language"),
+		ModelSize:  c.Query("modelSize"),
+		Device:     c.Query("device"),
+		SourceType: c.Query("sourceType"),
+		SortBy:     c.Query("sort", database.SortByCreated),
+		Cursor:     c.Query("cursor"),
+	}
+
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 || limit > maxListLimit {
+			return opts, fmt.Errorf("limit must be a number between 0 and %v", maxListLimit)
+		}
+		opts.Limit = limit
 	}
-
-	if t.WordsCount == 0 && t.Result.Text != "" {
-		calculated := len(strings.Fields(t.Result.Text))
-		t.WordsCount = calculated
-		if _, err := s.Db.UpdateTranscription(t); err != nil {
-			log.Error().Err(err).Msgf("Error updating words_count for transcription %v", t.ID.Hex())
+	if v := c.Query("status"); v != "" {
+		for _, part := range SplitAndTrim(v, ",") {
+			status, err := strconv.Atoi(part)
+			if err != nil {
+				return opts, fmt.Errorf("invalid status %q", part)
+			}
+			opts.Status = append(opts.Status, status)
 		}
 	}
+	if opts.SourceType != "" && opts.SourceType != models.SourceTypeFile && opts.SourceType != models.SourceTypeURL {
+		return opts, fmt.Errorf("sourceType must be %v or %v", models.SourceTypeFile, models.SourceTypeURL)
+	}
+	if !database.ValidSortBy(opts.SortBy) {
+		return opts, fmt.Errorf("cannot sort by %q", opts.SortBy)
+	}
+	switch c.Query("order", "asc") {
+	case "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return opts, fmt.Errorf("order must be asc or desc")
+	}
+
+	var err error
+	if opts.From, err = parseQueryTime(c.Query("from")); err != nil {
+		return opts, fmt.Errorf("invalid from: %v", err)
+	}
+	if opts.To, err = parseQueryTime(c.Query("to")); err != nil {
+		return opts, fmt.Errorf("invalid to: %v", err)
+	}
+	return opts, nil
+}
+
+// maxListLimit caps the page size of /api/list-transcriptions.
+const maxListLimit = 1000
+
+func parseQueryTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+func (s *Server) handleGetTranscriptionById(c *fiber.Ctx) error {
+	id := c.Params("id")
+	t, err := s.Db.GetTranscription(c.UserContext(), id)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Error getting transcription with id %v", id)
+		return dbError(err)
+	}
 
 	// Convert the transcription to JSON.
 	json, err := json.Marshal(t)
@@ -117,6 +214,28 @@ func (s *Server) handleGetTranscriptionById(c *fiber.Ctx) error {
 	return nil
 }
 
+// handleSearch finds the transcriptions whose result or translations contain
+// the q query parameter. limit caps the number of transcriptions returned.
+func (s *Server) handleSearch(c *fiber.Ctx) error {
+	opts := database.SearchOptions{
+		Query: strings.TrimSpace(c.Query("q")),
+		Limit: c.QueryInt("limit", 50),
+	}
+	if opts.Query == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "q is required")
+	}
+
+	hits, err := s.Db.SearchTranscriptions(c.UserContext(), opts)
+	if err != nil {
+		log.Error().Err(err).Msgf("Error searching for %q", opts.Query)
+		return dbError(err)
+	}
+	if hits == nil {
+		hits = []database.SearchHit{}
+	}
+	return c.JSON(hits)
+}
+
 // This function receives data from a form to create a new transcription.
 // If the transcription is created successfully, it returns a 201 Created status code and
 // broadcasts the new transcription to all ws clients.
@@ -124,6 +243,29 @@ func (s *Server) handlePostTranscription(c *fiber.Ctx) error {
 	log.Debug().Msg("POST /api/transcriptions")
 	var transcription models.Transcription
 
+	// A job can be scheduled to start later. This is checked first, so that
+	// no file is saved for an invalid request.
+	if c.FormValue("notBefore") != "" {
+		notBefore, err := time.Parse(time.RFC3339, c.FormValue("notBefore"))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "notBefore must be an RFC 3339 time, e.g. 2024-01-31T22:00:00Z")
+		}
+		if notBefore.After(time.Now()) {
+			notBefore = notBefore.UTC().Truncate(time.Millisecond)
+			transcription.NotBefore = &notBefore
+		}
+	}
+	if !models.ValidAudioFilter(c.FormValue("audio_filter")) {
+		return fiber.NewError(fiber.StatusBadRequest, "audio_filter must be highpass or denoise")
+	}
+	if c.FormValue("priority") != "" {
+		priority, err := strconv.Atoi(c.FormValue("priority"))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "priority must be an integer")
+		}
+		transcription.Priority = priority
+	}
+
 	// we get the filename from the from
 	var filename string
 	if c.FormValue("sourceUrl") == "" {
@@ -153,6 +295,9 @@ func (s *Server) handlePostTranscription(c *fiber.Ctx) error {
 	transcription.ModelSize = c.FormValue("modelSize")
 	transcription.FileName = filename
 	transcription.Status = models.TranscriptionStatusPending
+	if transcription.NotBefore != nil {
+		transcription.Status = models.TranscriptionStatusScheduled
+	}
 	transcription.Task = "transcribe"
 	transcription.SourceUrl = c.FormValue("sourceUrl")
 	transcription.Device = c.FormValue("device")
@@ -206,9 +351,13 @@ func (s *Server) handlePostTranscription(c *fiber.Ctx) error {
 		}
 	}
 
+	// Audio preprocessing
+	transcription.Normalize = c.FormValue("normalize") == "true"
+	transcription.AudioFilter = c.FormValue("audio_filter")
+
 	log.Debug().Msgf("Transcription: %+v", transcription)
 	// Save transcription to database
-	res, err := s.Db.NewTranscription(&transcription)
+	res, err := s.Db.NewTranscription(c.UserContext(), &transcription)
 	if err != nil {
 		log.Error().Err(err).Msg("Error saving transcription to database")
 		return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
@@ -216,7 +365,11 @@ func (s *Server) handlePostTranscription(c *fiber.Ctx) error {
 
 	// Broadcast transcription to websocket clients
 	s.BroadcastTranscription(res)
-	s.NewTranscriptionCh <- true
+	select {
+	case s.NewTranscriptionCh <- true:
+	default:
+		// A wake up is pending already.
+	}
 
 	// Convert the transcription to JSON.
 	json, err := json.Marshal(res)
@@ -231,6 +384,26 @@ func (s *Server) handlePostTranscription(c *fiber.Ctx) error {
 	return nil
 }
 
+// dbError maps an error returned by the database to the HTTP error sent to
+// the client.
+func dbError(err error) error {
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		return fiber.NewError(fiber.StatusNotFound, "Not found")
+	case errors.Is(err, database.ErrSegmentNotFound):
+		return fiber.NewError(fiber.StatusNotFound, "Segment not found")
+	case errors.Is(err, database.ErrRevisionNotFound):
+		return fiber.NewError(fiber.StatusNotFound, "Revision not found")
+	case errors.Is(err, database.ErrInvalidID):
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid id")
+	case errors.Is(err, database.ErrConflict):
+		return fiber.NewError(fiber.StatusConflict, "Conflict")
+	case errors.Is(err, database.ErrNotModified):
+		return fiber.NewError(fiber.StatusNotModified, "Not modified")
+	}
+	return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+}
+
 // SplitAndTrim splits a string by sep and trims spaces from each part
 func SplitAndTrim(s, sep string) []string {
 	var out []string
@@ -241,27 +414,27 @@ func SplitAndTrim(s, sep string) []string {
 	return out
 }
 
+// handleDeleteTranscription moves a transcription to the trash, and cancels
+// it if it is running. Its media stays on disk until the trash is purged.
 func (s *Server) handleDeleteTranscription(c *fiber.Ctx) error {
-	// First get the transcription from the database
 	id := c.Params("id")
-	t := s.Db.GetTranscription(id)
-	if t == nil {
-		log.Warn().Msgf("Transcription with id %v not found", id)
-		return fiber.NewError(fiber.StatusNotFound, "Not found")
+	t, err := s.Db.TrashTranscription(c.UserContext(), id)
+	if errors.Is(err, database.ErrNotModified) {
+		// In the trash already.
+		c.Status(fiber.StatusOK)
+		return nil
 	}
-
-	// Then delete the file from disk
-	err := os.Remove(fmt.Sprintf("%v/%v", os.Getenv("UPLOAD_DIR"), t.FileName))
 	if err != nil {
-		log.Error().Err(err).Msgf("Error deleting file %v", t.FileName)
+		log.Error().Err(err).Msgf("Error moving transcription %v to the trash", id)
+		return dbError(err)
 	}
-
-	// Finally delete the transcription from the database
-	err = s.Db.DeleteTranscription(id)
-	if err != nil {
-		log.Error().Err(err).Msgf("Error deleting transcription %v", id)
-		return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+	if t.Status == models.TranscriptionStatusRunning {
+		// Don't keep the worker busy with it.
+		if ct, err := s.CancelTranscription(c.UserContext(), id); err == nil {
+			t = ct
+		}
 	}
+	s.BroadcastTranscription(t)
 
 	// Return status deleted
 	c.Status(fiber.StatusOK)
@@ -277,15 +450,28 @@ func (s *Server) handlePatchTranscription(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
 	}
 
+	current, err := s.Db.GetTranscription(c.UserContext(), transcription.ID.Hex())
+	if err != nil {
+		return dbError(err)
+	}
+	before := models.RevisionOf(current)
+
 	// Update the transcription in the database
-	ut, err := s.Db.UpdateTranscription(&transcription)
+	ut, err := s.Db.UpdateTranscription(c.UserContext(), &transcription)
+	if errors.Is(err, database.ErrConflict) {
+		// Send the current document back so the client can merge its edits.
+		log.Warn().Msgf("Transcription %v was modified since version %v", transcription.ID.Hex(), transcription.Version)
+		current, gerr := s.Db.GetTranscription(c.UserContext(), transcription.ID.Hex())
+		if gerr != nil {
+			return dbError(gerr)
+		}
+		return c.Status(fiber.StatusConflict).JSON(current)
+	}
 	if err != nil {
 		log.Error().Err(err).Msgf("Error updating transcription")
-		if err.Error() == "no documents were modified" {
-			return fiber.NewError(fiber.StatusNotModified, "Not found")
-		}
-		return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		return dbError(err)
 	}
+	s.saveRevision(c.UserContext(), before, ut, requestAuthor(c.Get), "")
 
 	// Write the JSON to the response body.
 	s.BroadcastTranscription(ut)
@@ -311,9 +497,9 @@ func (s *Server) handleRenameFile(c *fiber.Ctx) error {
 	}
 
 	// Get the transcription from db
-	transcription := s.Db.GetTranscription(id)
-	if transcription == nil {
-		return fiber.NewError(fiber.StatusNotFound, "Transcription not found")
+	transcription, err := s.Db.GetTranscription(c.UserContext(), id)
+	if err != nil {
+		return dbError(err)
 	}
 
 	// Split current filename to get timeid part
@@ -329,15 +515,14 @@ func (s *Server) handleRenameFile(c *fiber.Ctx) error {
 	newPath := fmt.Sprintf("%v/%v", os.Getenv("UPLOAD_DIR"), newFullFileName)
 
 	// Rename the file on disk
-	err := os.Rename(oldPath, newPath)
+	err = os.Rename(oldPath, newPath)
 	if err != nil {
 		log.Error().Err(err).Msgf("Error renaming file from %v to %v", oldPath, newPath)
 		return fiber.NewError(fiber.StatusInternalServerError, "Error renaming file")
 	}
 
 	// Update filename in database
-	transcription.FileName = newFullFileName
-	updatedTranscription, err := s.Db.UpdateTranscription(transcription)
+	updatedTranscription, err := s.Db.RenameFile(c.UserContext(), id, newFullFileName)
 	if err != nil {
 		// Try to revert the file rename as db update failed
 		os.Rename(newPath, oldPath)
@@ -356,26 +541,81 @@ func (s *Server) handleTranslate(c *fiber.Ctx) error {
 	id := c.Params("id")
 	targetLang := c.Params("target")
 
-	transcription := s.Db.GetTranscription(id)
+	transcription, err := s.Db.GetTranscription(c.UserContext(), id)
+	if err != nil {
+		return dbError(err)
+	}
 
 	// Set status as translating
-	transcription.Status = models.TrannscriptionStatusTranslating
-	s.Db.UpdateTranscription(transcription)
-	s.BroadcastTranscription(transcription)
+	if t, err := s.Db.SetStatus(c.UserContext(), id, models.TrannscriptionStatusTranslating); err != nil {
+		log.Error().Err(err).Msgf("Error updating transcription %v", id)
+	} else {
+		s.BroadcastTranscription(t)
+	}
 
-	err := transcription.Translate(targetLang)
+	before := models.RevisionOf(transcription)
+	err = transcription.Translate(targetLang)
 	if err != nil {
 		log.Debug().Err(err).Msg("Error with translation")
 		return err
 	}
 
+	// Only the new translation is written, so the rest of the document can
+	// change while the translation runs.
+	translation := transcription.Translations[len(transcription.Translations)-1]
+	translated, err := s.Db.AppendTranslation(c.UserContext(), id, translation)
+	if err != nil {
+		log.Error().Err(err).Msgf("Error saving translation of transcription %v", id)
+		return dbError(err)
+	}
+	s.saveRevision(c.UserContext(), before, translated, requestAuthor(c.Get), "")
+
 	// Set as done
-	transcription.Status = models.TranscriptionStatusDone
-	s.Db.UpdateTranscription(transcription)
-	s.BroadcastTranscription(transcription)
+	t, err := s.Db.SetStatus(c.UserContext(), id, models.TranscriptionStatusDone)
+	if err != nil {
+		log.Error().Err(err).Msgf("Error updating transcription %v", id)
+		return dbError(err)
+	}
+	s.BroadcastTranscription(t)
 	return nil
 }
 
+// handlePatchSegment replaces a single segment of the transcription result.
+// The body is the segment; its id is taken from the path.
+func (s *Server) handlePatchSegment(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var segment models.Segment
+	if err := json.Unmarshal(c.Body(), &segment); err != nil {
+		log.Error().Err(err).Msg("Error parsing JSON body")
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+	segment.ID = c.Params("segmentId")
+
+	t, err := s.patchSegment(c.UserContext(), id, segment, requestAuthor(c.Get))
+	if err != nil {
+		log.Warn().Err(err).Msgf("Error patching segment %v of transcription %v", segment.ID, id)
+		return dbError(err)
+	}
+	s.BroadcastTranscription(t)
+	return c.JSON(t)
+}
+
+// patchSegment replaces a segment of the result of the transcription id and
+// saves the previous result as a revision. It serves both the REST endpoint
+// and the websocket.
+func (s *Server) patchSegment(ctx context.Context, id string, segment models.Segment, author string) (*models.Transcription, error) {
+	current, err := s.Db.GetTranscription(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	t, err := s.Db.PatchSegment(ctx, id, segment)
+	if err != nil {
+		return nil, err
+	}
+	s.saveRevision(ctx, models.RevisionOf(current), t, author, "")
+	return t, nil
+}
+
 func (s *Server) handleUploadJSON(c *fiber.Ctx) error {
 	var request struct {
 		TranscriptionId string      `json:"transcriptionId"`
@@ -398,10 +638,11 @@ func (s *Server) handleUploadJSON(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "result is required")
 	}
 
-	// Get the transcription from the database
-	transcription := s.Db.GetTranscription(request.TranscriptionId)
-	if transcription == nil {
-		return fiber.NewError(fiber.StatusNotFound, "Transcription not found")
+	// Get the transcription from the database, to save its current result
+	// as a revision.
+	current, err := s.Db.GetTranscription(c.UserContext(), request.TranscriptionId)
+	if err != nil {
+		return dbError(err)
 	}
 
 	// Validate the JSON structure
@@ -432,18 +673,12 @@ func (s *Server) handleUploadJSON(c *fiber.Ctx) error {
 	}
 
 	// Update the transcription with the new result
-	transcription.Result = whisperResult
-	transcription.WordsCount = len(strings.Fields(whisperResult.Text))
-	updatedTranscription, err := s.Db.UpdateTranscription(transcription)
+	updatedTranscription, err := s.Db.SetResult(c.UserContext(), request.TranscriptionId, whisperResult)
 	if err != nil {
-		if err.Error() == "no documents were modified" {
-			return c.Status(fiber.StatusNotModified).JSON(fiber.Map{
-				"message": "No changes were made",
-			})
-		}
 		log.Error().Err(err).Msg("Error updating transcription in database")
-		return fiber.NewError(fiber.StatusInternalServerError, "Error updating transcription")
+		return dbError(err)
 	}
+	s.saveRevision(c.UserContext(), models.RevisionOf(current), updatedTranscription, requestAuthor(c.Get), "")
 
 	// Broadcast the updated transcription to websocket clients
 	s.BroadcastTranscription(updatedTranscription)
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/goccy/go-json"
+
+	"codeberg.org/pluja/whishper/database"
+	"codeberg.org/pluja/whishper/events"
+	"codeberg.org/pluja/whishper/models"
+)
+
+// newTestServer returns a server over an empty in-memory database, with its
+// routes registered.
+func newTestServer(t *testing.T) *Server {
+	db, err := database.NewMemoryDb("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(":0", db, events.NewLocal(), nil)
+	s.RegisterRoutes()
+	return s
+}
+
+// request sends a request with body, if any, as JSON and returns the status
+// code and the response body.
+func request(t *testing.T, s *Server, method string, path string, body interface{}) (int, []byte) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req := httptest.NewRequest(method, path, r)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.Router.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, b
+}
+
+func TestPatchTranscriptionVersion(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	tr, err := s.Db.NewTranscription(ctx, &models.Transcription{FileName: "a.mp3", Result: models.WhisperResult{Text: "hello"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		version  int64
+		text     string
+		status   int
+		wantText string
+		wantVer  int64
+	}{
+		{"current version", 1, "edited", 200, "edited", 2},
+		{"stale version", 1, "lost edit", 409, "edited", 2},
+		{"next version", 2, "edited again", 200, "edited again", 3},
+	}
+	for _, tt := range tests {
+		edit := *tr
+		edit.Version = tt.version
+		edit.Result = models.WhisperResult{Text: tt.text}
+		status, body := request(t, s, "PATCH", "/api/transcriptions", &edit)
+		if status != tt.status {
+			t.Fatalf("%v: status %v, want %v: %s", tt.name, status, tt.status, body)
+		}
+		// A conflict returns the current document, to merge the edits with.
+		var got models.Transcription
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Result.Text != tt.wantText || got.Version != tt.wantVer {
+			t.Errorf("%v: returned text %q at version %v, want %q at %v", tt.name, got.Result.Text, got.Version, tt.wantText, tt.wantVer)
+		}
+		stored, err := s.Db.GetTranscription(ctx, tr.ID.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Result.Text != tt.wantText || stored.Version != tt.wantVer {
+			t.Errorf("%v: stored text %q at version %v, want %q at %v", tt.name, stored.Result.Text, stored.Version, tt.wantText, tt.wantVer)
+		}
+	}
+}
+
+// The priority of a new job must be an integer, and an invalid one is
+// refused before the media is saved.
+func TestPostTranscriptionPriority(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("UPLOAD_DIR", dir)
+	s := newTestServer(t)
+	for i, tt := range []struct {
+		priority string
+		status   int
+		want     int
+	}{
+		{"", 200, 0},
+		{"-2", 200, -2},
+		{"high", 400, 0},
+		{"3.5", 400, 0},
+	} {
+		var form bytes.Buffer
+		w := multipart.NewWriter(&form)
+		if tt.priority != "" {
+			w.WriteField("priority", tt.priority)
+		}
+		part, err := w.CreateFormFile("file", strconv.Itoa(i)+".mp3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte("media"))
+		w.Close()
+		req := httptest.NewRequest("POST", "/api/transcriptions", &form)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		resp, err := s.Router.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("priority %q: status %v, want %v: %s", tt.priority, resp.StatusCode, tt.status, body)
+			continue
+		}
+		if tt.status != 200 {
+			continue
+		}
+		var got models.Transcription
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Priority != tt.want {
+			t.Errorf("priority %q: got %v, want %v", tt.priority, got.Priority, tt.want)
+		}
+	}
+	// Only the accepted jobs saved their media.
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("%v media files saved, want 2", len(entries))
+	}
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+
+	"codeberg.org/pluja/whishper/database"
+	"codeberg.org/pluja/whishper/models"
+)
+
+// TrackJob registers the cancel function of a job running in this instance,
+// so that cancelling the transcription id stops it. The returned function
+// unregisters it once the job ends.
+func (s *Server) TrackJob(id string, cancel context.CancelFunc) func() {
+	s.jobsMu.Lock()
+	s.jobs[id] = cancel
+	s.jobsMu.Unlock()
+	return func() {
+		s.jobsMu.Lock()
+		delete(s.jobs, id)
+		s.jobsMu.Unlock()
+	}
+}
+
+// stopJob stops the job of the transcription id if it runs in this instance.
+// Jobs running in other instances stop when they fail to renew their lease.
+func (s *Server) stopJob(id string) {
+	s.jobsMu.Lock()
+	cancel, ok := s.jobs[id]
+	s.jobsMu.Unlock()
+	if ok {
+		log.Info().Msgf("Stopping the running job of transcription %v", id)
+		cancel()
+	}
+}
+
+// CancelTranscription drops a pending transcription from the queue, or stops
+// it if it is running, and broadcasts it. It returns ErrNotModified if it is
+// neither.
+func (s *Server) CancelTranscription(ctx context.Context, id string) (*models.Transcription, error) {
+	t, err := s.Db.CancelTranscription(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	s.stopJob(id)
+	s.BroadcastTranscription(t)
+	return t, nil
+}
+
+func (s *Server) handleCancelTranscription(c *fiber.Ctx) error {
+	id := c.Params("id")
+	t, err := s.CancelTranscription(c.UserContext(), id)
+	if errors.Is(err, database.ErrNotModified) {
+		return fiber.NewError(fiber.StatusConflict, "Only pending and running transcriptions can be cancelled")
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Error cancelling transcription %v", id)
+		return dbError(err)
+	}
+	return c.JSON(t)
+}
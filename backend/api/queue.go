@@ -0,0 +1,81 @@
+package api
+
+import (
+	"errors"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+
+	"codeberg.org/pluja/whishper/database"
+	"codeberg.org/pluja/whishper/models"
+)
+
+// handleGetQueue lists the pending transcriptions in the order they will run.
+func (s *Server) handleGetQueue(c *fiber.Ctx) error {
+	pending, err := s.Db.GetPendingTranscriptions(c.UserContext())
+	if err != nil {
+		log.Error().Err(err).Msg("Error getting pending transcriptions")
+		return dbError(err)
+	}
+	if pending == nil {
+		pending = []*models.Transcription{}
+	}
+	return c.JSON(pending)
+}
+
+// handleReorderQueue changes the place of a pending transcription in the
+// queue. The body either sets its priority, {"priority": 5}, or bumps it
+// ahead of every other pending job, {"bump": true}.
+func (s *Server) handleReorderQueue(c *fiber.Ctx) error {
+	var request struct {
+		Priority *int `json:"priority"`
+		Bump     bool `json:"bump"`
+	}
+	if err := json.Unmarshal(c.Body(), &request); err != nil {
+		log.Error().Err(err).Msg("Error parsing JSON body")
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid JSON format")
+	}
+	if (request.Priority == nil) == !request.Bump {
+		return fiber.NewError(fiber.StatusBadRequest, "Either priority or bump is required")
+	}
+
+	id := c.Params("id")
+	t, err := s.Db.GetTranscription(c.UserContext(), id)
+	if err != nil {
+		return dbError(err)
+	}
+	if t.Status != models.TranscriptionStatusPending || t.DeletedAt != nil {
+		return fiber.NewError(fiber.StatusConflict, "Only pending transcriptions can be reordered")
+	}
+
+	priority := t.Priority
+	if request.Priority != nil {
+		priority = *request.Priority
+	} else {
+		pending, err := s.Db.GetPendingTranscriptions(c.UserContext())
+		if err != nil {
+			log.Error().Err(err).Msg("Error getting pending transcriptions")
+			return dbError(err)
+		}
+		// The queue is in order: get ahead of its head, unless it is the head.
+		if len(pending) > 0 && pending[0].ID != t.ID {
+			priority = pending[0].Priority + 1
+		}
+	}
+	if priority == t.Priority {
+		return c.JSON(t)
+	}
+
+	ut, err := s.Db.SetPriority(c.UserContext(), id, priority)
+	if errors.Is(err, database.ErrConflict) {
+		// Claimed, cancelled or trashed since it was read.
+		return fiber.NewError(fiber.StatusConflict, "Only pending transcriptions can be reordered")
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Error setting the priority of transcription %v", id)
+		return dbError(err)
+	}
+	s.BroadcastTranscription(ut)
+	return c.JSON(ut)
+}
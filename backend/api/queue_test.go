@@ -0,0 +1,81 @@
+package api
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/goccy/go-json"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+func TestReorderQueue(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	ids := map[string]string{}
+	for _, tr := range []*models.Transcription{
+		{FileName: "a", Status: models.TranscriptionStatusPending},
+		{FileName: "b", Status: models.TranscriptionStatusPending},
+		{FileName: "c", Status: models.TranscriptionStatusPending},
+		{FileName: "done", Status: models.TranscriptionStatusDone},
+		{FileName: "trashed", Status: models.TranscriptionStatusPending},
+	} {
+		created, err := s.Db.NewTranscription(ctx, tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[tr.FileName] = created.ID.Hex()
+	}
+	if _, err := s.Db.TrashTranscription(ctx, ids["trashed"]); err != nil {
+		t.Fatal(err)
+	}
+
+	priority := func(p int) *int { return &p }
+	type reorder struct {
+		Priority *int `json:"priority,omitempty"`
+		Bump     bool `json:"bump,omitempty"`
+	}
+	// The steps run in order, on the queue left by the earlier ones.
+	tests := []struct {
+		name   string
+		target string
+		body   reorder
+		status int
+		queue  []string
+	}{
+		{"bump", "c", reorder{Bump: true}, 200, []string{"c", "a", "b"}},
+		{"set priority", "b", reorder{Priority: priority(5)}, 200, []string{"b", "c", "a"}},
+		{"bump past a priority", "c", reorder{Bump: true}, 200, []string{"c", "b", "a"}},
+		{"bump the head", "c", reorder{Bump: true}, 200, []string{"c", "b", "a"}},
+		{"lower priority", "c", reorder{Priority: priority(-1)}, 200, []string{"b", "a", "c"}},
+		{"priority and bump", "a", reorder{Priority: priority(1), Bump: true}, 400, []string{"b", "a", "c"}},
+		{"nothing", "a", reorder{}, 400, []string{"b", "a", "c"}},
+		{"not pending", "done", reorder{Bump: true}, 409, []string{"b", "a", "c"}},
+		{"in the trash", "trashed", reorder{Bump: true}, 409, []string{"b", "a", "c"}},
+		{"unknown", "", reorder{Bump: true}, 404, []string{"b", "a", "c"}},
+	}
+	for _, tt := range tests {
+		id, ok := ids[tt.target]
+		if !ok {
+			id = "650000000000000000000001"
+		}
+		status, body := request(t, s, "PATCH", "/api/queue/"+id, tt.body)
+		if status != tt.status {
+			t.Fatalf("%v: status %v, want %v: %s", tt.name, status, tt.status, body)
+		}
+
+		var queue []models.Transcription
+		status, body = request(t, s, "GET", "/api/queue", nil)
+		if err := json.Unmarshal(body, &queue); status != 200 || err != nil {
+			t.Fatalf("%v: listing the queue: status %v, %v: %s", tt.name, status, err, body)
+		}
+		var got []string
+		for _, tr := range queue {
+			got = append(got, tr.FileName)
+		}
+		if !reflect.DeepEqual(got, tt.queue) {
+			t.Errorf("%v: queue %v, want %v", tt.name, got, tt.queue)
+		}
+	}
+}
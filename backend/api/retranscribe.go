@@ -0,0 +1,141 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+
+	"codeberg.org/pluja/whishper/database"
+	"codeberg.org/pluja/whishper/models"
+)
+
+// retranscribeRequest holds the job parameters to change when running a
+// transcription again. The ones left out keep their value.
+type retranscribeRequest struct {
+	Language                *string   `json:"language"`
+	ModelSize               *string   `json:"modelSize"`
+	BeamSize                *int      `json:"beam_size"`
+	InitialPrompt           *string   `json:"initial_prompt"`
+	Hotwords                *[]string `json:"hotwords"`
+	VadFilter               *bool     `json:"vad_filter"`
+	VadThreshold            *float64  `json:"vad_threshold"`
+	VadMinSpeechDurationMS  *int      `json:"vad_min_speech_duration_ms"`
+	VadMinSilenceDurationMS *int      `json:"vad_min_silence_duration_ms"`
+	Normalize               *bool     `json:"normalize"`
+	AudioFilter             *string   `json:"audio_filter"`
+}
+
+// apply sets the parameters of the request on t.
+func (r *retranscribeRequest) apply(t *models.Transcription) {
+	if r.Language != nil {
+		t.Language = *r.Language
+	}
+	if r.ModelSize != nil {
+		t.ModelSize = *r.ModelSize
+	}
+	if r.BeamSize != nil {
+		t.BeamSize = *r.BeamSize
+	}
+	if r.InitialPrompt != nil {
+		t.InitialPrompt = *r.InitialPrompt
+	}
+	if r.Hotwords != nil {
+		var hotwords []string
+		for _, hw := range *r.Hotwords {
+			if hw = strings.TrimSpace(hw); hw != "" {
+				hotwords = append(hotwords, hw)
+			}
+		}
+		t.Hotwords = hotwords
+	}
+	if r.VadFilter != nil {
+		t.VadFilter = *r.VadFilter
+	}
+	if r.VadThreshold != nil {
+		t.VadThreshold = r.VadThreshold
+	}
+	if r.VadMinSpeechDurationMS != nil {
+		t.VadMinSpeechDurationMS = r.VadMinSpeechDurationMS
+	}
+	if r.VadMinSilenceDurationMS != nil {
+		t.VadMinSilenceDurationMS = r.VadMinSilenceDurationMS
+	}
+	if r.Normalize != nil {
+		t.Normalize = *r.Normalize
+	}
+	if r.AudioFilter != nil {
+		t.AudioFilter = *r.AudioFilter
+	}
+}
+
+// handleRetranscribe runs a done, failed or cancelled transcription again on
+// its stored media, with the job parameters of the body changed. The result
+// and translations it replaces are saved as a revision, so they can be
+// restored.
+func (s *Server) handleRetranscribe(c *fiber.Ctx) error {
+	var request retranscribeRequest
+	if len(c.Body()) > 0 {
+		if err := json.Unmarshal(c.Body(), &request); err != nil {
+			log.Error().Err(err).Msg("Error parsing JSON body")
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid JSON format")
+		}
+	}
+	if request.BeamSize != nil && *request.BeamSize < 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "beam_size can't be negative")
+	}
+	if request.AudioFilter != nil && !models.ValidAudioFilter(*request.AudioFilter) {
+		return fiber.NewError(fiber.StatusBadRequest, "audio_filter must be highpass or denoise")
+	}
+
+	id := c.Params("id")
+	t, err := s.Db.GetTranscription(c.UserContext(), id)
+	if err == nil && t.DeletedAt != nil {
+		// Transcriptions in the trash are hidden until restored.
+		err = database.ErrNotFound
+	}
+	if err != nil {
+		return dbError(err)
+	}
+	switch t.Status {
+	case models.TranscriptionStatusDone, models.TranscriptionStatusError, models.TranscriptionStatusCancelled:
+	default:
+		return fiber.NewError(fiber.StatusConflict, "Only done, failed and cancelled transcriptions can be re-transcribed")
+	}
+	// The media is reused. Jobs that failed before downloading theirs
+	// download it again.
+	if t.FileName != "" {
+		if _, err := os.Stat(filepath.Join(os.Getenv("UPLOAD_DIR"), t.FileName)); err != nil {
+			log.Error().Err(err).Msgf("Media file of transcription %v not found", id)
+			return fiber.NewError(fiber.StatusConflict, "The media file of this transcription is gone")
+		}
+	} else if t.SourceUrl == "" {
+		return fiber.NewError(fiber.StatusConflict, "This transcription has no media")
+	}
+
+	before := models.RevisionOf(t)
+	next := *t
+	request.apply(&next)
+	ut, err := s.Db.Retranscribe(c.UserContext(), &next)
+	if errors.Is(err, database.ErrConflict) {
+		return fiber.NewError(fiber.StatusConflict, "The transcription changed, try again")
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Error re-transcribing transcription %v", id)
+		return dbError(err)
+	}
+	s.saveRevision(c.UserContext(), before, ut, requestAuthor(c.Get), fmt.Sprintf("Re-transcribed with the %v model", ut.ModelSize))
+
+	s.BroadcastTranscription(ut)
+	select {
+	case s.NewTranscriptionCh <- true:
+	default:
+		// A wake up is pending already.
+	}
+	return c.JSON(ut)
+}
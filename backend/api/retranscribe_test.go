@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+// Re-transcribing queues the job again with the new parameters, and drops
+// what its last run left behind.
+func TestRetranscribe(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("UPLOAD_DIR", dir)
+	s := newTestServer(t)
+	ctx := context.Background()
+	if err := os.WriteFile(filepath.Join(dir, "a.mp3"), []byte("media"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Minute)
+	tr, err := s.Db.NewTranscription(ctx, &models.Transcription{
+		Status:         models.TranscriptionStatusError,
+		FileName:       "a.mp3",
+		ModelSize:      "small",
+		Progress:       0.5,
+		Result:         models.WhisperResult{Text: "hello", Segments: []models.Segment{{ID: "1", Text: "hello"}}},
+		Error:          &models.JobError{Stage: models.ErrorStageSave, Attempts: 1},
+		LeaseOwner:     "w",
+		LeaseExpiresAt: &expires,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, body := request(t, s, "POST", "/api/transcriptions/"+tr.ID.Hex()+"/retranscribe", map[string]string{"modelSize": "large-v3"})
+	if status != 200 {
+		t.Fatalf("re-transcribing: status %v: %s", status, body)
+	}
+	var got models.Transcription
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.Db.GetTranscription(ctx, tr.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, got := range []*models.Transcription{&got, stored} {
+		if got.Status != models.TranscriptionStatusPending || got.ModelSize != "large-v3" || got.FileName != "a.mp3" {
+			t.Errorf("got %+v, want it pending with the large-v3 model", got)
+		}
+		if got.Result.Text != "" || len(got.Result.Segments) != 0 || got.Error != nil || got.Progress != 0 {
+			t.Errorf("got result %+v, error %+v and progress %v, want them reset", got.Result, got.Error, got.Progress)
+		}
+		if got.LeaseOwner != "" || got.LeaseExpiresAt != nil {
+			t.Errorf("got lease %v until %v, want none", got.LeaseOwner, got.LeaseExpiresAt)
+		}
+	}
+	revisions, err := s.Db.ListRevisions(ctx, tr.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 1 {
+		t.Errorf("%v revisions, want the replaced result saved", len(revisions))
+	}
+	if len(s.NewTranscriptionCh) != 1 {
+		t.Errorf("%v wake ups, want 1", len(s.NewTranscriptionCh))
+	}
+}
+
+func TestRetranscribeRefused(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("UPLOAD_DIR", dir)
+	s := newTestServer(t)
+	ctx := context.Background()
+	if err := os.WriteFile(filepath.Join(dir, "a.mp3"), []byte("media"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	newJob := func(status int, fileName string, trashed bool) string {
+		tr, err := s.Db.NewTranscription(ctx, &models.Transcription{Status: status, FileName: fileName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if trashed {
+			if _, err := s.Db.TrashTranscription(ctx, tr.ID.Hex()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return tr.ID.Hex()
+	}
+
+	tests := []struct {
+		name string
+		id   string
+		want int
+	}{
+		{"running", newJob(models.TranscriptionStatusRunning, "a.mp3", false), 409},
+		{"pending", newJob(models.TranscriptionStatusPending, "a.mp3", false), 409},
+		{"media gone", newJob(models.TranscriptionStatusDone, "gone.mp3", false), 409},
+		{"no media", newJob(models.TranscriptionStatusDone, "", false), 409},
+		{"trashed", newJob(models.TranscriptionStatusDone, "a.mp3", true), 404},
+		{"missing", primitive.NewObjectID().Hex(), 404},
+	}
+	versions := map[string]int64{}
+	for _, tt := range tests[:len(tests)-1] {
+		tr, err := s.Db.GetTranscription(ctx, tt.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions[tt.id] = tr.Version
+	}
+
+	for _, tt := range tests {
+		status, body := request(t, s, "POST", "/api/transcriptions/"+tt.id+"/retranscribe", nil)
+		if status != tt.want {
+			t.Errorf("%v: status %v, want %v: %s", tt.name, status, tt.want, body)
+		}
+	}
+	for _, tt := range tests[:len(tests)-1] {
+		tr, err := s.Db.GetTranscription(ctx, tt.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tr.Version != versions[tt.id] {
+			t.Errorf("%v: written, at version %v from %v", tt.name, tr.Version, versions[tt.id])
+		}
+	}
+}
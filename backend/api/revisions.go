@@ -0,0 +1,148 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+
+	"codeberg.org/pluja/whishper/database"
+	"codeberg.org/pluja/whishper/models"
+)
+
+// authorHeaders are the headers an authenticating reverse proxy uses to pass
+// the user name on. Whishper has no users of its own.
+var authorHeaders = []string{"Remote-User", "X-Forwarded-User"}
+
+// requestAuthor returns the user behind a request, if a proxy told us.
+func requestAuthor(header func(key string, defaultValue ...string) string) string {
+	for _, key := range authorHeaders {
+		if user := header(key); user != "" {
+			return user
+		}
+	}
+	return ""
+}
+
+// saveRevision saves before, the state of a transcription right before a
+// change, as a revision if after changed its result or translations. Without
+// a summary, one is made from the changes. Errors are only logged: the
+// change itself is already saved.
+func (s *Server) saveRevision(ctx context.Context, before models.Revision, after *models.Transcription, author string, summary string) {
+	now := models.RevisionOf(after)
+	changes := before.ChangeSummary(&now)
+	if changes == "" {
+		return
+	}
+	if summary == "" {
+		summary = changes
+	}
+	before.Author = author
+	before.Summary = summary
+	if _, err := s.Db.AddRevision(ctx, &before); err != nil {
+		log.Error().Err(err).Msgf("Error saving a revision of transcription %v", after.ID.Hex())
+	}
+}
+
+func (s *Server) handleListRevisions(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if _, err := s.Db.GetTranscription(c.UserContext(), id); err != nil {
+		return dbError(err)
+	}
+	revisions, err := s.Db.ListRevisions(c.UserContext(), id)
+	if err != nil {
+		log.Error().Err(err).Msgf("Error listing the revisions of transcription %v", id)
+		return dbError(err)
+	}
+	if revisions == nil {
+		revisions = []*models.Revision{}
+	}
+	return c.JSON(revisions)
+}
+
+func (s *Server) handleGetRevision(c *fiber.Ctx) error {
+	revision, err := s.Db.GetRevision(c.UserContext(), c.Params("id"), c.Params("revisionId"))
+	if err != nil {
+		return dbError(err)
+	}
+	return c.JSON(revision)
+}
+
+// handleDiffRevisions compares two revisions given by the from and to query
+// parameters. to defaults to "current", the current state of the
+// transcription.
+func (s *Server) handleDiffRevisions(c *fiber.Ctx) error {
+	id := c.Params("id")
+	fromID, toID := c.Query("from"), c.Query("to", "current")
+	if fromID == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "from is required")
+	}
+
+	from, err := s.revisionOrCurrent(c.UserContext(), id, fromID)
+	if err != nil {
+		return dbError(err)
+	}
+	to, err := s.revisionOrCurrent(c.UserContext(), id, toID)
+	if err != nil {
+		return dbError(err)
+	}
+
+	changes := from.Diff(to)
+	if changes == nil {
+		changes = []models.SegmentChange{}
+	}
+	return c.JSON(fiber.Map{
+		"from":    fromID,
+		"to":      toID,
+		"summary": from.ChangeSummary(to),
+		"changes": changes,
+	})
+}
+
+// revisionOrCurrent returns the revision revisionID, or the current state of
+// the transcription if revisionID is "current".
+func (s *Server) revisionOrCurrent(ctx context.Context, id string, revisionID string) (*models.Revision, error) {
+	if revisionID == "current" {
+		t, err := s.Db.GetTranscription(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		current := models.RevisionOf(t)
+		return &current, nil
+	}
+	return s.Db.GetRevision(ctx, id, revisionID)
+}
+
+// handleRestoreRevision brings back the result and translations of a
+// revision. The state it replaces is saved as a revision too, so a restore
+// can be undone.
+func (s *Server) handleRestoreRevision(c *fiber.Ctx) error {
+	id := c.Params("id")
+	revision, err := s.Db.GetRevision(c.UserContext(), id, c.Params("revisionId"))
+	if err != nil {
+		return dbError(err)
+	}
+	t, err := s.Db.GetTranscription(c.UserContext(), id)
+	if err != nil {
+		return dbError(err)
+	}
+
+	before := models.RevisionOf(t)
+	t.Result = revision.Result
+	t.Translations = revision.Translations
+	t.WordsCount = revision.Result.WordsCount()
+	ut, err := s.Db.UpdateTranscription(c.UserContext(), t)
+	if errors.Is(err, database.ErrNotModified) {
+		return c.JSON(t)
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Error restoring revision %v of transcription %v", revision.ID.Hex(), id)
+		return dbError(err)
+	}
+	s.saveRevision(c.UserContext(), before, ut, requestAuthor(c.Get), fmt.Sprintf("Restored revision %v", revision.ID.Hex()))
+
+	s.BroadcastTranscription(ut)
+	return c.JSON(ut)
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/goccy/go-json"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+func TestRequestAuthor(t *testing.T) {
+	tests := []struct {
+		headers map[string]string
+		want    string
+	}{
+		{map[string]string{}, ""},
+		{map[string]string{"X-Forwarded-User": "bob"}, "bob"},
+		{map[string]string{"Remote-User": "alice", "X-Forwarded-User": "bob"}, "alice"},
+	}
+	for _, tt := range tests {
+		header := func(key string, defaultValue ...string) string { return tt.headers[key] }
+		if got := requestAuthor(header); got != tt.want {
+			t.Errorf("requestAuthor(%v) = %q, want %q", tt.headers, got, tt.want)
+		}
+	}
+}
+
+func TestRevisionDiffAndRestore(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	tr, err := s.Db.NewTranscription(ctx, &models.Transcription{
+		FileName: "a.mp3",
+		Result: models.WhisperResult{
+			Text:     "Hello world. Good night.",
+			Segments: []models.Segment{{ID: "1", Text: "Hello world."}, {ID: "2", Text: "Good night."}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "/api/transcriptions/" + tr.ID.Hex()
+
+	status, body := request(t, s, "PATCH", base+"/segments/2", models.Segment{Text: "Good morning."})
+	if status != 200 {
+		t.Fatalf("patching a segment: status %v: %s", status, body)
+	}
+
+	var revisions []models.Revision
+	status, body = request(t, s, "GET", base+"/revisions", nil)
+	if err := json.Unmarshal(body, &revisions); status != 200 || err != nil {
+		t.Fatalf("listing revisions: status %v, %v: %s", status, err, body)
+	}
+	if len(revisions) != 1 || revisions[0].Summary != "Edited 1 segment" || revisions[0].Version != tr.Version {
+		t.Fatalf("revisions %+v, want the one before the edit", revisions)
+	}
+	edit := revisions[0].ID.Hex()
+
+	var diff struct {
+		Summary string                 `json:"summary"`
+		Changes []models.SegmentChange `json:"changes"`
+	}
+	status, body = request(t, s, "GET", base+"/revisions/diff?from="+edit, nil)
+	if err := json.Unmarshal(body, &diff); status != 200 || err != nil {
+		t.Fatalf("diffing: status %v, %v: %s", status, err, body)
+	}
+	if len(diff.Changes) != 1 || diff.Changes[0].SegmentID != "2" || diff.Changes[0].After.Text != "Good morning." {
+		t.Errorf("diff %+v, want the edited segment", diff)
+	}
+
+	tests := []struct {
+		name      string
+		revision  string
+		status    int
+		text      string
+		revisions int
+	}{
+		{"restore", edit, 200, "Hello world. Good night.", 2},
+		// The state is the one of the revision already.
+		{"restore again", edit, 200, "Hello world. Good night.", 2},
+		{"unknown revision", "650000000000000000000001", 404, "Hello world. Good night.", 2},
+		{"invalid revision", "nope", 404, "Hello world. Good night.", 2},
+	}
+	for _, tt := range tests {
+		status, body := request(t, s, "POST", base+"/revisions/"+tt.revision+"/restore", nil)
+		if status != tt.status {
+			t.Fatalf("%v: status %v, want %v: %s", tt.name, status, tt.status, body)
+		}
+		got, err := s.Db.GetTranscription(ctx, tr.ID.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Result.Text != tt.text || got.Result.Segments[1].Text != "Good night." {
+			t.Errorf("%v: result %+v, want the restored one", tt.name, got.Result)
+		}
+		revisions, err := s.Db.ListRevisions(ctx, tr.ID.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(revisions) != tt.revisions {
+			t.Errorf("%v: %v revisions, want %v", tt.name, len(revisions), tt.revisions)
+		}
+	}
+	// The restore can be undone.
+	latest, err := s.Db.ListRevisions(ctx, tr.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest[0].Summary != "Restored revision "+edit {
+		t.Errorf("newest revision %q, want the restore", latest[0].Summary)
+	}
+}
@@ -1,7 +1,10 @@
 package api
 
 import (
+	"context"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/goccy/go-json"
 	"github.com/gofiber/contrib/websocket"
@@ -9,20 +12,29 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/rs/zerolog/log"
 
+	"codeberg.org/pluja/whishper/asr"
 	"codeberg.org/pluja/whishper/database"
+	"codeberg.org/pluja/whishper/events"
 	"codeberg.org/pluja/whishper/models"
-	"codeberg.org/pluja/whishper/utils"
 )
 
 type Server struct {
-	ListenAddr         string
-	Router             *fiber.App
-	Db                 database.Db
+	ListenAddr string
+	Router     *fiber.App
+	Db         database.Db
+	// Bus carries the updates to the websocket clients of every instance.
+	Bus                events.Bus
 	NewTranscriptionCh chan bool
-	clients            []*websocket.Conn
+	clientsMu          sync.Mutex
+	clients            []*wsClient
+	// jobs holds the cancel functions of the jobs running in this instance.
+	jobsMu sync.Mutex
+	jobs   map[string]context.CancelFunc
+	// ASR routes the jobs to the transcription services.
+	ASR *asr.Router
 }
 
-func NewServer(listenAddr string, db database.Db) *Server {
+func NewServer(listenAddr string, db database.Db, bus events.Bus, router *asr.Router) *Server {
 	return &Server{
 		ListenAddr: listenAddr,
 		Router: fiber.New(fiber.Config{
@@ -32,23 +44,72 @@ func NewServer(listenAddr string, db database.Db) *Server {
 			ServerHeader: "Fiber",              // Optional, for easier debugging
 		}),
 		Db:                 db,
-		clients:            make([]*websocket.Conn, 0),
+		Bus:                bus,
+		clients:            make([]*wsClient, 0),
+		jobs:               make(map[string]context.CancelFunc),
 		NewTranscriptionCh: make(chan bool, 100),
+		ASR:                router,
 	}
 }
 
 func (s *Server) Run() {
+	updates, err := s.Bus.Subscribe(context.Background())
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error subscribing to transcription updates")
+	}
+	go s.sendUpdates(updates)
 	s.SetupWebsocket()
 	s.SetupMiddleware()
 	s.RegisterRoutes()
 	s.Router.Listen(s.ListenAddr)
 }
 
+// wsClient is a websocket connection with the updates waiting to be written
+// to it. Each client has its own writer, so a slow one doesn't hold up the
+// others.
+type wsClient struct {
+	conn *websocket.Conn
+	send chan []byte
+}
+
+const (
+	// wsSendBuffer is how many updates wait for a client before the next
+	// ones are dropped.
+	wsSendBuffer = 64
+	// wsWriteTimeout is how long a write to a client may take before the
+	// connection is closed.
+	wsWriteTimeout = 10 * time.Second
+)
+
+// writeUpdates writes the updates of client until its send channel is
+// closed. A failed write closes the connection, which ends the read loop.
+func writeUpdates(client *wsClient) {
+	for msg := range client.send {
+		client.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		if err := client.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			log.Error().Err(err).Msg("Error broadcasting message:")
+			client.conn.Close()
+			break
+		}
+	}
+	// Let the broadcasts go on until the client is removed.
+	for range client.send {
+	}
+}
+
 func (s *Server) SetupWebsocket() {
 	s.Router.Get("/ws/transcriptions", websocket.New(func(c *websocket.Conn) {
+		client := &wsClient{conn: c, send: make(chan []byte, wsSendBuffer)}
+		written := make(chan struct{})
+		go func() {
+			defer close(written)
+			writeUpdates(client)
+		}()
 
 		// Add this connection to the slice of clients
-		s.clients = append(s.clients, c)
+		s.clientsMu.Lock()
+		s.clients = append(s.clients, client)
+		s.clientsMu.Unlock()
 
 		for {
 			_, msg, err := c.ReadMessage()
@@ -60,7 +121,12 @@ func (s *Server) SetupWebsocket() {
 					log.Debug().Err(err).Msgf("Error reading message")
 				}
 				// Remove the client from the slice if it has disconnected
-				s.clients = removeWsClient(s.clients, c)
+				s.clientsMu.Lock()
+				s.clients = removeWsClient(s.clients, client)
+				close(client.send)
+				s.clientsMu.Unlock()
+				// The connection is released once the handler returns.
+				<-written
 				return
 			}
 			s.handleWebsocketMessage(c, msg)
@@ -68,22 +134,43 @@ func (s *Server) SetupWebsocket() {
 	}))
 }
 
+// BroadcastTranscription sends t to the websocket clients of every instance.
+// The update is sent later, so a copy of t is published: callers may go on
+// changing t.
 func (s *Server) BroadcastTranscription(t *models.Transcription) {
-	// Convert the transcription to JSON.
-	json, err := json.Marshal(&t)
-	if err != nil {
-		log.Error().Err(err).Msg("Error marshalling transcription to JSON:")
-		return
+	if err := s.Bus.Publish(context.Background(), t.Clone()); err != nil {
+		log.Error().Err(err).Msgf("Error publishing transcription %v", t.ID.Hex())
 	}
-	for _, client := range s.clients {
-		if err := client.WriteMessage(websocket.TextMessage, json); err != nil {
-			log.Error().Err(err).Msg("Error broadcasting message:")
+}
+
+// sendUpdates hands the updates received from the bus to the writers of the
+// websocket clients of this instance, which are the only writers to the
+// connections.
+func (s *Server) sendUpdates(updates <-chan *models.Transcription) {
+	for t := range updates {
+		// Convert the transcription to JSON.
+		json, err := json.Marshal(t)
+		if err != nil {
+			log.Error().Err(err).Msg("Error marshalling transcription to JSON:")
+			continue
 		}
+		s.clientsMu.Lock()
+		for _, client := range s.clients {
+			select {
+			case client.send <- json:
+			default:
+				log.Warn().Msgf("Dropped an update for the slow websocket client %v", client.conn.RemoteAddr())
+			}
+		}
+		s.clientsMu.Unlock()
 	}
 }
 
 func (s *Server) SetupMiddleware() {
-	s.Router.Use(cors.New())
+	s.Router.Use(cors.New(cors.Config{
+		// Let browsers read the pagination headers of the listings.
+		ExposeHeaders: "X-Total-Count, X-Next-Cursor",
+	}))
 }
 
 func (s *Server) RegisterRoutes() {
@@ -108,6 +195,16 @@ func (s *Server) RegisterRoutes() {
 		return err
 	})
 
+	// Register HTTP route for searching the text of every transcription.
+	s.Router.Get("/api/search", func(c *fiber.Ctx) error {
+		log.Debug().Msgf("GET /api/search?q=%v", c.Query("q"))
+		err := s.handleSearch(c)
+		if err != nil {
+			log.Error().Err(err).Msg("Error handling GET /api/search")
+		}
+		return err
+	})
+
 	// Register HTTP route for getting initial state.
 	s.Router.Get("/api/transcriptions/:id", func(c *fiber.Ctx) error {
 		log.Debug().Msgf("GET /api/transcriptions/%v", c.Params("id"))
@@ -157,6 +254,52 @@ func (s *Server) RegisterRoutes() {
 		return err
 	})
 
+	s.Router.Patch("/api/transcriptions/:id/segments/:segmentId", func(c *fiber.Ctx) error {
+		log.Debug().Msgf("PATCH /api/transcriptions/%v/segments/%v", c.Params("id"), c.Params("segmentId"))
+		err := s.handlePatchSegment(c)
+		if err != nil {
+			log.Error().Err(err).Msg("Error handling PATCH /api/transcriptions/:id/segments/:segmentId")
+		}
+		return err
+	})
+
+	s.Router.Get("/api/transcriptions/:id/revisions", func(c *fiber.Ctx) error {
+		log.Debug().Msgf("GET /api/transcriptions/%v/revisions", c.Params("id"))
+		err := s.handleListRevisions(c)
+		if err != nil {
+			log.Error().Err(err).Msg("Error handling GET /api/transcriptions/:id/revisions")
+		}
+		return err
+	})
+
+	// Registered before :revisionId, which would match "diff" too.
+	s.Router.Get("/api/transcriptions/:id/revisions/diff", func(c *fiber.Ctx) error {
+		log.Debug().Msgf("GET /api/transcriptions/%v/revisions/diff", c.Params("id"))
+		err := s.handleDiffRevisions(c)
+		if err != nil {
+			log.Error().Err(err).Msg("Error handling GET /api/transcriptions/:id/revisions/diff")
+		}
+		return err
+	})
+
+	s.Router.Get("/api/transcriptions/:id/revisions/:revisionId", func(c *fiber.Ctx) error {
+		log.Debug().Msgf("GET /api/transcriptions/%v/revisions/%v", c.Params("id"), c.Params("revisionId"))
+		err := s.handleGetRevision(c)
+		if err != nil {
+			log.Error().Err(err).Msg("Error handling GET /api/transcriptions/:id/revisions/:revisionId")
+		}
+		return err
+	})
+
+	s.Router.Post("/api/transcriptions/:id/revisions/:revisionId/restore", func(c *fiber.Ctx) error {
+		log.Debug().Msgf("POST /api/transcriptions/%v/revisions/%v/restore", c.Params("id"), c.Params("revisionId"))
+		err := s.handleRestoreRevision(c)
+		if err != nil {
+			log.Error().Err(err).Msg("Error handling POST /api/transcriptions/:id/revisions/:revisionId/restore")
+		}
+		return err
+	})
+
 	// Register HTTP route for receiving the form data and creating new transcription job.
 	s.Router.Delete("/api/transcriptions/:id", func(c *fiber.Ctx) error {
 		log.Debug().Msgf("DELETE /api/transcriptions/%v", c.Params("id"))
@@ -167,6 +310,80 @@ func (s *Server) RegisterRoutes() {
 		return err
 	})
 
+	// Queue: the pending transcriptions, in the order they will run.
+	s.Router.Get("/api/queue", func(c *fiber.Ctx) error {
+		log.Debug().Msg("GET /api/queue")
+		err := s.handleGetQueue(c)
+		if err != nil {
+			log.Error().Err(err).Msg("Error handling GET /api/queue")
+		}
+		return err
+	})
+
+	s.Router.Patch("/api/queue/:id", func(c *fiber.Ctx) error {
+		log.Debug().Msgf("PATCH /api/queue/%v", c.Params("id"))
+		err := s.handleReorderQueue(c)
+		if err != nil {
+			log.Error().Err(err).Msg("Error handling PATCH /api/queue/:id")
+		}
+		return err
+	})
+
+	s.Router.Post("/api/transcriptions/:id/cancel", func(c *fiber.Ctx) error {
+		log.Debug().Msgf("POST /api/transcriptions/%v/cancel", c.Params("id"))
+		err := s.handleCancelTranscription(c)
+		if err != nil {
+			log.Error().Err(err).Msg("Error handling POST /api/transcriptions/:id/cancel")
+		}
+		return err
+	})
+
+	s.Router.Post("/api/transcriptions/:id/retranscribe", func(c *fiber.Ctx) error {
+		log.Debug().Msgf("POST /api/transcriptions/%v/retranscribe", c.Params("id"))
+		err := s.handleRetranscribe(c)
+		if err != nil {
+			log.Error().Err(err).Msg("Error handling POST /api/transcriptions/:id/retranscribe")
+		}
+		return err
+	})
+
+	// Trash: deleted transcriptions can be restored until they are purged.
+	s.Router.Get("/api/trash", func(c *fiber.Ctx) error {
+		log.Debug().Msg("GET /api/trash")
+		err := s.handleListTrash(c)
+		if err != nil {
+			log.Error().Err(err).Msg("Error handling GET /api/trash")
+		}
+		return err
+	})
+
+	s.Router.Delete("/api/trash", func(c *fiber.Ctx) error {
+		log.Debug().Msg("DELETE /api/trash")
+		err := s.handleEmptyTrash(c)
+		if err != nil {
+			log.Error().Err(err).Msg("Error handling DELETE /api/trash")
+		}
+		return err
+	})
+
+	s.Router.Post("/api/trash/:id/restore", func(c *fiber.Ctx) error {
+		log.Debug().Msgf("POST /api/trash/%v/restore", c.Params("id"))
+		err := s.handleRestoreTranscription(c)
+		if err != nil {
+			log.Error().Err(err).Msg("Error handling POST /api/trash/:id/restore")
+		}
+		return err
+	})
+
+	s.Router.Delete("/api/trash/:id", func(c *fiber.Ctx) error {
+		log.Debug().Msgf("DELETE /api/trash/%v", c.Params("id"))
+		err := s.handlePurgeTranscription(c)
+		if err != nil {
+			log.Error().Err(err).Msg("Error handling DELETE /api/trash/:id")
+		}
+		return err
+	})
+
 	// Register HTTP route for uploading JSON to replace transcription result
 	s.Router.Post("/api/upload", func(c *fiber.Ctx) error {
 		log.Debug().Msg("POST /api/upload")
@@ -177,38 +394,80 @@ func (s *Server) RegisterRoutes() {
 		return err
 	})
 
+	s.Router.Get("/api/admin/indexes", func(c *fiber.Ctx) error {
+		log.Debug().Msg("GET /api/admin/indexes")
+		err := s.handleIndexStatus(c)
+		if err != nil {
+			log.Error().Err(err).Msg("Error handling GET /api/admin/indexes")
+		}
+		return err
+	})
+
+	s.Router.Get("/api/admin/export", func(c *fiber.Ctx) error {
+		log.Debug().Msg("GET /api/admin/export")
+		err := s.handleExport(c)
+		if err != nil {
+			log.Error().Err(err).Msg("Error handling GET /api/admin/export")
+		}
+		return err
+	})
+
+	s.Router.Post("/api/admin/import", func(c *fiber.Ctx) error {
+		log.Debug().Msg("POST /api/admin/import")
+		err := s.handleImport(c)
+		if err != nil {
+			log.Error().Err(err).Msg("Error handling POST /api/admin/import")
+		}
+		return err
+	})
+
 	s.Router.Get("/api/status", func(c *fiber.Ctx) error {
-		healthy, msg := utils.CheckTranscriptionServiceHealth()
+		healthy, msg := s.ASR.Healthy()
+		endpoints := s.ASR.Status()
 		if healthy {
 			return c.JSON(fiber.Map{
-				"status": "ok",
+				"status":          "ok",
 				"service_message": msg,
+				"endpoints":       endpoints,
 			})
 		}
 
 		// If the health check failed, it may be because the transcription-api is busy
 		// processing a running transcription and not responding. Check the DB for
 		// running transcriptions and fall back to reporting a likely running state.
-		running := s.Db.GetRunningTranscription()
-		if running != nil && len(running) > 0 {
-			log.Debug().Msgf("Transcription service healthcheck failed but %d running transcriptions found", len(running))
+		// Only the ones whose worker still renews the lease count: the others
+		// are left over from a crash.
+		running, err := s.Db.GetRunningTranscription(c.UserContext())
+		if err != nil {
+			log.Error().Err(err).Msg("Error getting running transcriptions")
+		}
+		alive := 0
+		for _, t := range running {
+			if t.LeaseExpiresAt != nil && t.LeaseExpiresAt.After(time.Now()) {
+				alive++
+			}
+		}
+		if alive > 0 {
+			log.Debug().Msgf("Transcription service healthcheck failed but %d running transcriptions found", alive)
 			return c.JSON(fiber.Map{
-				"status": "ok",
+				"status":          "ok",
 				"service_message": "transcription service unreachable but there are running transcriptions",
+				"endpoints":       endpoints,
 			})
 		}
 
 		// No running transcriptions -> real outage
 		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
-			"status": "error",
-			"error":  "transcription service unavailable",
+			"status":          "error",
+			"error":           "transcription service unavailable",
 			"service_message": msg,
+			"endpoints":       endpoints,
 		})
 	})
 }
 
 // Helper function to remove a WebSocket connection from the slice
-func removeWsClient(s []*websocket.Conn, r *websocket.Conn) []*websocket.Conn {
+func removeWsClient(s []*wsClient, r *wsClient) []*wsClient {
 	for i, v := range s {
 		if v == r {
 			return append(s[:i], s[i+1:]...)
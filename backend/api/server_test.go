@@ -0,0 +1,56 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/goccy/go-json"
+
+	"codeberg.org/pluja/whishper/events"
+	"codeberg.org/pluja/whishper/models"
+)
+
+// The monitor keeps changing a transcription after broadcasting it, while the
+// update is marshalled on another goroutine. Run with -race.
+func TestBroadcastTranscriptionThenMutate(t *testing.T) {
+	s := NewServer(":0", nil, events.NewLocal(), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates, err := s.Bus.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 50
+	received := make(chan float64, n)
+	go func() {
+		for u := range updates {
+			b, err := json.Marshal(u)
+			if err != nil {
+				t.Error(err)
+			}
+			var decoded models.Transcription
+			if err := json.Unmarshal(b, &decoded); err != nil {
+				t.Error(err)
+			}
+			received <- decoded.Progress
+		}
+	}()
+
+	tr := &models.Transcription{
+		Result: models.WhisperResult{Segments: []models.Segment{{ID: "1", Words: []models.Word{{Word: "a"}}}}},
+	}
+	for i := 0; i < n; i++ {
+		tr.Progress = float64(i) / n
+		s.BroadcastTranscription(tr)
+		tr.Progress = -1
+		tr.DownloadingModel = !tr.DownloadingModel
+		tr.Result.Segments[0].Words[0].Word = "b"
+		tr.Result.Segments = append(tr.Result.Segments, models.Segment{ID: "x"})
+	}
+	for i := 0; i < n; i++ {
+		if got, want := <-received, float64(i)/n; got != want {
+			t.Fatalf("update %v has progress %v, want the published %v", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+
+	"codeberg.org/pluja/whishper/database"
+	"codeberg.org/pluja/whishper/models"
+	"codeberg.org/pluja/whishper/utils"
+)
+
+// handleListTrash lists the transcriptions in the trash. It takes the same
+// query parameters as /api/list-transcriptions.
+func (s *Server) handleListTrash(c *fiber.Ctx) error {
+	opts, err := listOptionsFromQuery(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	opts.Trashed = true
+
+	page, err := s.Db.ListTranscriptions(c.UserContext(), opts)
+	if err != nil {
+		log.Error().Err(err).Msg("Error listing the trash")
+		if errors.Is(err, database.ErrInvalidCursor) {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		return dbError(err)
+	}
+	return writeListPage(c, page)
+}
+
+func (s *Server) handleRestoreTranscription(c *fiber.Ctx) error {
+	id := c.Params("id")
+	t, err := s.Db.RestoreTranscription(c.UserContext(), id)
+	if errors.Is(err, database.ErrNotModified) {
+		// Not in the trash.
+		t, err = s.Db.GetTranscription(c.UserContext(), id)
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Error restoring transcription %v from the trash", id)
+		return dbError(err)
+	}
+	s.BroadcastTranscription(t)
+	if t.Status == models.TranscriptionStatusPending {
+		// The queue skipped it while it was in the trash.
+		select {
+		case s.NewTranscriptionCh <- true:
+		default:
+			// A wake up is pending already.
+		}
+	}
+	return c.JSON(t)
+}
+
+// handlePurgeTranscription deletes a transcription in the trash for good.
+func (s *Server) handlePurgeTranscription(c *fiber.Ctx) error {
+	err := s.PurgeTranscription(c.UserContext(), c.Params("id"), time.Time{})
+	if errors.Is(err, database.ErrConflict) {
+		return fiber.NewError(fiber.StatusConflict, "The transcription is not in the trash")
+	}
+	if err != nil {
+		return dbError(err)
+	}
+	c.Status(fiber.StatusOK)
+	return nil
+}
+
+// handleEmptyTrash deletes every transcription in the trash for good.
+func (s *Server) handleEmptyTrash(c *fiber.Ctx) error {
+	purged, err := s.PurgeTrash(c.UserContext(), time.Time{})
+	if err != nil {
+		return dbError(err)
+	}
+	return c.JSON(fiber.Map{"purged": purged})
+}
+
+// purgePage is how many transcriptions PurgeTrash lists at once.
+const purgePage = 100
+
+// PurgeTrash deletes for good the transcriptions trashed before the given
+// time, or all of them if it is zero. It returns how many were deleted.
+func (s *Server) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+	opts := database.ListOptions{Trashed: true, TrashedBefore: before, Limit: purgePage}
+	purged := 0
+	for {
+		page, err := s.Db.ListTranscriptions(ctx, opts)
+		if err != nil {
+			log.Error().Err(err).Msg("Error listing the trash")
+			return purged, err
+		}
+		for _, t := range page.Items {
+			err := s.PurgeTranscription(ctx, t.ID.Hex(), before)
+			if errors.Is(err, database.ErrNotFound) || errors.Is(err, database.ErrConflict) {
+				// Purged by another replica, or restored, meanwhile.
+				continue
+			}
+			if err != nil {
+				return purged, err
+			}
+			purged++
+		}
+		// The cursor is the position after the last item, which stays
+		// valid once the items are deleted.
+		if page.NextCursor == "" {
+			return purged, nil
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+// PurgeTranscription deletes the transcription id for good if it is still in
+// the trash, trashed before the given time unless it is zero. Its media and
+// the audio extracted from it are removed from disk once it is gone, so a
+// transcription restored meanwhile keeps them.
+func (s *Server) PurgeTranscription(ctx context.Context, id string, before time.Time) error {
+	t, err := s.Db.PurgeTranscription(ctx, id, before)
+	if err != nil {
+		if !errors.Is(err, database.ErrConflict) {
+			log.Error().Err(err).Msgf("Error deleting transcription %v", id)
+		}
+		return err
+	}
+	if t.FileName != "" {
+		err := os.Remove(filepath.Join(os.Getenv("UPLOAD_DIR"), t.FileName))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Error().Err(err).Msgf("Error deleting file %v", t.FileName)
+		}
+	}
+	audio, _ := filepath.Glob(filepath.Join(utils.PreprocessedDir(), t.ID.Hex()+".*"))
+	for _, path := range audio {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Error().Err(err).Msgf("Error deleting file %v", path)
+		}
+	}
+	log.Debug().Msgf("Purged transcription %v", id)
+	return nil
+}
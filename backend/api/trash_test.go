@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"codeberg.org/pluja/whishper/database"
+	"codeberg.org/pluja/whishper/models"
+)
+
+// Emptying the trash goes through every page of it, and leaves the rest alone.
+func TestEmptyTrash(t *testing.T) {
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	s := newTestServer(t)
+	ctx := context.Background()
+	const trashed, kept = 2*purgePage + 1, 3
+	for i := 0; i < trashed+kept; i++ {
+		tr, err := s.Db.NewTranscription(ctx, &models.Transcription{Status: models.TranscriptionStatusDone})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < trashed {
+			if _, err := s.Db.TrashTranscription(ctx, tr.ID.Hex()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	status, body := request(t, s, "DELETE", "/api/trash", nil)
+	var got struct {
+		Purged int `json:"purged"`
+	}
+	if err := json.Unmarshal(body, &got); status != 200 || err != nil {
+		t.Fatalf("emptying the trash: status %v, %v: %s", status, err, body)
+	}
+	if got.Purged != trashed {
+		t.Errorf("purged %v, want %v", got.Purged, trashed)
+	}
+	for _, tt := range []struct {
+		trashed bool
+		want    int
+	}{{true, 0}, {false, kept}} {
+		page, err := s.Db.ListTranscriptions(ctx, database.ListOptions{Trashed: tt.trashed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Items) != tt.want {
+			t.Errorf("%v transcriptions left with trashed %v, want %v", len(page.Items), tt.trashed, tt.want)
+		}
+	}
+}
+
+// Restoring a pending job doesn't hang when the monitor has wake ups pending
+// already.
+func TestRestoreWakesMonitor(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	tr, err := s.Db.NewTranscription(ctx, &models.Transcription{Status: models.TranscriptionStatusPending})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Db.TrashTranscription(ctx, tr.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	for len(s.NewTranscriptionCh) < cap(s.NewTranscriptionCh) {
+		s.NewTranscriptionCh <- true
+	}
+
+	done := make(chan int)
+	go func() {
+		status, _ := request(t, s, "POST", "/api/trash/"+tr.ID.Hex()+"/restore", nil)
+		done <- status
+	}()
+	select {
+	case status := <-done:
+		if status != 200 {
+			t.Errorf("restoring: status %v", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("restoring blocked on the wake up")
+	}
+}
+
+// Purging removes the media of a transcription only once it is deleted, so
+// one restored in between keeps its media.
+func TestPurgeKeepsRestoredMedia(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("UPLOAD_DIR", dir)
+	s := newTestServer(t)
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name    string
+		restore bool
+		status  int
+	}{
+		{"trashed", false, 200},
+		{"restored", true, 409},
+	} {
+		fileName := tt.name + ".mp3"
+		media := filepath.Join(dir, fileName)
+		if err := os.WriteFile(media, []byte("media"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		tr, err := s.Db.NewTranscription(ctx, &models.Transcription{Status: models.TranscriptionStatusDone, FileName: fileName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Db.TrashTranscription(ctx, tr.ID.Hex()); err != nil {
+			t.Fatal(err)
+		}
+		if tt.restore {
+			// Restored after the trash was read, before it is purged.
+			if _, err := s.Db.RestoreTranscription(ctx, tr.ID.Hex()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		status, body := request(t, s, "DELETE", "/api/trash/"+tr.ID.Hex(), nil)
+		if status != tt.status {
+			t.Errorf("%v: purging: status %v, want %v: %s", tt.name, status, tt.status, body)
+		}
+		_, err = os.Stat(media)
+		if kept := err == nil; kept != tt.restore {
+			t.Errorf("%v: media kept %v, want %v", tt.name, kept, tt.restore)
+		}
+		_, err = s.Db.GetTranscription(ctx, tr.ID.Hex())
+		if kept := err == nil; kept != tt.restore {
+			t.Errorf("%v: transcription kept %v, want %v", tt.name, kept, tt.restore)
+		}
+	}
+}
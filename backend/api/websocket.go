@@ -1,38 +1,39 @@
 package api
 
 import (
+	"context"
+
 	"github.com/goccy/go-json"
 	"github.com/gofiber/contrib/websocket"
 	"github.com/rs/zerolog/log"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"codeberg.org/pluja/whishper/models"
 )
 
+// segmentMessage is the only message clients send: an edit of a single
+// segment of a transcription result.
+type segmentMessage struct {
+	ID      string         `json:"id"`
+	Segment models.Segment `json:"segment"`
+}
+
 func (s *Server) handleWebsocketMessage(wsess *websocket.Conn, msg []byte) {
 	log.Info().Msgf("Received message from client: %v", wsess.RemoteAddr().String())
-	// Try to unmarshal message to transcription
-	var transcription models.Transcription
-	err := json.Unmarshal(msg, &transcription)
+	var message segmentMessage
+	err := json.Unmarshal(msg, &message)
 	if err != nil {
-		log.Error().Err(err).Msg("Error unmarshalling message to transcription:")
+		log.Error().Err(err).Msg("Error unmarshalling message to segment edit:")
+		return
+	}
+	if message.ID == "" || message.Segment.ID == "" {
+		log.Error().Msgf("Segment not updated, the message needs a transcription and a segment id")
 		return
 	}
 
-	var res *models.Transcription
-	// Check if the transcription has a valid ID
-	// If it has ID, it means it's an update
-	if transcription.ID != primitive.NilObjectID {
-		log.Printf("Updating transcription: %v", transcription.ID)
-		// Update transcription in database
-		res, err = s.Db.UpdateTranscription(&transcription)
-		if err != nil {
-			log.Error().Err(err).Msg("Error updating transcription in database:")
-			return
-		}
-		log.Printf("Updated transcription in database: %v", res)
-	} else {
-		log.Error().Msgf("Transcription not updated, it does not have an ID")
+	log.Printf("Updating segment %v of transcription %v", message.Segment.ID, message.ID)
+	res, err := s.patchSegment(context.Background(), message.ID, message.Segment, requestAuthor(wsess.Headers))
+	if err != nil {
+		log.Error().Err(err).Msg("Error updating segment in database:")
 		return
 	}
 
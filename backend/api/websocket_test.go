@@ -0,0 +1,86 @@
+package api
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/goccy/go-json"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+// clientCount waits until the server has want websocket clients.
+func clientCount(t *testing.T, s *Server, want int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.clientsMu.Lock()
+		n := len(s.clients)
+		s.clientsMu.Unlock()
+		if n == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v websocket clients, want %v", n, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Updates reach the clients that read them while another client reads
+// nothing, and clients are removed once they disconnect.
+func TestWebsocketUpdates(t *testing.T) {
+	s := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates, err := s.Bus.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.sendUpdates(updates)
+	s.SetupWebsocket()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Router.Listener(ln)
+	defer s.Router.Shutdown()
+
+	url := "ws://" + ln.Addr().String() + "/ws/transcriptions"
+	idle, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	reader, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCount(t, s, 2)
+
+	// No more than a client buffers, so none is dropped however the writers
+	// are scheduled.
+	const sent = wsSendBuffer
+	for i := 0; i < sent; i++ {
+		s.BroadcastTranscription(&models.Transcription{FileName: "a.mp3", Progress: float64(i)})
+	}
+	reader.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < sent; i++ {
+		_, msg, err := reader.ReadMessage()
+		if err != nil {
+			t.Fatalf("reading update %v: %v", i, err)
+		}
+		var got models.Transcription
+		if err := json.Unmarshal(msg, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.FileName != "a.mp3" {
+			t.Errorf("update %v is %+v, want the broadcast one", i, got)
+		}
+	}
+
+	reader.Close()
+	clientCount(t, s, 1)
+}
@@ -0,0 +1,106 @@
+// Package asr routes the transcription jobs to the transcription services
+// (ASR endpoints) able to run them, keeping track of their health and load.
+package asr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Endpoint is a transcription service and what it can run.
+type Endpoint struct {
+	// Address is the host and port of the service, i.e. whisper-api:8000.
+	Address string `json:"address"`
+	// Devices the service runs models on. Empty means any.
+	Devices []string `json:"devices,omitempty"`
+	// MaxModel is the largest model size the service runs. Empty means any.
+	MaxModel string `json:"maxModel,omitempty"`
+	// Concurrency is how many jobs the service runs at once. 0 means no
+	// limit.
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+// ParseEndpoints reads a list of endpoints separated by semicolons. Each one
+// is an address followed by its capabilities, separated by spaces:
+//
+//	whisper-gpu:8000 devices=cuda maxmodel=large-v3 concurrency=1; whisper-cpu:8000 devices=cpu maxmodel=small
+//
+// Capabilities left out don't restrict the endpoint.
+func ParseEndpoints(spec string) ([]Endpoint, error) {
+	var endpoints []Endpoint
+	for _, part := range strings.Split(spec, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		e := Endpoint{Address: fields[0]}
+		if strings.Contains(e.Address, "=") {
+			return nil, fmt.Errorf("endpoint %q must start with its address", part)
+		}
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok || value == "" {
+				return nil, fmt.Errorf("invalid capability %q of endpoint %v, expected key=value", field, e.Address)
+			}
+			switch key {
+			case "devices":
+				e.Devices = strings.Split(value, ",")
+			case "maxmodel":
+				e.MaxModel = value
+			case "concurrency":
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("invalid concurrency %q for endpoint %v", value, e.Address)
+				}
+				e.Concurrency = n
+			default:
+				return nil, fmt.Errorf("unknown capability %q of endpoint %v, use devices, maxmodel or concurrency", key, e.Address)
+			}
+		}
+		endpoints = append(endpoints, e)
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no endpoint in %q", spec)
+	}
+	return endpoints, nil
+}
+
+// Supports reports whether the endpoint can run a job on device with the
+// model size.
+func (e *Endpoint) Supports(device string, modelSize string) bool {
+	if len(e.Devices) > 0 {
+		found := false
+		for _, d := range e.Devices {
+			if d == device {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return e.MaxModel == "" || modelRank(modelSize) <= modelRank(e.MaxModel)
+}
+
+// modelRank orders the model sizes by how much they need: 1 for tiny up to 5
+// for the large ones. English-only and distilled variants rank like the model
+// they come from. An empty size is the service default and ranks 0; unknown
+// sizes rank like the large ones.
+func modelRank(size string) int {
+	size = strings.TrimSuffix(strings.ToLower(size), ".en")
+	switch {
+	case size == "":
+		return 0
+	case strings.Contains(size, "tiny"):
+		return 1
+	case strings.Contains(size, "base"):
+		return 2
+	case strings.Contains(size, "small"):
+		return 3
+	case strings.Contains(size, "medium"):
+		return 4
+	}
+	return 5
+}
@@ -0,0 +1,37 @@
+package asr
+
+import "testing"
+
+func TestModelRank(t *testing.T) {
+	// Each size needs more than the previous one.
+	order := [][]string{
+		{""},
+		{"tiny", "tiny.en"},
+		{"base", "Base.en"},
+		{"small", "small.en", "distil-small.en"},
+		{"medium", "medium.en", "distil-medium.en"},
+		{"large-v3", "large", "distil-large-v2", "turbo"},
+	}
+	for rank, sizes := range order {
+		for _, size := range sizes {
+			if got := modelRank(size); got != rank {
+				t.Errorf("modelRank(%q) = %v, want %v", size, got, rank)
+			}
+		}
+	}
+
+	e := Endpoint{Devices: []string{"cpu"}, MaxModel: "small"}
+	for _, tt := range []struct {
+		device, size string
+		want         bool
+	}{
+		{"cpu", "small.en", true},
+		{"cpu", "", true},
+		{"cpu", "medium", false},
+		{"cuda", "tiny", false},
+	} {
+		if got := e.Supports(tt.device, tt.size); got != tt.want {
+			t.Errorf("Supports(%q, %q) = %v, want %v", tt.device, tt.size, got, tt.want)
+		}
+	}
+}
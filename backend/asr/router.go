@@ -0,0 +1,215 @@
+package asr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"codeberg.org/pluja/whishper/utils"
+)
+
+// healthInterval is how often every endpoint is health checked.
+const healthInterval = 30 * time.Second
+
+var (
+	// ErrUnsupported is returned when no endpoint supports the device and
+	// model size of a job.
+	ErrUnsupported = errors.New("no transcription service supports this device and model size")
+	// ErrUnavailable is returned when the endpoints supporting a job are all
+	// down. It is transient: they may come back.
+	ErrUnavailable = errors.New("every transcription service able to run this job is down")
+)
+
+// EndpointStatus is the state of an endpoint, as reported by the status API.
+type EndpointStatus struct {
+	Endpoint
+	Healthy bool `json:"healthy"`
+	// Message is the last health check answer or error.
+	Message string `json:"message,omitempty"`
+	// Active counts the jobs of this instance running on the endpoint.
+	Active int `json:"active"`
+}
+
+// Router picks the endpoint each job runs on, among the healthy endpoints
+// supporting it, the least loaded first.
+type Router struct {
+	mu     sync.Mutex
+	states []*EndpointStatus
+	// freed is closed and replaced whenever a job releases an endpoint or an
+	// endpoint comes back, to wake up the jobs waiting for one.
+	freed chan struct{}
+}
+
+// NewRouter returns a router over endpoints, all taken for healthy until
+// they are checked.
+func NewRouter(endpoints []Endpoint) *Router {
+	r := &Router{freed: make(chan struct{})}
+	for _, e := range endpoints {
+		r.states = append(r.states, &EndpointStatus{Endpoint: e, Healthy: true})
+	}
+	return r
+}
+
+// StartHealthChecks checks every endpoint now and then every healthInterval.
+func (r *Router) StartHealthChecks() {
+	go func() {
+		ticker := time.NewTicker(healthInterval)
+		defer ticker.Stop()
+		for {
+			r.checkAll()
+			<-ticker.C
+		}
+	}()
+}
+
+func (r *Router) checkAll() {
+	var wg sync.WaitGroup
+	for _, st := range r.states {
+		wg.Add(1)
+		go func(st *EndpointStatus) {
+			defer wg.Done()
+			ok, msg := utils.CheckTranscriptionServiceHealth(st.Address)
+			r.setHealth(st, ok, msg)
+		}(st)
+	}
+	wg.Wait()
+}
+
+func (r *Router) setHealth(st *EndpointStatus, ok bool, msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !ok && msg == "" {
+		msg = "health check failed"
+	}
+	if !ok && st.Active > 0 {
+		// The service may be too busy with our jobs to answer.
+		ok = true
+		msg = "not answering health checks while running transcriptions"
+	}
+	if ok != st.Healthy {
+		if ok {
+			log.Info().Msgf("Transcription service %v is back up", st.Address)
+			r.wake()
+		} else {
+			log.Warn().Msgf("Transcription service %v is down: %v", st.Address, msg)
+		}
+	}
+	st.Healthy = ok
+	st.Message = msg
+}
+
+// MarkDown takes the endpoint at address out of the rotation after a request
+// to it failed with err, until its next successful health check.
+func (r *Router) MarkDown(address string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, st := range r.states {
+		if st.Address == address && st.Healthy {
+			log.Warn().Err(err).Msgf("Transcription service %v failed, taking it out of the rotation", address)
+			st.Healthy = false
+			st.Message = err.Error()
+		}
+	}
+}
+
+// Acquire returns the address of the endpoint to run a job on device with
+// modelSize, waiting for one to have room if they are all busy. The release
+// function must be called once the job is done with it. It returns
+// ErrUnsupported if no endpoint supports the job and ErrUnavailable if those
+// that do are down.
+func (r *Router) Acquire(ctx context.Context, device string, modelSize string) (string, func(), error) {
+	for {
+		r.mu.Lock()
+		var best *EndpointStatus
+		supported, healthy := false, false
+		for _, st := range r.states {
+			if !st.Supports(device, modelSize) {
+				continue
+			}
+			supported = true
+			if !st.Healthy {
+				continue
+			}
+			healthy = true
+			if st.Concurrency > 0 && st.Active >= st.Concurrency {
+				continue
+			}
+			if best == nil || load(st) < load(best) {
+				best = st
+			}
+		}
+		if best != nil {
+			best.Active++
+			r.mu.Unlock()
+			return best.Address, r.releaser(best), nil
+		}
+		freed := r.freed
+		r.mu.Unlock()
+
+		if !supported {
+			return "", nil, fmt.Errorf("%w: device %v, model %v", ErrUnsupported, device, modelSize)
+		}
+		if !healthy {
+			return "", nil, ErrUnavailable
+		}
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		}
+	}
+}
+
+// load is how busy an endpoint is, for picking the least loaded one.
+func load(st *EndpointStatus) float64 {
+	if st.Concurrency == 0 {
+		return float64(st.Active) / 1000
+	}
+	return float64(st.Active) / float64(st.Concurrency)
+}
+
+func (r *Router) releaser(st *EndpointStatus) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			st.Active--
+			r.wake()
+		})
+	}
+}
+
+// wake wakes up the jobs waiting for an endpoint. Callers must hold mu.
+func (r *Router) wake() {
+	close(r.freed)
+	r.freed = make(chan struct{})
+}
+
+// Status reports the state of every endpoint.
+func (r *Router) Status() []EndpointStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	statuses := make([]EndpointStatus, len(r.states))
+	for i, st := range r.states {
+		statuses[i] = *st
+	}
+	return statuses
+}
+
+// Healthy reports whether any endpoint is healthy, with the health check
+// message of the first one that is, or of the first endpoint otherwise.
+func (r *Router) Healthy() (bool, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, st := range r.states {
+		if st.Healthy {
+			return true, st.Message
+		}
+	}
+	return false, r.states[0].Message
+}
@@ -0,0 +1,146 @@
+package asr
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// acquired is the result of an Acquire call run in the background.
+type acquired struct {
+	address string
+	release func()
+	err     error
+}
+
+func acquireAsync(ctx context.Context, r *Router, device string, modelSize string) <-chan acquired {
+	done := make(chan acquired, 1)
+	go func() {
+		address, release, err := r.Acquire(ctx, device, modelSize)
+		done <- acquired{address, release, err}
+	}()
+	return done
+}
+
+// waiting fails the test if the Acquire call behind done returned already.
+func waiting(t *testing.T, done <-chan acquired) {
+	t.Helper()
+	select {
+	case got := <-done:
+		t.Fatalf("acquire returned %+v, want it to wait", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func received(t *testing.T, done <-chan acquired) acquired {
+	t.Helper()
+	select {
+	case got := <-done:
+		return got
+	case <-time.After(5 * time.Second):
+		t.Fatal("acquire kept waiting")
+		return acquired{}
+	}
+}
+
+// Jobs wait for a busy endpoint to be released, or give up with their
+// context.
+func TestAcquireWaits(t *testing.T) {
+	r := NewRouter([]Endpoint{{Address: "a", Concurrency: 1}})
+	ctx := context.Background()
+	address, release, err := r.Acquire(ctx, "cpu", "small")
+	if err != nil || address != "a" {
+		t.Fatalf("got %v, %v, want a", address, err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	gaveUp := acquireAsync(cancelled, r, "cpu", "small")
+	done := acquireAsync(ctx, r, "cpu", "small")
+	waiting(t, gaveUp)
+	waiting(t, done)
+	cancel()
+	if got := received(t, gaveUp); !errors.Is(got.err, context.Canceled) {
+		t.Errorf("cancelled acquire: got error %v, want %v", got.err, context.Canceled)
+	}
+
+	release()
+	release() // Releasing twice frees the endpoint once.
+	got := received(t, done)
+	if got.err != nil || got.address != "a" {
+		t.Fatalf("got %v, %v, want a once released", got.address, got.err)
+	}
+	if st := r.Status()[0]; st.Active != 1 {
+		t.Errorf("%v active jobs, want 1", st.Active)
+	}
+	got.release()
+}
+
+// Jobs go to the least loaded endpoint supporting them, and skip those that
+// are down.
+func TestAcquireFailover(t *testing.T) {
+	r := NewRouter([]Endpoint{
+		{Address: "gpu", Devices: []string{"cuda"}},
+		{Address: "a", Concurrency: 2, MaxModel: "small"},
+		{Address: "b", Concurrency: 2, MaxModel: "medium"},
+	})
+	ctx := context.Background()
+	acquire := func(device string, modelSize string) (string, error) {
+		address, _, err := r.Acquire(ctx, device, modelSize)
+		return address, err
+	}
+
+	for _, want := range []string{"a", "b", "a"} {
+		if got, err := acquire("cpu", "base"); err != nil || got != want {
+			t.Errorf("got %v, %v, want %v", got, err, want)
+		}
+	}
+	if got, err := acquire("cpu", "medium"); err != nil || got != "b" {
+		t.Errorf("medium model: got %v, %v, want b", got, err)
+	}
+	if _, err := acquire("cpu", "large-v3"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("large model: got error %v, want %v", err, ErrUnsupported)
+	}
+
+	r.MarkDown("gpu", errors.New("connection refused"))
+	if _, err := acquire("cuda", "large-v3"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("gpu down: got error %v, want %v", err, ErrUnavailable)
+	}
+	if st := r.Status()[0]; st.Healthy || st.Message != "connection refused" {
+		t.Errorf("gpu status %+v, want down with the error", st)
+	}
+	if ok, _ := r.Healthy(); !ok {
+		t.Error("router unhealthy with endpoints up")
+	}
+}
+
+// An endpoint marked down comes back with its next successful health check,
+// which wakes the jobs waiting. A failed health check doesn't take down an
+// endpoint running jobs.
+func TestEndpointRecovery(t *testing.T) {
+	r := NewRouter([]Endpoint{{Address: "a", Concurrency: 1}, {Address: "b"}})
+	a, b := r.states[0], r.states[1]
+	ctx := context.Background()
+
+	r.MarkDown("b", errors.New("timeout"))
+	_, release, err := r.Acquire(ctx, "cpu", "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := acquireAsync(ctx, r, "cpu", "small")
+	waiting(t, done)
+	r.setHealth(b, true, "")
+	if got := received(t, done); got.err != nil || got.address != "b" {
+		t.Errorf("got %v, %v, want b once back", got.address, got.err)
+	}
+
+	r.setHealth(a, false, "")
+	if !a.Healthy {
+		t.Error("busy endpoint taken down by a failed health check")
+	}
+	release()
+	r.setHealth(a, false, "")
+	if a.Healthy || a.Message != "health check failed" {
+		t.Errorf("idle endpoint %+v after a failed health check, want down", *a)
+	}
+}
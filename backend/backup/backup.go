@@ -0,0 +1,371 @@
+// Package backup exports a whole instance, every transcription with its
+// revisions and media, to a single archive, and imports it into any database.
+//
+// The archive is a gzipped tar file. It starts with manifest.json, followed by
+// the entries of each transcription in turn:
+//
+//	media/<fileName>                 the media file, if any
+//	transcriptions/<id>.json         the transcription
+//	revisions/<id>.json              its revisions, oldest first, if any
+//
+// so that it can be imported in a single pass.
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"codeberg.org/pluja/whishper/database"
+	"codeberg.org/pluja/whishper/models"
+)
+
+// formatVersion is the version of the archive layout. Import refuses newer
+// archives.
+const formatVersion = 1
+
+type manifest struct {
+	Format         int       `json:"format"`
+	CreatedAt      time.Time `json:"createdAt"`
+	Transcriptions int       `json:"transcriptions"`
+}
+
+// Stats counts what an export or an import went through.
+type Stats struct {
+	Transcriptions int `json:"transcriptions"`
+	Revisions      int `json:"revisions"`
+	Media          int `json:"media"`
+	// MissingMedia counts the transcriptions whose media file wasn't found
+	// on disk when exporting, or in the archive when importing. They go
+	// without it.
+	MissingMedia int `json:"missingMedia,omitempty"`
+}
+
+// Export writes an archive of every transcription of db, trashed ones
+// included, with their revisions and their media from uploadDir, to w.
+func Export(ctx context.Context, db database.Db, uploadDir string, w io.Writer) (Stats, error) {
+	var stats Stats
+	transcriptions, err := db.GetAllTranscriptions(ctx)
+	if err != nil {
+		return stats, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err = writeJSON(tw, "manifest.json", manifest{
+		Format:         formatVersion,
+		CreatedAt:      time.Now().UTC(),
+		Transcriptions: len(transcriptions),
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	written := map[string]bool{}
+	for _, t := range transcriptions {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		if t.FileName != "" && !written[t.FileName] {
+			ok, err := writeMedia(tw, uploadDir, t.FileName)
+			if err != nil {
+				return stats, err
+			}
+			if ok {
+				written[t.FileName] = true
+				stats.Media++
+			} else {
+				log.Warn().Msgf("Media %v of transcription %v not found, exporting without it", t.FileName, t.ID.Hex())
+				stats.MissingMedia++
+			}
+		}
+
+		if err := writeJSON(tw, "transcriptions/"+t.ID.Hex()+".json", t); err != nil {
+			return stats, err
+		}
+		stats.Transcriptions++
+
+		revisions, err := fullRevisions(ctx, db, t.ID.Hex())
+		if err != nil {
+			return stats, err
+		}
+		if len(revisions) > 0 {
+			if err := writeJSON(tw, "revisions/"+t.ID.Hex()+".json", revisions); err != nil {
+				return stats, err
+			}
+			stats.Revisions += len(revisions)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return stats, err
+	}
+	return stats, gz.Close()
+}
+
+// fullRevisions returns the revisions of a transcription with their content,
+// oldest first.
+func fullRevisions(ctx context.Context, db database.Db, id string) ([]*models.Revision, error) {
+	list, err := db.ListRevisions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	revisions := make([]*models.Revision, 0, len(list))
+	for i := len(list) - 1; i >= 0; i-- {
+		r, err := db.GetRevision(ctx, id, list[i].ID.Hex())
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, r)
+	}
+	return revisions, nil
+}
+
+func writeJSON(tw *tar.Writer, name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(b)
+	return err
+}
+
+// writeMedia adds the media file name to the archive. It returns false if
+// the file doesn't exist.
+func writeMedia(tw *tar.Writer, uploadDir string, name string) (bool, error) {
+	f, err := os.Open(filepath.Join(uploadDir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    "media/" + name,
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	})
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(tw, f)
+	return err == nil, err
+}
+
+// Import restores an archive written by Export into db, and its media into
+// uploadDir. Every transcription and revision gets a new id, so an archive
+// can be imported next to existing data, even the data it was exported from.
+// Media files that would overwrite an existing file are renamed. Jobs that
+// were running when the archive was written are queued again.
+func Import(ctx context.Context, db database.Db, uploadDir string, r io.Reader) (Stats, error) {
+	var stats Stats
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return stats, fmt.Errorf("not a whishper archive: %w", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	// Old file names and transcription ids to the new ones.
+	fileNames := map[string]string{}
+	ids := map[string]primitive.ObjectID{}
+	sawManifest := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		dir, name := path.Split(hdr.Name)
+		if !sawManifest {
+			if hdr.Name != "manifest.json" {
+				return stats, errors.New("not a whishper archive: the manifest is missing")
+			}
+			var m manifest
+			if err := json.NewDecoder(tr).Decode(&m); err != nil {
+				return stats, fmt.Errorf("reading the manifest: %w", err)
+			}
+			if m.Format > formatVersion {
+				return stats, fmt.Errorf("the archive format %v is newer than this build (%v)", m.Format, formatVersion)
+			}
+			sawManifest = true
+			continue
+		}
+
+		switch {
+		case dir == "media/" && validName(name):
+			newName, err := saveMedia(uploadDir, name, tr)
+			if err != nil {
+				return stats, err
+			}
+			fileNames[name] = newName
+			stats.Media++
+
+		case dir == "transcriptions/" && strings.HasSuffix(name, ".json"):
+			var t models.Transcription
+			if err := json.NewDecoder(tr).Decode(&t); err != nil {
+				return stats, fmt.Errorf("reading %v: %w", hdr.Name, err)
+			}
+			oldID := t.ID.Hex()
+			if !prepareImport(&t, fileNames) {
+				log.Warn().Msgf("Media %v of transcription %v not in the archive, importing without it", t.FileName, oldID)
+				stats.MissingMedia++
+			}
+			if _, err := db.NewTranscription(ctx, &t); err != nil {
+				return stats, fmt.Errorf("importing transcription %v: %w", oldID, err)
+			}
+			ids[oldID] = t.ID
+			stats.Transcriptions++
+
+		case dir == "revisions/" && strings.HasSuffix(name, ".json"):
+			oldID := strings.TrimSuffix(name, ".json")
+			id, ok := ids[oldID]
+			if !ok {
+				log.Warn().Msgf("Skipping the revisions of transcription %v, which isn't in the archive", oldID)
+				continue
+			}
+			var revisions []*models.Revision
+			if err := json.NewDecoder(tr).Decode(&revisions); err != nil {
+				return stats, fmt.Errorf("reading %v: %w", hdr.Name, err)
+			}
+			for _, rev := range revisions {
+				rev.ID = remapID(rev.ID)
+				rev.TranscriptionID = id
+				if _, err := db.AddRevision(ctx, rev); err != nil {
+					return stats, fmt.Errorf("importing a revision of transcription %v: %w", oldID, err)
+				}
+				stats.Revisions++
+			}
+
+		default:
+			log.Warn().Msgf("Skipping unknown archive entry %v", hdr.Name)
+		}
+	}
+	if !sawManifest {
+		return stats, errors.New("not a whishper archive: the manifest is missing")
+	}
+	return stats, nil
+}
+
+// prepareImport gives t a new id and its new file name, and queues it again
+// if it was running. It returns false if the media of t wasn't imported, in
+// which case t goes without it: a queued job then downloads its source again,
+// or fails if it has none.
+func prepareImport(t *models.Transcription, fileNames map[string]string) bool {
+	t.ID = remapID(t.ID)
+	if t.Status == models.TranscriptionStatusRunning {
+		t.Status = models.TranscriptionStatusPending
+		t.Progress = 0
+		t.DownloadingModel = false
+	}
+	t.LeaseOwner = ""
+	t.LeaseExpiresAt = nil
+
+	if t.FileName == "" {
+		return true
+	}
+	if newName, ok := fileNames[t.FileName]; ok {
+		t.FileName = newName
+		return true
+	}
+	// The old name may belong to another file of this instance.
+	t.FileName = ""
+	queued := t.Status == models.TranscriptionStatusPending || t.Status == models.TranscriptionStatusScheduled
+	if queued && t.SourceUrl == "" {
+		attempts := 1
+		if t.Error != nil {
+			attempts = t.Error.Attempts + 1
+		}
+		t.Status = models.TranscriptionStatusError
+		t.Error = &models.JobError{
+			Stage:    models.ErrorStagePrepare,
+			Message:  "the media file was missing from the imported archive",
+			Attempts: attempts,
+			At:       time.Now().UTC(),
+		}
+	}
+	return false
+}
+
+// remapID returns a new id with the creation time of id, so that imported
+// documents keep their order.
+func remapID(id primitive.ObjectID) primitive.ObjectID {
+	newID := primitive.NewObjectID()
+	if !id.IsZero() {
+		copy(newID[:4], id[:4])
+	}
+	return newID
+}
+
+// validName reports whether name is a plain file name that stays inside the
+// upload directory.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// saveMedia writes the media file name read from r into uploadDir and returns
+// the name it was saved under. Names already taken get a new time prefix.
+func saveMedia(uploadDir string, name string, r io.Reader) (string, error) {
+	newName := name
+	for i := 0; ; i++ {
+		f, err := os.OpenFile(filepath.Join(uploadDir, newName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, os.ErrExist) {
+			newName = freshName(name, i)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return "", err
+		}
+		return newName, f.Close()
+	}
+}
+
+// freshName replaces the time prefix uploads get with the current time.
+func freshName(name string, attempt int) string {
+	if _, original, ok := strings.Cut(name, models.FileNameSeparator); ok {
+		name = original
+	}
+	timeid := time.Now().Format("2006_01_02-150405000")
+	if attempt > 0 {
+		timeid = fmt.Sprintf("%v-%v", timeid, attempt)
+	}
+	return timeid + models.FileNameSeparator + name
+}
@@ -0,0 +1,179 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"codeberg.org/pluja/whishper/database"
+	"codeberg.org/pluja/whishper/models"
+)
+
+func newTestDb(t *testing.T) database.Db {
+	db, err := database.NewMemoryDb("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// Importing an export into a fresh database restores every transcription and
+// revision under new ids, and the media under names that don't clash with
+// the files already there.
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	const fileName = "2024_01_02-030405000" + models.FileNameSeparator + "talk.mp3"
+	if err := os.WriteFile(filepath.Join(dir, fileName), []byte("media"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src := newTestDb(t)
+	done, err := src.NewTranscription(ctx, &models.Transcription{
+		Status:   models.TranscriptionStatusDone,
+		FileName: fileName,
+		Result:   models.WhisperResult{Text: "hello", Segments: []models.Segment{{ID: "1", Text: "hello"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev := models.RevisionOf(done)
+	rev.Summary = "edited"
+	if _, err := src.AddRevision(ctx, &rev); err != nil {
+		t.Fatal(err)
+	}
+	lost := []*models.Transcription{
+		{Status: models.TranscriptionStatusDone, FileName: "gone.mp3"},
+		{Status: models.TranscriptionStatusRunning, FileName: "gone.mp3", LeaseOwner: "w"},
+		{Status: models.TranscriptionStatusPending, FileName: "gone.mp3", SourceUrl: "https://example.com/talk"},
+	}
+	for _, tr := range lost {
+		if _, err := src.NewTranscription(ctx, tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var archive bytes.Buffer
+	exported, err := Export(ctx, src, dir, &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Stats{Transcriptions: 4, Revisions: 1, Media: 1, MissingMedia: 3}); exported != want {
+		t.Errorf("exported %+v, want %+v", exported, want)
+	}
+
+	// The media is already in dir, so the imported copy gets a new name.
+	dst := newTestDb(t)
+	imported, err := Import(ctx, dst, dir, &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != exported {
+		t.Errorf("imported %+v, want %+v", imported, exported)
+	}
+
+	all, err := dst.GetAllTranscriptions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 4 {
+		t.Fatalf("imported %v transcriptions, want 4", len(all))
+	}
+	for _, tr := range all {
+		if tr.ID == done.ID || tr.ID == lost[0].ID || tr.ID == lost[1].ID || tr.ID == lost[2].ID {
+			t.Errorf("transcription %v kept its id", tr.ID.Hex())
+		}
+	}
+
+	got := all[0]
+	if got.ID.Timestamp() != done.ID.Timestamp() || got.Result.Text != "hello" {
+		t.Errorf("imported %+v, want the done transcription with its creation time", got)
+	}
+	if got.FileName == fileName || got.FileName == "" {
+		t.Errorf("imported file name %q, want a new one", got.FileName)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, got.FileName)); err != nil || string(b) != "media" {
+		t.Errorf("imported media: %q, %v", b, err)
+	}
+	revisions, err := dst.ListRevisions(ctx, got.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 1 || revisions[0].ID == rev.ID || revisions[0].TranscriptionID != got.ID || revisions[0].Summary != "edited" {
+		t.Errorf("imported revisions %+v, want the revision moved to the new id", revisions)
+	}
+
+	// Transcriptions without their media don't point to another file, and
+	// queued ones only run again if they can download it.
+	for i, want := range []int{models.TranscriptionStatusDone, models.TranscriptionStatusError, models.TranscriptionStatusPending} {
+		tr := all[i+1]
+		if tr.FileName != "" || tr.Status != want || tr.LeaseOwner != "" {
+			t.Errorf("imported %+v without media, want no file name, no lease and status %v", tr, want)
+		}
+	}
+	if jobErr := all[2].Error; jobErr == nil || jobErr.Stage != models.ErrorStagePrepare {
+		t.Errorf("failed import error %+v, want a prepare error", jobErr)
+	}
+}
+
+// Media entries whose name could leave the upload directory are skipped, and
+// the transcriptions using them go without media.
+func TestImportRejectsMediaNames(t *testing.T) {
+	for _, name := range []string{`..\evil.mp3`, ".."} {
+		var archive bytes.Buffer
+		gz := gzip.NewWriter(&archive)
+		tw := tar.NewWriter(gz)
+		if err := writeJSON(tw, "manifest.json", manifest{Format: formatVersion}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: "media/" + name, Mode: 0644, Size: 4}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte("evil")); err != nil {
+			t.Fatal(err)
+		}
+		tr := &models.Transcription{Status: models.TranscriptionStatusDone, FileName: name}
+		if err := writeJSON(tw, "transcriptions/a.json", tr); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		parent := t.TempDir()
+		dir := filepath.Join(parent, "uploads")
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		db := newTestDb(t)
+		stats, err := Import(context.Background(), db, dir, &archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Media != 0 || stats.MissingMedia != 1 {
+			t.Errorf("%q: imported %+v, want the media skipped", name, stats)
+		}
+		for _, d := range []string{parent, dir} {
+			entries, _ := os.ReadDir(d)
+			for _, e := range entries {
+				if e.Name() != "uploads" {
+					t.Errorf("%q: wrote %v", name, filepath.Join(d, e.Name()))
+				}
+			}
+		}
+		all, err := db.GetAllTranscriptions(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 1 || all[0].FileName != "" {
+			t.Errorf("%q: imported %+v, want one transcription without media", name, all)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package database
+
+import (
+	"context"
+	"errors"
+
+	"github.com/rs/zerolog/log"
+)
+
+// CopyTranscriptions copies every transcription of src into dst, keeping the
+// ids. Documents that already exist in dst are left untouched, so an
+// interrupted copy can simply be run again. It returns how many documents
+// were copied and how many were skipped.
+func CopyTranscriptions(ctx context.Context, dst, src Db) (copied int, skipped int, err error) {
+	transcriptions, err := src.GetAllTranscriptions(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, t := range transcriptions {
+		_, err := dst.GetTranscription(ctx, t.ID.Hex())
+		if err == nil {
+			log.Debug().Msgf("Transcription %v already exists, skipping", t.ID.Hex())
+			skipped++
+			continue
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return copied, skipped, err
+		}
+		if _, err := dst.NewTranscription(ctx, t); err != nil {
+			log.Error().Err(err).Msgf("Error copying transcription %v", t.ID.Hex())
+			return copied, skipped, err
+		}
+		copied++
+	}
+	return copied, skipped, nil
+}
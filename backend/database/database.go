@@ -1,15 +1,150 @@
 package database
 
 import (
+	"context"
+	"errors"
+	"time"
+
 	"codeberg.org/pluja/whishper/models"
 )
 
+var (
+	// ErrNotFound is returned when no transcription matches the given id.
+	ErrNotFound = errors.New("transcription not found")
+	// ErrNotModified is returned when an update leaves the document unchanged.
+	ErrNotModified = errors.New("no documents were modified")
+	// ErrInvalidID is returned when the given id is not a valid ObjectID.
+	ErrInvalidID = errors.New("invalid transcription id")
+	// ErrLeaseLost is returned when a worker renews a lease it no longer holds.
+	ErrLeaseLost = errors.New("lease lost")
+	// ErrConflict is returned when an update carries an outdated version.
+	ErrConflict = errors.New("transcription was modified concurrently")
+)
+
+// ClaimRequest identifies the worker claiming a job and for how long the job
+// is leased to it.
+type ClaimRequest struct {
+	WorkerID string
+	Lease    time.Duration
+	// SkipDevices and SkipModelSizes leave out the jobs for the devices and
+	// model sizes the worker has no capacity left for.
+	SkipDevices    []string
+	SkipModelSizes []string
+}
+
+// JobOutcome is how a job ended: failed for good with Error, or done with
+// Result if Error is nil. A failed job with RetryAt set is scheduled to run
+// again at that time instead.
+type JobOutcome struct {
+	Result  models.WhisperResult
+	Error   *models.JobError
+	RetryAt *time.Time
+}
+
 type Db interface {
-	NewTranscription(*models.Transcription) (*models.Transcription, error)
-	UpdateTranscription(*models.Transcription) (*models.Transcription, error)
-	DeleteTranscription(string) error
-	GetTranscription(string) *models.Transcription
-	GetAllTranscriptions() []*models.Transcription
-	GetPendingTranscriptions() []*models.Transcription
-	GetRunningTranscription() []*models.Transcription
+	NewTranscription(context.Context, *models.Transcription) (*models.Transcription, error)
+	// UpdateTranscription writes t if the stored version is still t.Version,
+	// and increments it. It returns ErrConflict otherwise.
+	UpdateTranscription(context.Context, *models.Transcription) (*models.Transcription, error)
+	// DeleteTranscription deletes a transcription for good, along with its
+	// revisions. Users delete to the trash with TrashTranscription.
+	DeleteTranscription(context.Context, string) error
+	// PurgeTranscription deletes a transcription in the trash for good, like
+	// DeleteTranscription, and returns it. If trashedBefore isn't zero, it
+	// must have been trashed before then. It returns ErrConflict if it isn't
+	// in the trash, or was trashed again since.
+	PurgeTranscription(ctx context.Context, id string, trashedBefore time.Time) (*models.Transcription, error)
+	// TrashTranscription moves a transcription to the trash, which hides it
+	// from listings, searches and the queue. It returns ErrNotModified if it
+	// is in the trash already.
+	TrashTranscription(ctx context.Context, id string) (*models.Transcription, error)
+	// RestoreTranscription takes a transcription out of the trash. It
+	// returns ErrNotModified if it isn't in the trash.
+	RestoreTranscription(ctx context.Context, id string) (*models.Transcription, error)
+	// RecoverTranscription moves a running transcription still at version,
+	// whose worker stopped renewing its lease, to status, drops the lease and
+	// records jobErr. It returns ErrConflict if the transcription was written
+	// since, or isn't running anymore.
+	RecoverTranscription(ctx context.Context, id string, version int64, status int, jobErr *models.JobError) (*models.Transcription, error)
+	// CancelTranscription moves a pending, scheduled or running
+	// transcription to cancelled and drops its lease. It returns
+	// ErrNotModified if it is none of them.
+	CancelTranscription(ctx context.Context, id string) (*models.Transcription, error)
+	// Retranscribe queues a done, failed or cancelled transcription still at
+	// t.Version again, with the language, model size, beam size, initial
+	// prompt, hotwords, VAD settings and audio preprocessing of t. Its
+	// result, translations and error are dropped. It returns ErrConflict if
+	// the transcription was written since, or isn't finished.
+	Retranscribe(ctx context.Context, t *models.Transcription) (*models.Transcription, error)
+	GetTranscription(context.Context, string) (*models.Transcription, error)
+	// GetAllTranscriptions also returns the transcriptions in the trash.
+	GetAllTranscriptions(context.Context) ([]*models.Transcription, error)
+	// GetPendingTranscriptions returns the queue, in the order it is
+	// claimed.
+	GetPendingTranscriptions(context.Context) ([]*models.Transcription, error)
+	GetRunningTranscription(context.Context) ([]*models.Transcription, error)
+	// ListTranscriptions returns one page of the transcriptions matching
+	// opts, without their segments. It lists the trash if opts.Trashed is
+	// set, and what isn't in the trash otherwise.
+	ListTranscriptions(context.Context, ListOptions) (*ListPage, error)
+	// SearchTranscriptions finds the transcriptions whose result or
+	// translations contain the query, best matches first.
+	SearchTranscriptions(context.Context, SearchOptions) ([]SearchHit, error)
+	// ClaimNextPending atomically moves the first pending transcription the
+	// request doesn't skip to running, leased to the worker. Jobs are taken
+	// by priority, highest first, then oldest first. It returns
+	// ErrNotFound if no such job is pending.
+	ClaimNextPending(context.Context, ClaimRequest) (*models.Transcription, error)
+	// ReleaseScheduled queues the scheduled transcriptions due by now, except
+	// the ones in the trash, and returns them.
+	ReleaseScheduled(ctx context.Context, now time.Time) ([]*models.Transcription, error)
+	// RenewLease extends the lease of a running transcription until the
+	// given time. It returns ErrLeaseLost if the worker doesn't hold it.
+	RenewLease(ctx context.Context, id string, workerID string, until time.Time) error
+	// FinishJob atomically ends a running transcription leased to the
+	// worker with outcome, and drops the lease. A done job gets its result,
+	// its words count and a full progress, and loses the error of earlier
+	// attempts. A job to retry goes back to scheduled with its not before
+	// set to RetryAt, so ReleaseScheduled queues it again. It returns ErrLeaseLost if the worker doesn't hold the job
+	// anymore, like when it was cancelled, taken over or deleted.
+	FinishJob(ctx context.Context, id string, workerID string, outcome JobOutcome) (*models.Transcription, error)
+
+	// Narrow updates only write the fields they are about, so concurrent
+	// writers don't overwrite each other. They return the updated document.
+	SetProgress(ctx context.Context, id string, progress float64, downloadingModel bool) (*models.Transcription, error)
+	// SetStatus also drops the lease when the status isn't running.
+	SetStatus(ctx context.Context, id string, status int) (*models.Transcription, error)
+	// SetError records why the last attempt failed. A nil error clears it.
+	SetError(ctx context.Context, id string, jobErr *models.JobError) (*models.Transcription, error)
+	// SetResult stores the result and its words count.
+	SetResult(ctx context.Context, id string, result models.WhisperResult) (*models.Transcription, error)
+	AppendTranslation(ctx context.Context, id string, translation models.Translation) (*models.Transcription, error)
+	RenameFile(ctx context.Context, id string, fileName string) (*models.Transcription, error)
+	// SetPriority moves a pending transcription in the queue. It returns
+	// ErrConflict if the transcription isn't pending or is in the trash.
+	SetPriority(ctx context.Context, id string, priority int) (*models.Transcription, error)
+	// PatchSegment replaces the result segment with the same id. It returns
+	// ErrSegmentNotFound if there is none.
+	PatchSegment(ctx context.Context, id string, segment models.Segment) (*models.Transcription, error)
+
+	// SchemaVersion returns the version of the last migration applied to
+	// the database, 0 if none was.
+	SchemaVersion(context.Context) (int, error)
+	SetSchemaVersion(context.Context, int) error
+	// EnsureIndexes creates the indexes the queries rely on, if missing. It
+	// runs on every startup.
+	EnsureIndexes(context.Context) error
+	// IndexStatus reports which of the declared indexes exist, followed by
+	// the other indexes found in the database.
+	IndexStatus(context.Context) ([]IndexStatus, error)
+
+	// AddRevision saves a revision, giving it an id and a creation time.
+	// Revisions are deleted along with their transcription.
+	AddRevision(context.Context, *models.Revision) (*models.Revision, error)
+	// ListRevisions returns the revisions of a transcription, newest first,
+	// without their result and translations.
+	ListRevisions(ctx context.Context, transcriptionID string) ([]*models.Revision, error)
+	// GetRevision returns ErrRevisionNotFound if the transcription has no
+	// such revision.
+	GetRevision(ctx context.Context, transcriptionID string, revisionID string) (*models.Revision, error)
 }
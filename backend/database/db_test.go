@@ -0,0 +1,136 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+// forEachBackend runs test against a new, empty store of every driver.
+// MongoDb is only tested when TEST_DB_ENDPOINT points to a server, which must
+// be a throwaway one: the whishper database there is dropped before and after
+// each test.
+func forEachBackend(t *testing.T, test func(t *testing.T, db Db)) {
+	t.Run("memory", func(t *testing.T) {
+		db, err := NewMemoryDb("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		test(t, db)
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		test(t, newTestSqlite(t, filepath.Join(t.TempDir(), "whishper.db")))
+	})
+	t.Run("mongo", func(t *testing.T) {
+		endpoint := os.Getenv("TEST_DB_ENDPOINT")
+		if endpoint == "" {
+			t.Skip("TEST_DB_ENDPOINT is not set")
+		}
+		t.Setenv("DB_ENDPOINT", endpoint)
+		db := NewMongoDb()
+		drop := func() {
+			if err := db.client.Database("whishper").Drop(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		drop()
+		t.Cleanup(drop)
+		if err := db.EnsureIndexes(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		test(t, db)
+	})
+}
+
+func newTestSqlite(t *testing.T, path string) *SqliteDb {
+	db, err := NewSqliteDb(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.db.Close() })
+	return db
+}
+
+func TestNewTranscription(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Db) {
+		ctx := context.Background()
+		tr, err := db.NewTranscription(ctx, &models.Transcription{
+			FileName: "a.mp3",
+			Result:   models.WhisperResult{Text: "hello", Segments: []models.Segment{{ID: "1", Text: "hello"}}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tr.ID.IsZero() || tr.Version != 1 || tr.CreatedAt.IsZero() {
+			t.Errorf("new transcription has id %v, version %v and creation time %v", tr.ID, tr.Version, tr.CreatedAt)
+		}
+		got, err := db.GetTranscription(ctx, tr.ID.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.FileName != "a.mp3" || len(got.Result.Segments) != 1 || got.Result.Segments[0].Text != "hello" {
+			t.Errorf("got %+v, want the new transcription", got)
+		}
+		all, err := db.GetAllTranscriptions(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 1 || all[0].ID != tr.ID {
+			t.Errorf("got all %v, want the new transcription only", all)
+		}
+	})
+}
+
+// Purging deletes a transcription only while it is in the trash, trashed
+// before the given time, whatever was read before.
+func TestPurgeTranscription(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Db) {
+		ctx := context.Background()
+		tr, err := db.NewTranscription(ctx, &models.Transcription{FileName: "a.mp3"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := tr.ID.Hex()
+		if _, err := db.PurgeTranscription(ctx, id, time.Time{}); !errors.Is(err, ErrConflict) {
+			t.Errorf("purging out of the trash: got error %v, want %v", err, ErrConflict)
+		}
+		trashed, err := db.TrashTranscription(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.PurgeTranscription(ctx, id, *trashed.DeletedAt); !errors.Is(err, ErrConflict) {
+			t.Errorf("purging trashed at the cutoff: got error %v, want %v", err, ErrConflict)
+		}
+		if _, err := db.RestoreTranscription(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.PurgeTranscription(ctx, id, time.Time{}); !errors.Is(err, ErrConflict) {
+			t.Errorf("purging once restored: got error %v, want %v", err, ErrConflict)
+		}
+		if _, err := db.GetTranscription(ctx, id); err != nil {
+			t.Fatalf("kept transcription: %v", err)
+		}
+
+		if _, err := db.TrashTranscription(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		purged, err := db.PurgeTranscription(ctx, id, time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if purged.ID != tr.ID || purged.FileName != "a.mp3" {
+			t.Errorf("purged %+v, want the transcription", purged)
+		}
+		if _, err := db.GetTranscription(ctx, id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("getting the purged transcription: got error %v, want %v", err, ErrNotFound)
+		}
+		if _, err := db.PurgeTranscription(ctx, id, time.Time{}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("purging again: got error %v, want %v", err, ErrNotFound)
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+func TestTypedErrors(t *testing.T) {
+	missing := primitive.NewObjectID().Hex()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		call func(ctx context.Context, db Db, id string) error
+		ctx  context.Context
+		id   string
+		want error
+	}{
+		{
+			name: "get missing",
+			call: func(ctx context.Context, db Db, id string) error {
+				_, err := db.GetTranscription(ctx, id)
+				return err
+			},
+			id:   missing,
+			want: ErrNotFound,
+		},
+		{
+			name: "get invalid id",
+			call: func(ctx context.Context, db Db, id string) error {
+				_, err := db.GetTranscription(ctx, id)
+				return err
+			},
+			id:   "not-an-id",
+			want: ErrInvalidID,
+		},
+		{
+			name: "delete missing",
+			call: func(ctx context.Context, db Db, id string) error {
+				return db.DeleteTranscription(ctx, id)
+			},
+			id:   missing,
+			want: ErrNotFound,
+		},
+		{
+			name: "update missing",
+			call: func(ctx context.Context, db Db, id string) error {
+				oid, _ := primitive.ObjectIDFromHex(id)
+				_, err := db.UpdateTranscription(ctx, &models.Transcription{ID: oid, Version: 1})
+				return err
+			},
+			id:   missing,
+			want: ErrNotFound,
+		},
+		{
+			name: "narrow update missing",
+			call: func(ctx context.Context, db Db, id string) error {
+				_, err := db.SetProgress(ctx, id, 0.5, false)
+				return err
+			},
+			id:   missing,
+			want: ErrNotFound,
+		},
+		{
+			name: "narrow update invalid id",
+			call: func(ctx context.Context, db Db, id string) error {
+				_, err := db.SetStatus(ctx, id, models.TranscriptionStatusDone)
+				return err
+			},
+			id:   "not-an-id",
+			want: ErrInvalidID,
+		},
+		{
+			name: "claim empty queue",
+			call: func(ctx context.Context, db Db, id string) error {
+				_, err := db.ClaimNextPending(ctx, ClaimRequest{WorkerID: "w", Lease: time.Minute})
+				return err
+			},
+			want: ErrNotFound,
+		},
+		{
+			name: "revision invalid id",
+			call: func(ctx context.Context, db Db, id string) error {
+				_, err := db.GetRevision(ctx, missing, id)
+				return err
+			},
+			id:   "not-an-id",
+			want: ErrRevisionNotFound,
+		},
+		{
+			name: "cancelled context",
+			call: func(ctx context.Context, db Db, id string) error {
+				_, err := db.NewTranscription(ctx, &models.Transcription{})
+				return err
+			},
+			ctx:  cancelled,
+			want: context.Canceled,
+		},
+	}
+
+	forEachBackend(t, func(t *testing.T, db Db) {
+		for _, tt := range tests {
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			if err := tt.call(ctx, db, tt.id); !errors.Is(err, tt.want) {
+				t.Errorf("%v: got error %v, want %v", tt.name, err, tt.want)
+			}
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package database
+
+import (
+	"strings"
+)
+
+// Index is an index a backend declares for its queries. EnsureIndexes creates
+// the declared indexes and IndexStatus reports whether they exist.
+type Index struct {
+	// Collection is the collection, or table, the index belongs to.
+	Collection string
+	Name       string
+	// Keys are the indexed fields in order, prefixed with "-" when
+	// descending.
+	Keys   []string
+	Unique bool
+	// Sparse indexes leave out the documents without the first key.
+	Sparse bool
+	// Text indexes hold the words of their keys, for searches. Their keys
+	// have no direction.
+	Text bool
+}
+
+// IndexStatus is the state of an index in the database.
+type IndexStatus struct {
+	Collection string   `json:"collection"`
+	Name       string   `json:"name"`
+	Keys       []string `json:"keys"`
+	Unique     bool     `json:"unique,omitempty"`
+	// Declared is false for the indexes found in the database that the
+	// backend doesn't declare, like the ones created by hand.
+	Declared bool `json:"declared"`
+	// Present is false for the declared indexes missing from the database,
+	// or existing with other keys.
+	Present bool `json:"present"`
+}
+
+// indexStatus matches the declared indexes against the existing ones, given
+// by collection and name. Existing indexes that aren't declared are reported
+// after the declared ones.
+func indexStatus(declared []Index, existing []IndexStatus) []IndexStatus {
+	found := map[string]IndexStatus{}
+	for _, ix := range existing {
+		found[ix.Collection+"."+ix.Name] = ix
+	}
+
+	statuses := make([]IndexStatus, 0, len(declared)+len(existing))
+	for _, ix := range declared {
+		key := ix.Collection + "." + ix.Name
+		current, ok := found[key]
+		delete(found, key)
+		statuses = append(statuses, IndexStatus{
+			Collection: ix.Collection,
+			Name:       ix.Name,
+			Keys:       ix.Keys,
+			Unique:     ix.Unique,
+			Declared:   true,
+			Present:    ok && strings.Join(current.Keys, ",") == strings.Join(ix.Keys, ","),
+		})
+	}
+	for _, ix := range existing {
+		if _, ok := found[ix.Collection+"."+ix.Name]; ok {
+			ix.Present = true
+			statuses = append(statuses, ix)
+		}
+	}
+	return statuses
+}
+
+// indexKey splits a key of Index.Keys into its field and direction.
+func indexKey(key string) (field string, desc bool) {
+	if strings.HasPrefix(key, "-") {
+		return key[1:], true
+	}
+	return key, false
+}
@@ -0,0 +1,100 @@
+package database
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+// leaseUntil is the expiry of a lease taken now. BSON dates only keep
+// milliseconds, so it is truncated to make every backend return the same value.
+func leaseUntil(now time.Time, lease time.Duration) time.Time {
+	return now.Add(lease).UTC().Truncate(time.Millisecond)
+}
+
+// accepts reports whether the worker of req can take t. Backends that can't
+// filter in their query language use it directly.
+func (req *ClaimRequest) accepts(t *models.Transcription) bool {
+	for _, device := range req.SkipDevices {
+		if t.Device == device {
+			return false
+		}
+	}
+	for _, size := range req.SkipModelSizes {
+		if t.ModelSize == size {
+			return false
+		}
+	}
+	return true
+}
+
+// queueOrder sorts pending jobs in the order they are claimed: by priority,
+// highest first, then in submission order. Backends that can't sort in their
+// query language use it directly.
+func queueOrder(list []*models.Transcription) {
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Priority != list[j].Priority {
+			return list[i].Priority > list[j].Priority
+		}
+		return bytes.Compare(list[i].ID[:], list[j].ID[:]) < 0
+	})
+}
+
+// due reports whether t is a scheduled job to release by now.
+func due(t *models.Transcription, now time.Time) bool {
+	return t.Status == models.TranscriptionStatusScheduled && t.DeletedAt == nil &&
+		(t.NotBefore == nil || !t.NotBefore.After(now))
+}
+
+// claimUpdate moves a claimed job to running.
+func claimUpdate(req ClaimRequest, now time.Time) fieldUpdate {
+	return fieldUpdate{set: bson.D{
+		primitive.E{Key: "status", Value: models.TranscriptionStatusRunning},
+		primitive.E{Key: "lease_owner", Value: req.WorkerID},
+		primitive.E{Key: "lease_expires_at", Value: leaseUntil(now, req.Lease)},
+	}}
+}
+
+func renewUpdate(until time.Time) fieldUpdate {
+	return fieldUpdate{set: bson.D{primitive.E{Key: "lease_expires_at", Value: until.UTC().Truncate(time.Millisecond)}}}
+}
+
+// finishUpdate moves a running job to done or failed, as outcome tells.
+func finishUpdate(outcome JobOutcome) fieldUpdate {
+	if outcome.Error != nil && outcome.RetryAt != nil {
+		u := statusUpdate(models.TranscriptionStatusScheduled)
+		u.set = append(u.set,
+			primitive.E{Key: "not_before", Value: outcome.RetryAt.UTC().Truncate(time.Millisecond)},
+			primitive.E{Key: "progress", Value: 0.0},
+			primitive.E{Key: "downloading_model", Value: false},
+			primitive.E{Key: "error", Value: outcome.Error},
+		)
+		return u
+	}
+	if outcome.Error != nil {
+		u := statusUpdate(models.TranscriptionStatusError)
+		u.set = append(u.set,
+			primitive.E{Key: "downloading_model", Value: false},
+			primitive.E{Key: "error", Value: outcome.Error},
+		)
+		return u
+	}
+	u := statusUpdate(models.TranscriptionStatusDone)
+	u.set = append(u.set, resultUpdate(outcome.Result).set...)
+	u.set = append(u.set,
+		primitive.E{Key: "progress", Value: 1.0},
+		primitive.E{Key: "downloading_model", Value: false},
+	)
+	u.unset = append(u.unset, "error")
+	return u
+}
+
+// holdsLease reports whether t is running under the lease of workerID.
+func holdsLease(t *models.Transcription, workerID string) bool {
+	return t.Status == models.TranscriptionStatusRunning && t.LeaseOwner == workerID
+}
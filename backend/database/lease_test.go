@@ -0,0 +1,227 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+// Workers claiming at the same time never get the same job, and together
+// they get all of them.
+func TestConcurrentClaims(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Db) {
+		ctx := context.Background()
+		const jobs, workers = 20, 8
+		for i := 0; i < jobs; i++ {
+			if _, err := db.NewTranscription(ctx, &models.Transcription{Status: models.TranscriptionStatusPending}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var mu sync.Mutex
+		claimed := map[string]string{}
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(worker string) {
+				defer wg.Done()
+				for {
+					job, err := db.ClaimNextPending(ctx, ClaimRequest{WorkerID: worker, Lease: time.Minute})
+					if errors.Is(err, ErrNotFound) {
+						return
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if job.Status != models.TranscriptionStatusRunning || job.LeaseOwner != worker {
+						t.Errorf("%v claimed a job with status %v leased to %q", worker, job.Status, job.LeaseOwner)
+					}
+					mu.Lock()
+					if other, ok := claimed[job.ID.Hex()]; ok {
+						t.Errorf("job %v claimed by both %v and %v", job.ID.Hex(), other, worker)
+					}
+					claimed[job.ID.Hex()] = worker
+					mu.Unlock()
+				}
+			}(fmt.Sprintf("worker-%v", w))
+		}
+		wg.Wait()
+		if len(claimed) != jobs {
+			t.Errorf("claimed %v jobs, want %v", len(claimed), jobs)
+		}
+	})
+}
+
+func TestFinishJob(t *testing.T) {
+	result := models.WhisperResult{Text: "hello world", Segments: []models.Segment{{ID: "1", Text: "hello world"}}}
+	failure := &models.JobError{Stage: models.ErrorStageTranscribe, Message: "boom", Attempts: 3}
+	retryAt := time.Now().Add(time.Minute)
+
+	tests := []struct {
+		name    string
+		worker  string
+		before  func(ctx context.Context, db Db, id string) error
+		outcome JobOutcome
+		status  int
+		err     error
+	}{
+		{name: "done", worker: "w1", outcome: JobOutcome{Result: result}, status: models.TranscriptionStatusDone},
+		{name: "failed", worker: "w1", outcome: JobOutcome{Error: failure}, status: models.TranscriptionStatusError},
+		{name: "retry", worker: "w1", outcome: JobOutcome{Error: failure, RetryAt: &retryAt}, status: models.TranscriptionStatusScheduled},
+		{name: "other worker", worker: "w2", outcome: JobOutcome{Result: result}, status: models.TranscriptionStatusRunning, err: ErrLeaseLost},
+		{
+			name:   "cancelled",
+			worker: "w1",
+			before: func(ctx context.Context, db Db, id string) error {
+				_, err := db.CancelTranscription(ctx, id)
+				return err
+			},
+			outcome: JobOutcome{Result: result},
+			status:  models.TranscriptionStatusCancelled,
+			err:     ErrLeaseLost,
+		},
+		{
+			name:   "recovered",
+			worker: "w1",
+			before: func(ctx context.Context, db Db, id string) error {
+				t, err := db.GetTranscription(ctx, id)
+				if err != nil {
+					return err
+				}
+				_, err = db.RecoverTranscription(ctx, id, t.Version, models.TranscriptionStatusPending, failure)
+				return err
+			},
+			outcome: JobOutcome{Error: failure},
+			status:  models.TranscriptionStatusPending,
+			err:     ErrLeaseLost,
+		},
+	}
+
+	forEachBackend(t, func(t *testing.T, db Db) {
+		ctx := context.Background()
+		for _, tt := range tests {
+			// An earlier attempt failed.
+			earlier := &models.JobError{Stage: models.ErrorStageTranscribe, Message: "timeout", Attempts: 1}
+			tr, err := db.NewTranscription(ctx, &models.Transcription{Status: models.TranscriptionStatusPending, Error: earlier})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.ClaimNextPending(ctx, ClaimRequest{WorkerID: "w1", Lease: time.Minute}); err != nil {
+				t.Fatal(err)
+			}
+			id := tr.ID.Hex()
+			if tt.before != nil {
+				if err := tt.before(ctx, db, id); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			finished, err := db.FinishJob(ctx, id, tt.worker, tt.outcome)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("%v: got error %v, want %v", tt.name, err, tt.err)
+			}
+			got, err := db.GetTranscription(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tt.status {
+				t.Errorf("%v: status %v, want %v", tt.name, got.Status, tt.status)
+			}
+			if tt.err != nil {
+				if got.Result.Text != "" {
+					t.Errorf("%v: the result was saved for a job the worker lost", tt.name)
+				}
+				continue
+			}
+			if finished.Status != tt.status || got.LeaseOwner != "" || got.LeaseExpiresAt != nil {
+				t.Errorf("%v: finished with status %v, lease %q until %v", tt.name, finished.Status, got.LeaseOwner, got.LeaseExpiresAt)
+			}
+			switch tt.status {
+			case models.TranscriptionStatusDone:
+				if got.Result.Text != "hello world" || len(got.Result.Segments) != 1 || got.WordsCount != 2 || got.Progress != 1 || got.Error != nil {
+					t.Errorf("%v: done with result %+v, %v words, progress %v and error %v", tt.name, got.Result, got.WordsCount, got.Progress, got.Error)
+				}
+			case models.TranscriptionStatusError:
+				if got.Error == nil || got.Error.Message != "boom" || got.Result.Text != "" {
+					t.Errorf("%v: failed with error %+v and result %+v", tt.name, got.Error, got.Result)
+				}
+			case models.TranscriptionStatusScheduled:
+				if got.Error == nil || got.Error.Message != "boom" || got.NotBefore == nil || !got.NotBefore.Equal(retryAt.Truncate(time.Millisecond)) {
+					t.Errorf("%v: scheduled with error %+v not before %v, want %v", tt.name, got.Error, got.NotBefore, retryAt)
+				}
+			}
+		}
+	})
+}
+
+func TestReleaseScheduled(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+	tests := []struct {
+		name      string
+		status    int
+		notBefore *time.Time
+		trashed   bool
+		released  bool
+	}{
+		{name: "due", status: models.TranscriptionStatusScheduled, notBefore: at(-time.Hour), released: true},
+		{name: "due now", status: models.TranscriptionStatusScheduled, notBefore: at(0), released: true},
+		{name: "no time", status: models.TranscriptionStatusScheduled, released: true},
+		{name: "later", status: models.TranscriptionStatusScheduled, notBefore: at(time.Minute)},
+		{name: "in the trash", status: models.TranscriptionStatusScheduled, notBefore: at(-time.Hour), trashed: true},
+		{name: "pending", status: models.TranscriptionStatusPending, notBefore: at(-time.Hour)},
+		{name: "done", status: models.TranscriptionStatusDone, notBefore: at(-time.Hour)},
+	}
+
+	forEachBackend(t, func(t *testing.T, db Db) {
+		ctx := context.Background()
+		names := map[string]string{}
+		for _, tt := range tests {
+			tr, err := db.NewTranscription(ctx, &models.Transcription{FileName: tt.name, Status: tt.status, NotBefore: tt.notBefore})
+			if err != nil {
+				t.Fatal(err)
+			}
+			names[tr.ID.Hex()] = tt.name
+			if tt.trashed {
+				if _, err := db.TrashTranscription(ctx, tr.ID.Hex()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		released, err := db.ReleaseScheduled(ctx, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]bool{}
+		for _, tr := range released {
+			if tr.Status != models.TranscriptionStatusPending {
+				t.Errorf("%v: released with status %v", names[tr.ID.Hex()], tr.Status)
+			}
+			got[names[tr.ID.Hex()]] = true
+		}
+		for _, tt := range tests {
+			if got[tt.name] != tt.released {
+				t.Errorf("%v: released %v, want %v", tt.name, got[tt.name], tt.released)
+			}
+		}
+
+		// Released jobs are queued, so they aren't released twice.
+		again, err := db.ReleaseScheduled(ctx, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(again) != 0 {
+			t.Errorf("released %v jobs again", len(again))
+		}
+	})
+}
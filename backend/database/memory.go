@@ -0,0 +1,860 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+// MemoryDb is a thread-safe, in-memory implementation of Db. Documents are
+// kept as BSON so that reads and writes follow the same rules as MongoDb
+// ($set semantics, generated ObjectIDs, "no documents were modified", ...).
+// If a snapshot path is given, the whole store, revisions and schema version
+// included, is written to disk after every change and loaded back on startup.
+// Progress updates are the exception: they are written together, at most
+// every progressFlush.
+type MemoryDb struct {
+	mu sync.RWMutex
+	memoryState
+	snapshot string
+	// dirty is set while progress updates wait for flush to write them.
+	dirty bool
+	flush *time.Timer
+}
+
+// progressFlush is how long progress updates may wait to be written to the
+// snapshot. A crash loses them, which only loses the progress of jobs the
+// recovery restarts anyway.
+const progressFlush = 5 * time.Second
+
+// memoryState is the content of a MemoryDb. Writes change a copy of it, which
+// replaces the current one once it is saved.
+type memoryState struct {
+	docs          map[primitive.ObjectID]bson.Raw
+	order         []primitive.ObjectID
+	schemaVersion int
+	// revisions are kept in the order they were added.
+	revisions []bson.Raw
+}
+
+// clone copies the state deeply enough to change the copy. The documents
+// themselves are never changed in place.
+func (s *memoryState) clone() *memoryState {
+	c := &memoryState{
+		docs:          make(map[primitive.ObjectID]bson.Raw, len(s.docs)),
+		order:         append([]primitive.ObjectID(nil), s.order...),
+		schemaVersion: s.schemaVersion,
+		revisions:     append([]bson.Raw(nil), s.revisions...),
+	}
+	for id, raw := range s.docs {
+		c.docs[id] = raw
+	}
+	return c
+}
+
+func NewMemoryDb(snapshotPath string) (*MemoryDb, error) {
+	m := &MemoryDb{
+		memoryState: memoryState{docs: make(map[primitive.ObjectID]bson.Raw)},
+		snapshot:    snapshotPath,
+	}
+	if snapshotPath == "" {
+		return m, nil
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	log.Info().Msgf("Loaded %v transcriptions from snapshot %v", len(m.order), snapshotPath)
+	return m, nil
+}
+
+func (m *MemoryDb) GetTranscription(ctx context.Context, id string) (*models.Transcription, error) {
+	oid, err := objectID(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	raw, ok := m.docs[oid]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return decodeTranscription(raw)
+}
+
+func (m *MemoryDb) DeleteTranscription(ctx context.Context, id string) error {
+	_, err := m.delete(ctx, id, nil)
+	return err
+}
+
+func (m *MemoryDb) PurgeTranscription(ctx context.Context, id string, trashedBefore time.Time) (*models.Transcription, error) {
+	trashed := ListOptions{Trashed: true, TrashedBefore: trashedBefore}
+	return m.delete(ctx, id, &trashed)
+}
+
+// delete deletes the transcription id and its revisions if it matches the
+// filters of opts, or in any case if opts is nil.
+func (m *MemoryDb) delete(ctx context.Context, id string, opts *ListOptions) (*models.Transcription, error) {
+	oid, err := objectID(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deleted *models.Transcription
+	err = m.write(func(s *memoryState) error {
+		raw, ok := s.docs[oid]
+		if !ok {
+			return ErrNotFound
+		}
+		t, err := decodeTranscription(raw)
+		if err != nil {
+			return err
+		}
+		if opts != nil && !opts.matches(t) {
+			return ErrConflict
+		}
+		deleted = t
+		delete(s.docs, oid)
+		for i, o := range s.order {
+			if o == oid {
+				s.order = append(s.order[:i], s.order[i+1:]...)
+				break
+			}
+		}
+		kept := s.revisions[:0]
+		for _, raw := range s.revisions {
+			if tid, _ := raw.Lookup("transcription_id").ObjectIDOK(); tid != oid {
+				kept = append(kept, raw)
+			}
+		}
+		s.revisions = kept
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+func (m *MemoryDb) NewTranscription(ctx context.Context, t *models.Transcription) (*models.Transcription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Like InsertOne, keep a caller provided id and generate one otherwise.
+	id := t.ID
+	if id == primitive.NilObjectID {
+		id = primitive.NewObjectID()
+	}
+	if _, ok := m.docs[id]; ok {
+		err := fmt.Errorf("duplicate key error: _id %v", id.Hex())
+		log.Printf("Error creating new transcription: %v", err)
+		return nil, err
+	}
+
+	doc := *t
+	doc.ID = id
+	prepareNew(&doc)
+	raw, err := bson.Marshal(&doc)
+	if err != nil {
+		log.Printf("Error creating new transcription: %v", err)
+		return nil, err
+	}
+	err = m.write(func(s *memoryState) error {
+		s.docs[id] = raw
+		s.order = append(s.order, id)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t.ID = id
+	t.Version, t.CreatedAt, t.UpdatedAt = doc.Version, doc.CreatedAt, doc.UpdatedAt
+	return t, nil
+}
+
+func (m *MemoryDb) GetAllTranscriptions(ctx context.Context) ([]*models.Transcription, error) {
+	return m.find(ctx, func(*models.Transcription) bool { return true })
+}
+
+func (m *MemoryDb) GetPendingTranscriptions(ctx context.Context) ([]*models.Transcription, error) {
+	pending, err := m.find(ctx, func(t *models.Transcription) bool {
+		return t.Status == models.TranscriptionStatusPending && t.DeletedAt == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	queueOrder(pending)
+	return pending, nil
+}
+
+func (m *MemoryDb) GetRunningTranscription(ctx context.Context) ([]*models.Transcription, error) {
+	return m.find(ctx, func(t *models.Transcription) bool {
+		return t.Status == models.TranscriptionStatusRunning
+	})
+}
+
+func (m *MemoryDb) UpdateTranscription(ctx context.Context, t *models.Transcription) (*models.Transcription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, ok := m.docs[t.ID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	merged, err := replaceUpdate(current, t)
+	if err != nil {
+		return nil, err
+	}
+	err = m.write(func(s *memoryState) error {
+		s.docs[t.ID] = merged
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (m *MemoryDb) ListTranscriptions(ctx context.Context, opts ListOptions) (*ListPage, error) {
+	cur, err := opts.cursor()
+	if err != nil {
+		return nil, err
+	}
+	matches, err := m.find(ctx, opts.matches)
+	if err != nil {
+		return nil, err
+	}
+
+	sortBy := opts.sortBy()
+	sort.SliceStable(matches, func(i, j int) bool {
+		cmp := compareValues(sortValue(matches[i], sortBy), sortValue(matches[j], sortBy))
+		if cmp == 0 {
+			cmp = compareValues(matches[i].ID, matches[j].ID)
+		}
+		if opts.Desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
+
+	page := &ListPage{Total: int64(len(matches))}
+	for _, t := range matches {
+		if cur != nil && !cur.after(t) {
+			continue
+		}
+		if opts.Limit > 0 && len(page.Items) == opts.Limit {
+			page.NextCursor = encodeCursor(&opts, page.Items[len(page.Items)-1])
+			break
+		}
+		page.Items = append(page.Items, listItem(t))
+	}
+	return page, nil
+}
+
+func (m *MemoryDb) SearchTranscriptions(ctx context.Context, opts SearchOptions) ([]SearchHit, error) {
+	terms := SearchTerms(opts.Query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	transcriptions, err := m.GetAllTranscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var hits []SearchHit
+	for _, t := range transcriptions {
+		if t.DeletedAt != nil {
+			continue
+		}
+		if hit := searchTranscription(t, terms); hit != nil {
+			hits = append(hits, *hit)
+		}
+	}
+	return rankHits(hits, opts.Limit), nil
+}
+
+func (m *MemoryDb) ClaimNextPending(ctx context.Context, req ClaimRequest) (*models.Transcription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var next *models.Transcription
+	for _, id := range m.order {
+		t, err := decodeTranscription(m.docs[id])
+		if err != nil {
+			return nil, err
+		}
+		if t.Status != models.TranscriptionStatusPending || t.DeletedAt != nil || !req.accepts(t) {
+			continue
+		}
+		// Ties keep the first one, which is the oldest.
+		if next == nil || t.Priority > next.Priority {
+			next = t
+		}
+	}
+	if next == nil {
+		return nil, ErrNotFound
+	}
+	var merged bson.Raw
+	err := m.write(func(s *memoryState) (err error) {
+		merged, err = s.setFields(next.ID, claimUpdate(req, time.Now()))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return decodeTranscription(merged)
+}
+
+func (m *MemoryDb) ReleaseScheduled(ctx context.Context, now time.Time) ([]*models.Transcription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var released []*models.Transcription
+	err := m.write(func(s *memoryState) error {
+		for _, id := range s.order {
+			t, err := decodeTranscription(s.docs[id])
+			if err != nil {
+				return err
+			}
+			if !due(t, now) {
+				continue
+			}
+			merged, err := s.setFields(id, releaseUpdate())
+			if err != nil {
+				return err
+			}
+			if t, err = decodeTranscription(merged); err != nil {
+				return err
+			}
+			released = append(released, t)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return released, nil
+}
+
+func (m *MemoryDb) SchemaVersion(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.schemaVersion, nil
+}
+
+func (m *MemoryDb) SetSchemaVersion(ctx context.Context, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.write(func(s *memoryState) error {
+		s.schemaVersion = version
+		return nil
+	})
+}
+
+// EnsureIndexes does nothing, every query scans the whole store.
+func (m *MemoryDb) EnsureIndexes(ctx context.Context) error {
+	return nil
+}
+
+// IndexStatus returns no index, the store has none.
+func (m *MemoryDb) IndexStatus(ctx context.Context) ([]IndexStatus, error) {
+	return []IndexStatus{}, nil
+}
+
+func (m *MemoryDb) AddRevision(ctx context.Context, r *models.Revision) (*models.Revision, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	prepareRevision(r)
+	raw, err := bson.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err = m.write(func(s *memoryState) error {
+		s.revisions = append(s.revisions, raw)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (m *MemoryDb) ListRevisions(ctx context.Context, transcriptionID string) ([]*models.Revision, error) {
+	oid, err := objectID(transcriptionID)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var revisions []*models.Revision
+	for i := len(m.revisions) - 1; i >= 0; i-- {
+		raw := m.revisions[i]
+		if tid, _ := raw.Lookup("transcription_id").ObjectIDOK(); tid != oid {
+			continue
+		}
+		var r models.Revision
+		if err := bson.Unmarshal(raw, &r); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revisionListItem(&r))
+	}
+	return revisions, nil
+}
+
+func (m *MemoryDb) GetRevision(ctx context.Context, transcriptionID string, revisionID string) (*models.Revision, error) {
+	oid, err := objectID(transcriptionID)
+	if err != nil {
+		return nil, err
+	}
+	rid, err := parseRevisionID(revisionID)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, raw := range m.revisions {
+		id, _ := raw.Lookup("_id").ObjectIDOK()
+		tid, _ := raw.Lookup("transcription_id").ObjectIDOK()
+		if id != rid || tid != oid {
+			continue
+		}
+		var r models.Revision
+		if err := bson.Unmarshal(raw, &r); err != nil {
+			return nil, err
+		}
+		return &r, nil
+	}
+	return nil, ErrRevisionNotFound
+}
+
+func (m *MemoryDb) RenewLease(ctx context.Context, id string, workerID string, until time.Time) error {
+	oid, err := objectID(id)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	raw, ok := m.docs[oid]
+	if !ok {
+		return ErrLeaseLost
+	}
+	t, err := decodeTranscription(raw)
+	if err != nil {
+		return err
+	}
+	if !holdsLease(t, workerID) {
+		return ErrLeaseLost
+	}
+	return m.write(func(s *memoryState) error {
+		_, err := s.setFields(oid, renewUpdate(until))
+		return err
+	})
+}
+
+func (m *MemoryDb) FinishJob(ctx context.Context, id string, workerID string, outcome JobOutcome) (*models.Transcription, error) {
+	t, err := m.modify(ctx, id, func(t *models.Transcription) (fieldUpdate, error) {
+		if !holdsLease(t, workerID) {
+			return fieldUpdate{}, ErrLeaseLost
+		}
+		return finishUpdate(outcome), nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrLeaseLost
+	}
+	return t, err
+}
+
+// SetProgress only writes the snapshot within progressFlush, along with the
+// other progress updates made meanwhile.
+func (m *MemoryDb) SetProgress(ctx context.Context, id string, progress float64, downloadingModel bool) (*models.Transcription, error) {
+	return m.modifyWith(ctx, id, m.writeLater, func(*models.Transcription) (fieldUpdate, error) {
+		return progressUpdate(progress, downloadingModel), nil
+	})
+}
+
+func (m *MemoryDb) SetStatus(ctx context.Context, id string, status int) (*models.Transcription, error) {
+	return m.modify(ctx, id, func(*models.Transcription) (fieldUpdate, error) {
+		return statusUpdate(status), nil
+	})
+}
+
+func (m *MemoryDb) SetError(ctx context.Context, id string, jobErr *models.JobError) (*models.Transcription, error) {
+	return m.modify(ctx, id, func(*models.Transcription) (fieldUpdate, error) {
+		return errorUpdate(jobErr), nil
+	})
+}
+
+func (m *MemoryDb) SetPriority(ctx context.Context, id string, priority int) (*models.Transcription, error) {
+	return m.modify(ctx, id, func(t *models.Transcription) (fieldUpdate, error) {
+		if t.Status != models.TranscriptionStatusPending || t.DeletedAt != nil {
+			return fieldUpdate{}, ErrConflict
+		}
+		return priorityUpdate(priority), nil
+	})
+}
+
+func (m *MemoryDb) SetResult(ctx context.Context, id string, result models.WhisperResult) (*models.Transcription, error) {
+	return m.modify(ctx, id, func(*models.Transcription) (fieldUpdate, error) {
+		return resultUpdate(result), nil
+	})
+}
+
+func (m *MemoryDb) AppendTranslation(ctx context.Context, id string, translation models.Translation) (*models.Transcription, error) {
+	return m.modify(ctx, id, func(t *models.Transcription) (fieldUpdate, error) {
+		return translationAppend(t, translation), nil
+	})
+}
+
+func (m *MemoryDb) RecoverTranscription(ctx context.Context, id string, version int64, status int, jobErr *models.JobError) (*models.Transcription, error) {
+	return m.modify(ctx, id, func(t *models.Transcription) (fieldUpdate, error) {
+		if t.Version != version || t.Status != models.TranscriptionStatusRunning {
+			return fieldUpdate{}, ErrConflict
+		}
+		return recoverUpdate(status, jobErr), nil
+	})
+}
+
+func (m *MemoryDb) CancelTranscription(ctx context.Context, id string) (*models.Transcription, error) {
+	return m.modify(ctx, id, func(t *models.Transcription) (fieldUpdate, error) {
+		if !cancellable(t.Status) {
+			return fieldUpdate{}, ErrNotModified
+		}
+		return cancelUpdate(), nil
+	})
+}
+
+func (m *MemoryDb) Retranscribe(ctx context.Context, t *models.Transcription) (*models.Transcription, error) {
+	return m.modify(ctx, t.ID.Hex(), func(current *models.Transcription) (fieldUpdate, error) {
+		if current.Version != t.Version || !finished(current.Status) {
+			return fieldUpdate{}, ErrConflict
+		}
+		return retranscribeUpdate(t), nil
+	})
+}
+
+func (m *MemoryDb) TrashTranscription(ctx context.Context, id string) (*models.Transcription, error) {
+	return m.modify(ctx, id, func(t *models.Transcription) (fieldUpdate, error) {
+		if t.DeletedAt != nil {
+			return fieldUpdate{}, ErrNotModified
+		}
+		return trashUpdate(writeTime()), nil
+	})
+}
+
+func (m *MemoryDb) RestoreTranscription(ctx context.Context, id string) (*models.Transcription, error) {
+	return m.modify(ctx, id, func(t *models.Transcription) (fieldUpdate, error) {
+		if t.DeletedAt == nil {
+			return fieldUpdate{}, ErrNotModified
+		}
+		return restoreUpdate(), nil
+	})
+}
+
+func (m *MemoryDb) RenameFile(ctx context.Context, id string, fileName string) (*models.Transcription, error) {
+	return m.modify(ctx, id, func(*models.Transcription) (fieldUpdate, error) {
+		return fileNameUpdate(fileName), nil
+	})
+}
+
+func (m *MemoryDb) PatchSegment(ctx context.Context, id string, segment models.Segment) (*models.Transcription, error) {
+	return m.modify(ctx, id, func(t *models.Transcription) (fieldUpdate, error) {
+		return segmentPatch(t, segment)
+	})
+}
+
+// modify applies the update built by change from the current document id,
+// under the write lock, and returns the updated document.
+func (m *MemoryDb) modify(ctx context.Context, id string, change func(*models.Transcription) (fieldUpdate, error)) (*models.Transcription, error) {
+	return m.modifyWith(ctx, id, m.write, change)
+}
+
+// modifyWith is modify saving the store with write, or writeLater.
+func (m *MemoryDb) modifyWith(ctx context.Context, id string, write func(func(*memoryState) error) error, change func(*models.Transcription) (fieldUpdate, error)) (*models.Transcription, error) {
+	oid, err := objectID(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	raw, ok := m.docs[oid]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	t, err := decodeTranscription(raw)
+	if err != nil {
+		return nil, err
+	}
+	u, err := change(t)
+	if err != nil {
+		return nil, err
+	}
+	var merged bson.Raw
+	err = write(func(s *memoryState) (err error) {
+		merged, err = s.setFields(oid, u)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return decodeTranscription(merged)
+}
+
+// setFields applies u to the document id.
+func (s *memoryState) setFields(id primitive.ObjectID, u fieldUpdate) (bson.Raw, error) {
+	current, ok := s.docs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	merged, err := u.apply(current)
+	if err != nil {
+		return nil, err
+	}
+	s.docs[id] = merged
+	return merged, nil
+}
+
+// write applies change to a copy of the store and saves the copy before it
+// replaces the store, so a failed change or save leaves the store as it was.
+// Callers must hold the write lock.
+func (m *MemoryDb) write(change func(*memoryState) error) error {
+	next := m.memoryState.clone()
+	if err := change(next); err != nil {
+		return err
+	}
+	if err := m.persist(next); err != nil {
+		return err
+	}
+	m.memoryState = *next
+	// The snapshot has the waiting progress updates too.
+	m.dirty = false
+	return nil
+}
+
+// writeLater applies change to the store in place, which is cheaper but
+// only fits changes that fail before they change anything, and leaves the
+// save to flushLater, which runs within progressFlush. Callers must hold the
+// write lock.
+func (m *MemoryDb) writeLater(change func(*memoryState) error) error {
+	if err := change(&m.memoryState); err != nil {
+		return err
+	}
+	if m.snapshot == "" {
+		return nil
+	}
+	m.dirty = true
+	if m.flush == nil {
+		m.flush = time.AfterFunc(progressFlush, m.flushLater)
+	}
+	return nil
+}
+
+// flushLater saves the progress updates left by writeLater, unless a write
+// has saved them already. If the save fails, the next write saves them.
+func (m *MemoryDb) flushLater() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flush = nil
+	if !m.dirty {
+		return
+	}
+	if err := m.persist(&m.memoryState); err == nil {
+		m.dirty = false
+	}
+}
+
+// find returns, in insertion order, the decoded documents accepted by match.
+// Like the MongoDb queries it returns nil when nothing matches.
+func (m *MemoryDb) find(ctx context.Context, match func(*models.Transcription) bool) ([]*models.Transcription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var transcriptions []*models.Transcription
+	for _, id := range m.order {
+		t, err := decodeTranscription(m.docs[id])
+		if err != nil {
+			log.Printf("Error decoding transcription: %v", err)
+			return nil, err
+		}
+		if match(t) {
+			transcriptions = append(transcriptions, t)
+		}
+	}
+	return transcriptions, nil
+}
+
+// Snapshot lines that aren't transcriptions hold a single one of these keys.
+const (
+	snapshotSchemaVersion = "schema_version"
+	snapshotRevision      = "revision"
+)
+
+// persist writes s to the snapshot file, if any. Callers must hold the write
+// lock. The snapshot holds one canonical extended JSON document per line: the
+// schema version, the transcriptions in insertion order, then the revisions
+// in the order they were added. It is replaced atomically.
+func (m *MemoryDb) persist(s *memoryState) error {
+	if m.snapshot == "" {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	writeLine := func(doc interface{}) error {
+		line, err := bson.MarshalExtJSON(doc, true, false)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		return nil
+	}
+	if err := writeLine(bson.D{{Key: snapshotSchemaVersion, Value: s.schemaVersion}}); err != nil {
+		log.Error().Err(err).Msg("Error encoding the schema version for the snapshot")
+		return err
+	}
+	for _, id := range s.order {
+		if err := writeLine(s.docs[id]); err != nil {
+			log.Error().Err(err).Msgf("Error encoding transcription %v for the snapshot", id.Hex())
+			return err
+		}
+	}
+	for _, raw := range s.revisions {
+		if err := writeLine(bson.D{{Key: snapshotRevision, Value: raw}}); err != nil {
+			log.Error().Err(err).Msg("Error encoding a revision for the snapshot")
+			return err
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(m.snapshot), filepath.Base(m.snapshot)+".tmp*")
+	if err != nil {
+		log.Error().Err(err).Msg("Error creating snapshot file")
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		log.Error().Err(err).Msg("Error writing snapshot file")
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		log.Error().Err(err).Msg("Error writing snapshot file")
+		return err
+	}
+	return os.Rename(tmp.Name(), m.snapshot)
+}
+
+// load reads the snapshot file. A missing file is an empty store. Snapshots
+// written before the schema version and the revisions were saved hold
+// transcriptions only.
+func (m *MemoryDb) load() error {
+	f, err := os.Open(m.snapshot)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// A single document can be as large as a full transcription result.
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON(line, true, &doc); err != nil {
+			return fmt.Errorf("reading snapshot %v: %w", m.snapshot, err)
+		}
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		if v, ok := bson.Raw(raw).Lookup(snapshotSchemaVersion).AsInt64OK(); ok {
+			m.schemaVersion = int(v)
+			continue
+		}
+		if r, ok := bson.Raw(raw).Lookup(snapshotRevision).DocumentOK(); ok {
+			m.revisions = append(m.revisions, r)
+			continue
+		}
+		id, ok := bson.Raw(raw).Lookup("_id").ObjectIDOK()
+		if !ok {
+			return fmt.Errorf("reading snapshot %v: document without an ObjectID", m.snapshot)
+		}
+		if _, dup := m.docs[id]; !dup {
+			m.order = append(m.order, id)
+		}
+		m.docs[id] = raw
+	}
+	return scanner.Err()
+}
+
+func decodeTranscription(raw bson.Raw) (*models.Transcription, error) {
+	var t models.Transcription
+	if err := bson.Unmarshal(raw, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,174 @@
+package database
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+func TestMemorySnapshotRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "db.jsonl")
+	db, err := NewMemoryDb(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := db.NewTranscription(ctx, &models.Transcription{FileName: "a.mp3", Result: models.WhisperResult{Text: "hello"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev := models.RevisionOf(tr)
+	rev.Summary = "Edited 1 segment"
+	if _, err := db.AddRevision(ctx, &rev); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetSchemaVersion(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := NewMemoryDb(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := loaded.GetTranscription(ctx, tr.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FileName != "a.mp3" || got.Result.Text != "hello" {
+		t.Errorf("loaded transcription %+v, want the saved one", got)
+	}
+	if v, _ := loaded.SchemaVersion(ctx); v != 5 {
+		t.Errorf("loaded schema version %v, want 5", v)
+	}
+	r, err := loaded.GetRevision(ctx, tr.ID.Hex(), rev.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Summary != rev.Summary || r.Result.Text != "hello" {
+		t.Errorf("loaded revision %+v, want the saved one", r)
+	}
+}
+
+// Snapshots written before the schema version and the revisions were saved
+// hold one transcription per line.
+func TestMemoryLoadTranscriptionsOnlySnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.jsonl")
+	line := `{"_id":{"$oid":"650000000000000000000001"},"status":{"$numberInt":"2"},"fileName":"a.mp3"}` + "\n"
+	if err := os.WriteFile(path, []byte(line), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewMemoryDb(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.GetTranscription(context.Background(), "650000000000000000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FileName != "a.mp3" {
+		t.Errorf("loaded file name %q, want a.mp3", got.FileName)
+	}
+	if v, _ := db.SchemaVersion(context.Background()); v != 0 {
+		t.Errorf("schema version %v, want 0", v)
+	}
+}
+
+// A change that can't be saved isn't made in memory either.
+func TestMemoryFailedPersist(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	db, err := NewMemoryDb(filepath.Join(dir, "db.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := db.NewTranscription(ctx, &models.Transcription{FileName: "a.mp3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.snapshot = filepath.Join(dir, "missing", "db.jsonl")
+	if _, err := db.NewTranscription(ctx, &models.Transcription{FileName: "b.mp3"}); err == nil {
+		t.Fatal("created a transcription without saving it")
+	}
+	if _, err := db.RenameFile(ctx, tr.ID.Hex(), "c.mp3"); err == nil {
+		t.Fatal("renamed a transcription without saving it")
+	}
+	if err := db.SetSchemaVersion(ctx, 3); err == nil {
+		t.Fatal("set the schema version without saving it")
+	}
+	all, err := db.GetAllTranscriptions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].FileName != "a.mp3" {
+		t.Errorf("store has %+v, want the saved transcription only", all)
+	}
+	if v, _ := db.SchemaVersion(ctx); v != 0 {
+		t.Errorf("schema version %v, want 0", v)
+	}
+}
+
+// Progress updates are saved together later, or with the next write.
+func TestMemoryProgressFlush(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "db.jsonl")
+	db, err := NewMemoryDb(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := db.NewTranscription(ctx, &models.Transcription{FileName: "a.mp3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := tr.ID.Hex()
+	saved := func() *models.Transcription {
+		loaded, err := NewMemoryDb(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := loaded.GetTranscription(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	for _, progress := range []float64{0.1, 0.2, 0.3} {
+		if _, err := db.SetProgress(ctx, id, progress, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, _ := db.GetTranscription(ctx, id); got.Progress != 0.3 {
+		t.Errorf("progress %v in memory, want 0.3", got.Progress)
+	}
+	if got := saved(); got.Progress != 0 {
+		t.Errorf("progress %v saved before the flush, want 0", got.Progress)
+	}
+	db.mu.Lock()
+	db.flush.Stop()
+	db.mu.Unlock()
+	db.flushLater()
+	if got := saved(); got.Progress != 0.3 {
+		t.Errorf("progress %v saved by the flush, want 0.3", got.Progress)
+	}
+
+	if _, err := db.SetProgress(ctx, id, 0.5, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.RenameFile(ctx, id, "b.mp3"); err != nil {
+		t.Fatal(err)
+	}
+	if got := saved(); got.Progress != 0.5 || got.FileName != "b.mp3" {
+		t.Errorf("saved progress %v and file name %q, want the progress saved with the rename", got.Progress, got.FileName)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.dirty {
+		t.Error("the rename left the progress waiting for a flush")
+	}
+	db.flush.Stop()
+}
@@ -5,6 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -46,54 +49,92 @@ func NewMongoDb() *MongoDb {
 	}
 }
 
-func (m *MongoDb) GetTranscription(id string) *models.Transcription {
-	collection := m.client.Database("whishper").Collection("transcriptions")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+func (m *MongoDb) transcriptions() *mongo.Collection {
+	return m.client.Database("whishper").Collection("transcriptions")
+}
 
-	oid, err := primitive.ObjectIDFromHex(id)
+// meta holds the documents describing the database itself, like the schema
+// version.
+func (m *MongoDb) meta() *mongo.Collection {
+	return m.client.Database("whishper").Collection("meta")
+}
+
+func (m *MongoDb) GetTranscription(ctx context.Context, id string) (*models.Transcription, error) {
+	oid, err := objectID(id)
 	if err != nil {
-		log.Printf("Error converting id to object id: %v", err)
-		return nil
+		return nil, err
 	}
 	filter := bson.D{primitive.E{Key: "_id", Value: oid}}
 	var result models.Transcription
-	err = collection.FindOne(ctx, filter).Decode(&result)
+	err = m.transcriptions().FindOne(ctx, filter).Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		log.Printf("Error getting transcription: %v", err)
-		return nil
+		return nil, err
+	}
+	if err := m.hydrate(ctx, &result); err != nil {
+		return nil, err
 	}
-	return &result
+	return &result, nil
 }
 
-func (m *MongoDb) DeleteTranscription(id string) error {
-	collection := m.client.Database("whishper").Collection("transcriptions")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+func (m *MongoDb) DeleteTranscription(ctx context.Context, id string) error {
+	_, err := m.delete(ctx, id, nil)
+	return err
+}
 
-	oid, err := primitive.ObjectIDFromHex(id)
+func (m *MongoDb) PurgeTranscription(ctx context.Context, id string, trashedBefore time.Time) (*models.Transcription, error) {
+	t, err := m.delete(ctx, id, mongoListFilter(&ListOptions{Trashed: true, TrashedBefore: trashedBefore}))
+	if errors.Is(err, ErrNotFound) {
+		// Tell a transcription gone from one trashed again or restored.
+		if _, err := m.GetTranscription(ctx, id); err != nil {
+			return nil, err
+		}
+		return nil, ErrConflict
+	}
+	return t, err
+}
+
+// delete deletes the transcription id, if it matches filter, along with its
+// segments and revisions. It returns the stored document, whose segments
+// are gone.
+func (m *MongoDb) delete(ctx context.Context, id string, filter bson.D) (*models.Transcription, error) {
+	oid, err := objectID(id)
 	if err != nil {
-		log.Debug().Msg("Error converting id to object id.")
-		return err
+		return nil, err
 	}
 
-	filter := bson.D{primitive.E{Key: "_id", Value: oid}}
-	_, err = collection.DeleteOne(ctx, filter)
+	filter = append(bson.D{primitive.E{Key: "_id", Value: oid}}, filter...)
+	var stored models.Transcription
+	err = m.transcriptions().FindOneAndDelete(ctx, filter).Decode(&stored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		log.Debug().Msg("Error deleting transcription")
-		return err
+		return nil, err
 	}
-	return nil
+	m.dropSegments(ctx, segmentSets(&stored)...)
+	if err := m.deleteRevisions(ctx, oid); err != nil {
+		log.Warn().Err(err).Msgf("Error deleting the revisions of transcription %v", id)
+	}
+	return &stored, nil
 }
 
-func (m *MongoDb) NewTranscription(t *models.Transcription) (*models.Transcription, error) {
-	collection := m.client.Database("whishper").Collection("transcriptions")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+func (m *MongoDb) NewTranscription(ctx context.Context, t *models.Transcription) (*models.Transcription, error) {
+	prepareNew(t)
+	doc, created, err := m.externalize(ctx, t, nil, nil)
+	if err != nil {
+		log.Printf("Error creating new transcription: %v", err)
+		return nil, err
+	}
 	// Create a new mongodb object id
-	i, err := collection.InsertOne(ctx, t)
+	i, err := m.transcriptions().InsertOne(ctx, doc)
 	if err != nil {
 		log.Printf("Error creating new transcription: %v", err)
+		m.dropSegments(ctx, created...)
 		return nil, err
 	}
 	// Set the id of the transcription to the mongodb object id
@@ -101,105 +142,754 @@ func (m *MongoDb) NewTranscription(t *models.Transcription) (*models.Transcripti
 	return t, nil
 }
 
-func (s *MongoDb) GetAllTranscriptions() []*models.Transcription {
-	collection := s.client.Database("whishper").Collection("transcriptions")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+func (m *MongoDb) GetAllTranscriptions(ctx context.Context) ([]*models.Transcription, error) {
+	return m.findFull(ctx, bson.D{})
+}
 
-	cursor, err := collection.Find(ctx, bson.D{})
+func (m *MongoDb) GetPendingTranscriptions(ctx context.Context) ([]*models.Transcription, error) {
+	return m.findFull(ctx, bson.D{primitive.E{Key: "status", Value: models.TranscriptionStatusPending}, notTrashed},
+		options.Find().SetSort(queueSort))
+}
+
+func (m *MongoDb) GetRunningTranscription(ctx context.Context) ([]*models.Transcription, error) {
+	return m.findFull(ctx, bson.D{primitive.E{Key: "status", Value: models.TranscriptionStatusRunning}})
+}
+
+func (m *MongoDb) UpdateTranscription(ctx context.Context, t *models.Transcription) (*models.Transcription, error) {
+	raw, err := m.storedTranscription(ctx, t.ID)
 	if err != nil {
-		log.Printf("Error getting transcriptions: %v", err)
-		return nil
+		return nil, err
+	}
+	var stored, current models.Transcription
+	if err := bson.Unmarshal(raw, &stored); err != nil {
+		return nil, err
+	}
+	if err := bson.Unmarshal(raw, &current); err != nil {
+		return nil, err
+	}
+	if err := m.hydrate(ctx, &current); err != nil {
+		return nil, err
+	}
+	currentRaw, err := bson.Marshal(&current)
+	if err != nil {
+		return nil, err
+	}
+	// Checks the version and whether anything changes, and bumps t.Version.
+	expected := t.Version
+	if _, err := replaceUpdate(currentRaw, t); err != nil {
+		return nil, err
+	}
+	doc, created, err := m.externalize(ctx, t, &stored, &current)
+	if err != nil {
+		t.Version = expected
+		return nil, err
 	}
-	defer cursor.Close(ctx)
 
-	var transcriptions []*models.Transcription
-	for cursor.Next(ctx) {
-		var result models.Transcription
-		err := cursor.Decode(&result)
-		if err != nil {
-			log.Printf("Error decoding transcription: %v", err)
-			return nil
+	// The version in the filter makes the write fail if someone else wrote
+	// the document since it was read above.
+	filter := bson.D{primitive.E{Key: "_id", Value: t.ID}, versionFilter(expected)}
+	updateQuery := bson.D{primitive.E{Key: "$set", Value: doc}}
+	updateResult, err := m.transcriptions().UpdateOne(ctx, filter, updateQuery)
+	if err == nil && updateResult.MatchedCount == 0 {
+		err = ErrConflict
+	}
+	if err != nil {
+		t.Version = expected
+		m.dropSegments(ctx, created...)
+		return nil, err
+	}
+	m.dropSegments(ctx, unusedSets(segmentSets(&stored), segmentSets(doc))...)
+
+	return t, nil
+}
+
+func (m *MongoDb) ListTranscriptions(ctx context.Context, opts ListOptions) (*ListPage, error) {
+	cur, err := opts.cursor()
+	if err != nil {
+		return nil, err
+	}
+
+	filter := mongoListFilter(&opts)
+	total, err := m.transcriptions().CountDocuments(ctx, filter)
+	if err != nil {
+		log.Printf("Error counting transcriptions: %v", err)
+		return nil, err
+	}
+
+	field := map[string]string{
+		SortByCreated:  "_id",
+		SortByFileName: "fileName",
+		SortByStatus:   "status",
+		SortByLanguage: "language",
+		SortByDuration: "result.duration",
+	}[opts.sortBy()]
+	op, dir := "$gt", 1
+	if opts.Desc {
+		op, dir = "$lt", -1
+	}
+	sort := bson.D{primitive.E{Key: "_id", Value: dir}}
+	if field != "_id" {
+		sort = append(bson.D{primitive.E{Key: field, Value: dir}}, sort...)
+	}
+	if cur != nil {
+		after := bson.D{primitive.E{Key: "_id", Value: bson.D{primitive.E{Key: op, Value: cur.id}}}}
+		if field != "_id" {
+			after = bson.D{primitive.E{Key: "$or", Value: bson.A{
+				bson.D{primitive.E{Key: field, Value: bson.D{primitive.E{Key: op, Value: cur.value}}}},
+				bson.D{primitive.E{Key: field, Value: cur.value}, primitive.E{Key: "_id", Value: bson.D{primitive.E{Key: op, Value: cur.id}}}},
+			}}}
 		}
-		transcriptions = append(transcriptions, &result)
+		filter = append(filter, primitive.E{Key: "$and", Value: bson.A{after}})
 	}
-	if err := cursor.Err(); err != nil {
-		log.Printf("Error getting transcriptions: %v", err)
-		return nil
+
+	findOpts := options.Find().
+		SetSort(sort).
+		SetProjection(bson.D{
+			primitive.E{Key: "result.segments", Value: 0},
+			primitive.E{Key: "translations.result", Value: 0},
+		})
+	if opts.Limit > 0 {
+		findOpts.SetLimit(int64(opts.Limit) + 1)
+	}
+	items, err := m.find(ctx, filter, findOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &ListPage{Total: total}
+	if opts.Limit > 0 && len(items) > opts.Limit {
+		items = items[:opts.Limit]
+		page.NextCursor = encodeCursor(&opts, items[len(items)-1])
 	}
-	return transcriptions
+	page.Items = items
+	return page, nil
 }
 
-func (s *MongoDb) GetPendingTranscriptions() []*models.Transcription {
-	collection := s.client.Database("whishper").Collection("transcriptions")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// searchFields are the fields covered by the text index used for searches.
+var searchFields = []string{
+	"result.text",
+	"translations.result.text",
+}
 
-	filter := bson.D{primitive.E{Key: "status", Value: models.TranscriptionStatusPending}}
-	cursor, err := collection.Find(ctx, filter)
+func (m *MongoDb) SearchTranscriptions(ctx context.Context, opts SearchOptions) ([]SearchHit, error) {
+	terms := SearchTerms(opts.Query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	// The index only narrows down the candidates; the matches themselves
+	// are found by searchTranscription, like for every other backend. Every
+	// term is a phrase, which the index matches as whole words.
+	phrases := make([]string, len(terms))
+	for i, term := range terms {
+		phrases[i] = `"` + strings.ReplaceAll(term, `"`, "") + `"`
+	}
+	filter := bson.D{primitive.E{Key: "$text", Value: bson.D{primitive.E{Key: "$search", Value: strings.Join(phrases, " ")}}}}
+	candidates, err := m.findFull(ctx, append(filter, notTrashed))
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		// The text index is missing, e.g. on FerretDB or if its creation
+		// failed on startup: scan the texts instead. It is tried again on
+		// the next search.
+		log.Debug().Err(err).Msg("Searching without the text index")
+		all := bson.A{}
+		for _, term := range terms {
+			anyField := bson.A{}
+			for _, field := range searchFields {
+				anyField = append(anyField, bson.D{primitive.E{Key: field, Value: primitive.Regex{Pattern: regexp.QuoteMeta(term), Options: "i"}}})
+			}
+			all = append(all, bson.D{primitive.E{Key: "$or", Value: anyField}})
+		}
+		candidates, err = m.findFull(ctx, bson.D{primitive.E{Key: "$and", Value: all}, notTrashed})
+	}
 	if err != nil {
-		log.Printf("Error getting transcriptions: %v", err)
-		return nil
+		return nil, err
+	}
+	var hits []SearchHit
+	for _, t := range candidates {
+		if hit := searchTranscription(t, terms); hit != nil {
+			hits = append(hits, *hit)
+		}
 	}
+	return rankHits(hits, opts.Limit), nil
+}
 
-	defer cursor.Close(ctx)
-	var transcriptions []*models.Transcription
-	for cursor.Next(ctx) {
-		var result models.Transcription
-		err := cursor.Decode(&result)
+func (m *MongoDb) ClaimNextPending(ctx context.Context, req ClaimRequest) (*models.Transcription, error) {
+	filter := bson.D{primitive.E{Key: "status", Value: models.TranscriptionStatusPending}, notTrashed}
+	if len(req.SkipDevices) > 0 {
+		filter = append(filter, primitive.E{Key: "device", Value: bson.D{primitive.E{Key: "$nin", Value: req.SkipDevices}}})
+	}
+	if len(req.SkipModelSizes) > 0 {
+		filter = append(filter, primitive.E{Key: "modelSize", Value: bson.D{primitive.E{Key: "$nin", Value: req.SkipModelSizes}}})
+	}
+	update := claimUpdate(req, time.Now()).mongo()
+	opts := options.FindOneAndUpdate().
+		SetSort(queueSort).
+		SetReturnDocument(options.After)
+
+	var result models.Transcription
+	err := m.transcriptions().FindOneAndUpdate(ctx, filter, update, opts).Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		log.Printf("Error claiming pending transcription: %v", err)
+		return nil, err
+	}
+	if err := m.hydrate(ctx, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (m *MongoDb) ReleaseScheduled(ctx context.Context, now time.Time) ([]*models.Transcription, error) {
+	scheduled := primitive.E{Key: "status", Value: models.TranscriptionStatusScheduled}
+	candidates, err := m.find(ctx, bson.D{scheduled, notTrashed, primitive.E{Key: "$or", Value: bson.A{
+		bson.D{primitive.E{Key: "not_before", Value: bson.D{primitive.E{Key: "$lte", Value: now}}}},
+		bson.D{primitive.E{Key: "not_before", Value: bson.D{primitive.E{Key: "$exists", Value: false}}}},
+	}}})
+	if err != nil {
+		return nil, err
+	}
+	var released []*models.Transcription
+	for _, t := range candidates {
+		// Only the instance that still finds it scheduled releases it.
+		ut, err := m.findAndUpdate(ctx, t.ID.Hex(), bson.D{scheduled}, releaseUpdate().mongo())
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
 		if err != nil {
-			log.Printf("Error decoding transcription: %v", err)
-			return nil
+			return released, err
 		}
-		transcriptions = append(transcriptions, &result)
+		released = append(released, ut)
+	}
+	return released, nil
+}
+
+func (m *MongoDb) SchemaVersion(ctx context.Context) (int, error) {
+	var doc struct {
+		Version int `bson:"version"`
+	}
+	err := m.meta().FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: "schema"}}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
 	}
+	return doc.Version, err
+}
 
-	return transcriptions
+func (m *MongoDb) SetSchemaVersion(ctx context.Context, version int) error {
+	_, err := m.meta().UpdateOne(ctx,
+		bson.D{primitive.E{Key: "_id", Value: "schema"}},
+		bson.D{primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "version", Value: version}}}},
+		options.Update().SetUpsert(true))
+	return err
 }
 
-func (s *MongoDb) GetRunningTranscription() []*models.Transcription {
-	collection := s.client.Database("whishper").Collection("transcriptions")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// mongoIndexes are the indexes the MongoDb queries rely on.
+var mongoIndexes = []Index{
+	// Claims look up the first transcription of the queue. Status filters
+	// use the prefix of the index.
+	{Collection: "transcriptions", Name: "queue", Keys: []string{"status", "-priority", "_id"}},
+	// Listings filter and sort by these, with the id to break ties.
+	{Collection: "transcriptions", Name: "fileName", Keys: []string{"fileName", "_id"}},
+	{Collection: "transcriptions", Name: "language", Keys: []string{"language", "_id"}},
+	{Collection: "transcriptions", Name: "sourceUrl", Keys: []string{"sourceUrl", "_id"}},
+	// The purger looks up what has been in the trash for long.
+	{Collection: "transcriptions", Name: "trash", Keys: []string{"deleted_at"}, Sparse: true},
+	// Segments are read by set, in order.
+	{Collection: "segments", Name: "set", Keys: []string{"set_id", "index"}, Unique: true},
+	{Collection: "revisions", Name: "transcription", Keys: []string{"transcription_id", "-_id"}},
+	// Searches look up the words of the texts.
+	{Collection: "transcriptions", Name: "search", Keys: searchFields, Text: true},
+}
+
+func (m *MongoDb) EnsureIndexes(ctx context.Context) error {
+	for _, ix := range mongoIndexes {
+		keys := bson.D{}
+		for _, key := range ix.Keys {
+			field, desc := indexKey(key)
+			var kind interface{} = 1
+			if ix.Text {
+				kind = "text"
+			} else if desc {
+				kind = -1
+			}
+			keys = append(keys, primitive.E{Key: field, Value: kind})
+		}
+		opts := options.Index().SetName(ix.Name)
+		if ix.Unique {
+			opts.SetUnique(true)
+		}
+		if ix.Sparse {
+			opts.SetSparse(true)
+		}
+		if ix.Text {
+			// No stemming nor stop words: transcripts come in many
+			// languages.
+			opts.SetDefaultLanguage("none")
+		}
+		_, err := m.client.Database("whishper").Collection(ix.Collection).Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys, Options: opts})
+		if err != nil && ix.Text {
+			// Some servers, like FerretDB, have no text indexes. Searches
+			// scan the texts without it.
+			log.Warn().Err(err).Msgf("Could not create the text index %v.%v, searches will scan the collection", ix.Collection, ix.Name)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("creating index %v.%v: %w", ix.Collection, ix.Name, err)
+		}
+	}
+	return nil
+}
 
-	filter := bson.D{primitive.E{Key: "status", Value: models.TranscriptionStatusRunning}}
-	cursor, err := collection.Find(ctx, filter)
+func (m *MongoDb) IndexStatus(ctx context.Context) ([]IndexStatus, error) {
+	var existing []IndexStatus
+	for _, collection := range []string{"transcriptions", "segments", "revisions"} {
+		cursor, err := m.client.Database("whishper").Collection(collection).Indexes().List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var specs []struct {
+			Name   string `bson:"name"`
+			Key    bson.D `bson:"key"`
+			Unique bool   `bson:"unique"`
+			// Weights lists the fields of text indexes, whose key only
+			// holds internal ones.
+			Weights bson.M `bson:"weights"`
+		}
+		if err := cursor.All(ctx, &specs); err != nil {
+			return nil, err
+		}
+		for _, spec := range specs {
+			if spec.Name == "_id_" {
+				continue
+			}
+			ix := IndexStatus{Collection: collection, Name: spec.Name, Unique: spec.Unique}
+			for _, key := range spec.Key {
+				ix.Keys = append(ix.Keys, mongoIndexKey(key))
+			}
+			if spec.Weights != nil {
+				ix.Keys = nil
+				for field := range spec.Weights {
+					ix.Keys = append(ix.Keys, field)
+				}
+				sort.Strings(ix.Keys)
+			}
+			existing = append(existing, ix)
+		}
+	}
+	return indexStatus(mongoIndexes, existing), nil
+}
+
+// mongoIndexKey formats a key of an index specification like Index.Keys.
+func mongoIndexKey(key primitive.E) string {
+	switch v := key.Value.(type) {
+	case int32:
+		if v < 0 {
+			return "-" + key.Key
+		}
+	case int64:
+		if v < 0 {
+			return "-" + key.Key
+		}
+	case float64:
+		if v < 0 {
+			return "-" + key.Key
+		}
+	default:
+		// Text, hashed and geo indexes.
+		return fmt.Sprintf("%v:%v", key.Key, v)
+	}
+	return key.Key
+}
+
+func (m *MongoDb) RenewLease(ctx context.Context, id string, workerID string, until time.Time) error {
+	oid, err := objectID(id)
+	if err != nil {
+		return err
+	}
+	res, err := m.transcriptions().UpdateOne(ctx, leaseFilter(oid, workerID), renewUpdate(until).mongo())
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (m *MongoDb) FinishJob(ctx context.Context, id string, workerID string, outcome JobOutcome) (*models.Transcription, error) {
+	oid, err := objectID(id)
+	if err != nil {
+		return nil, err
+	}
+	done := outcome.Error == nil
+	if done {
+		if err := m.storeSegments(ctx, &outcome.Result); err != nil {
+			return nil, err
+		}
+	}
+	// The previous document tells which set the new result replaces.
+	var before models.Transcription
+	err = m.transcriptions().FindOneAndUpdate(ctx, leaseFilter(oid, workerID), finishUpdate(outcome).mongo(),
+		options.FindOneAndUpdate().SetProjection(bson.D{primitive.E{Key: "result.segments_id", Value: 1}})).Decode(&before)
+	if err != nil {
+		if done {
+			m.dropSegments(ctx, outcome.Result.SegmentsID)
+		}
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrLeaseLost
+		}
+		log.Printf("Error updating transcription %v: %v", id, err)
+		return nil, err
+	}
+	if done && !before.Result.SegmentsID.IsZero() {
+		m.dropSegments(ctx, before.Result.SegmentsID)
+	}
+	return m.GetTranscription(ctx, id)
+}
+
+// leaseFilter matches the transcription id while it runs under the lease of
+// workerID.
+func leaseFilter(id primitive.ObjectID, workerID string) bson.D {
+	return bson.D{
+		primitive.E{Key: "_id", Value: id},
+		primitive.E{Key: "status", Value: models.TranscriptionStatusRunning},
+		primitive.E{Key: "lease_owner", Value: workerID},
+	}
+}
+
+func (m *MongoDb) SetProgress(ctx context.Context, id string, progress float64, downloadingModel bool) (*models.Transcription, error) {
+	return m.findAndUpdate(ctx, id, nil, progressUpdate(progress, downloadingModel).mongo())
+}
+
+func (m *MongoDb) SetStatus(ctx context.Context, id string, status int) (*models.Transcription, error) {
+	return m.findAndUpdate(ctx, id, nil, statusUpdate(status).mongo())
+}
+
+func (m *MongoDb) SetError(ctx context.Context, id string, jobErr *models.JobError) (*models.Transcription, error) {
+	return m.findAndUpdate(ctx, id, nil, errorUpdate(jobErr).mongo())
+}
+
+func (m *MongoDb) SetPriority(ctx context.Context, id string, priority int) (*models.Transcription, error) {
+	queued := bson.D{primitive.E{Key: "status", Value: models.TranscriptionStatusPending}, notTrashed}
+	t, err := m.findAndUpdate(ctx, id, queued, priorityUpdate(priority).mongo())
+	if errors.Is(err, ErrNotFound) {
+		// Tell a missing transcription from one that left the queue.
+		if _, err := m.GetTranscription(ctx, id); err != nil {
+			return nil, err
+		}
+		return nil, ErrConflict
+	}
+	return t, err
+}
+
+func (m *MongoDb) SetResult(ctx context.Context, id string, result models.WhisperResult) (*models.Transcription, error) {
+	oid, err := objectID(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.storeSegments(ctx, &result); err != nil {
+		return nil, err
+	}
+	// The previous document tells which set the new one replaces.
+	var before models.Transcription
+	err = m.transcriptions().FindOneAndUpdate(ctx, bson.D{primitive.E{Key: "_id", Value: oid}}, resultUpdate(result).mongo(),
+		options.FindOneAndUpdate().SetProjection(bson.D{primitive.E{Key: "result.segments_id", Value: 1}})).Decode(&before)
+	if err != nil {
+		m.dropSegments(ctx, result.SegmentsID)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+		log.Printf("Error updating transcription %v: %v", id, err)
+		return nil, err
+	}
+	if !before.Result.SegmentsID.IsZero() {
+		m.dropSegments(ctx, before.Result.SegmentsID)
+	}
+	return m.GetTranscription(ctx, id)
+}
+
+func (m *MongoDb) AppendTranslation(ctx context.Context, id string, translation models.Translation) (*models.Transcription, error) {
+	oid, err := objectID(id)
+	if err != nil {
+		return nil, err
+	}
+	// $push fails on a null array, which is what an empty slice was stored as.
+	_, err = m.transcriptions().UpdateOne(ctx,
+		bson.D{primitive.E{Key: "_id", Value: oid}, primitive.E{Key: "translations", Value: nil}},
+		bson.D{primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "translations", Value: bson.A{}}}}})
+	if err != nil {
+		return nil, err
+	}
+	if err := m.storeSegments(ctx, &translation.Result); err != nil {
+		return nil, err
+	}
+	t, err := m.findAndUpdate(ctx, id, nil, bson.D{
+		primitive.E{Key: "$push", Value: bson.D{primitive.E{Key: "translations", Value: translation}}},
+		primitive.E{Key: "$inc", Value: bson.D{primitive.E{Key: "version", Value: 1}}},
+		primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "updated_at", Value: writeTime()}}},
+	})
+	if err != nil {
+		m.dropSegments(ctx, translation.Result.SegmentsID)
+	}
+	return t, err
+}
+
+func (m *MongoDb) RecoverTranscription(ctx context.Context, id string, version int64, status int, jobErr *models.JobError) (*models.Transcription, error) {
+	filter := bson.D{primitive.E{Key: "status", Value: models.TranscriptionStatusRunning}, versionFilter(version)}
+	t, err := m.findAndUpdate(ctx, id, filter, recoverUpdate(status, jobErr).mongo())
+	if errors.Is(err, ErrNotFound) {
+		// Tell a missing transcription from one that moved on.
+		if _, err := m.GetTranscription(ctx, id); err != nil {
+			return nil, err
+		}
+		return nil, ErrConflict
+	}
+	return t, err
+}
+
+func (m *MongoDb) CancelTranscription(ctx context.Context, id string) (*models.Transcription, error) {
+	queued := bson.D{primitive.E{Key: "status", Value: bson.D{primitive.E{Key: "$in", Value: bson.A{
+		models.TranscriptionStatusPending, models.TranscriptionStatusRunning, models.TranscriptionStatusScheduled,
+	}}}}}
+	t, err := m.findAndUpdate(ctx, id, queued, cancelUpdate().mongo())
+	if errors.Is(err, ErrNotFound) {
+		// Tell a missing transcription from one that isn't queued.
+		if _, err := m.GetTranscription(ctx, id); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotModified
+	}
+	return t, err
+}
+
+func (m *MongoDb) Retranscribe(ctx context.Context, t *models.Transcription) (*models.Transcription, error) {
+	filter := bson.D{
+		primitive.E{Key: "_id", Value: t.ID},
+		primitive.E{Key: "status", Value: bson.D{primitive.E{Key: "$in", Value: bson.A{
+			models.TranscriptionStatusDone, models.TranscriptionStatusError, models.TranscriptionStatusCancelled,
+		}}}},
+		versionFilter(t.Version),
+	}
+	// The previous document tells which segment sets were dropped.
+	var before models.Transcription
+	err := m.transcriptions().FindOneAndUpdate(ctx, filter, retranscribeUpdate(t).mongo(),
+		options.FindOneAndUpdate().SetProjection(bson.D{
+			primitive.E{Key: "result.segments_id", Value: 1},
+			primitive.E{Key: "translations.result.segments_id", Value: 1},
+		})).Decode(&before)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// Tell a missing transcription from one that moved on.
+		if _, err := m.GetTranscription(ctx, t.ID.Hex()); err != nil {
+			return nil, err
+		}
+		return nil, ErrConflict
+	}
+	if err != nil {
+		log.Printf("Error updating transcription %v: %v", t.ID.Hex(), err)
+		return nil, err
+	}
+	m.dropSegments(ctx, segmentSets(&before)...)
+	return m.GetTranscription(ctx, t.ID.Hex())
+}
+
+func (m *MongoDb) TrashTranscription(ctx context.Context, id string) (*models.Transcription, error) {
+	t, err := m.findAndUpdate(ctx, id, bson.D{notTrashed}, trashUpdate(writeTime()).mongo())
+	if errors.Is(err, ErrNotFound) {
+		return nil, m.trashState(ctx, id, true)
+	}
+	return t, err
+}
+
+func (m *MongoDb) RestoreTranscription(ctx context.Context, id string) (*models.Transcription, error) {
+	trashed := bson.D{primitive.E{Key: "deleted_at", Value: bson.D{primitive.E{Key: "$exists", Value: true}}}}
+	t, err := m.findAndUpdate(ctx, id, trashed, restoreUpdate().mongo())
+	if errors.Is(err, ErrNotFound) {
+		return nil, m.trashState(ctx, id, false)
+	}
+	return t, err
+}
+
+// trashState explains why moving the transcription id in or out of the
+// trash matched nothing: it returns ErrNotModified if it is where it had to
+// go already, and ErrNotFound if it doesn't exist.
+func (m *MongoDb) trashState(ctx context.Context, id string, trashed bool) error {
+	t, err := m.GetTranscription(ctx, id)
+	if err != nil {
+		return err
+	}
+	if (t.DeletedAt != nil) == trashed {
+		return ErrNotModified
+	}
+	// Moved the other way in between.
+	return ErrConflict
+}
+
+func (m *MongoDb) RenameFile(ctx context.Context, id string, fileName string) (*models.Transcription, error) {
+	return m.findAndUpdate(ctx, id, nil, fileNameUpdate(fileName).mongo())
+}
+
+func (m *MongoDb) PatchSegment(ctx context.Context, id string, segment models.Segment) (*models.Transcription, error) {
+	oid, err := objectID(id)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := m.storedTranscription(ctx, oid)
+	if err != nil {
+		return nil, err
+	}
+	if setID, ok := raw.Lookup("result", "segments_id").ObjectIDOK(); ok {
+		if err := m.patchSetSegment(ctx, setID, segment); err != nil {
+			return nil, err
+		}
+		// The result text is searched, so it follows the edited segments.
+		edited := models.WhisperResult{SegmentsID: setID}
+		if err := m.hydrateResults(ctx, &edited); err != nil {
+			return nil, err
+		}
+		t, err := m.findAndUpdate(ctx, id,
+			bson.D{primitive.E{Key: "result.segments_id", Value: setID}},
+			textUpdate(edited.SegmentsText()).mongo())
+		if errors.Is(err, ErrNotFound) {
+			// The result was replaced while the segment was written.
+			return nil, ErrConflict
+		}
+		return t, err
+	}
+
+	// The segments are still inside the document, so the whole result is
+	// rewritten if it wasn't changed since it was read.
+	current, err := decodeTranscription(raw)
+	if err != nil {
+		return nil, err
+	}
+	u, err := segmentPatch(current, segment)
+	if err != nil {
+		return nil, err
+	}
+	t, err := m.findAndUpdate(ctx, id, bson.D{versionFilter(current.Version)}, u.mongo())
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrConflict
+	}
+	return t, err
+}
+
+// findAndUpdate applies update to the transcription id, if it also matches
+// filter, and returns the updated document.
+func (m *MongoDb) findAndUpdate(ctx context.Context, id string, filter bson.D, update bson.D) (*models.Transcription, error) {
+	oid, err := objectID(id)
+	if err != nil {
+		return nil, err
+	}
+	filter = append(bson.D{primitive.E{Key: "_id", Value: oid}}, filter...)
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var result models.Transcription
+	err = m.transcriptions().FindOneAndUpdate(ctx, filter, update, opts).Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		log.Printf("Error updating transcription %v: %v", id, err)
+		return nil, err
+	}
+	if err := m.hydrate(ctx, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// queueSort is the order pending jobs are claimed in.
+var queueSort = bson.D{primitive.E{Key: "priority", Value: -1}, primitive.E{Key: "_id", Value: 1}}
+
+// notTrashed matches the transcriptions that aren't in the trash.
+var notTrashed = primitive.E{Key: "deleted_at", Value: bson.D{primitive.E{Key: "$exists", Value: false}}}
+
+// mongoListFilter translates the filters of opts into a query document.
+func mongoListFilter(opts *ListOptions) bson.D {
+	filter := bson.D{notTrashed}
+	if opts.Trashed {
+		trashed := bson.D{primitive.E{Key: "$exists", Value: true}}
+		if !opts.TrashedBefore.IsZero() {
+			trashed = append(trashed, primitive.E{Key: "$lt", Value: opts.TrashedBefore})
+		}
+		filter = bson.D{primitive.E{Key: "deleted_at", Value: trashed}}
+	}
+	if len(opts.Status) > 0 {
+		filter = append(filter, primitive.E{Key: "status", Value: bson.D{primitive.E{Key: "$in", Value: opts.Status}}})
+	}
+	if opts.Language != "" {
+		filter = append(filter, primitive.E{Key: "language", Value: opts.Language})
+	}
+	if opts.ModelSize != "" {
+		filter = append(filter, primitive.E{Key: "modelSize", Value: opts.ModelSize})
+	}
+	if opts.Device != "" {
+		filter = append(filter, primitive.E{Key: "device", Value: opts.Device})
+	}
+	switch opts.SourceType {
+	case models.SourceTypeURL:
+		filter = append(filter, primitive.E{Key: "sourceUrl", Value: bson.D{primitive.E{Key: "$ne", Value: ""}}})
+	case models.SourceTypeFile:
+		filter = append(filter, primitive.E{Key: "sourceUrl", Value: ""})
+	}
+	// The creation time is the timestamp embedded in the ObjectID.
+	created := bson.D{}
+	if !opts.From.IsZero() {
+		created = append(created, primitive.E{Key: "$gte", Value: primitive.NewObjectIDFromTimestamp(opts.From)})
+	}
+	if !opts.To.IsZero() {
+		created = append(created, primitive.E{Key: "$lt", Value: primitive.NewObjectIDFromTimestamp(opts.To)})
+	}
+	if len(created) > 0 {
+		filter = append(filter, primitive.E{Key: "_id", Value: created})
+	}
+	return filter
+}
+
+func (m *MongoDb) find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) ([]*models.Transcription, error) {
+	cursor, err := m.transcriptions().Find(ctx, filter, opts...)
 	if err != nil {
 		log.Printf("Error getting transcriptions: %v", err)
-		return nil
+		return nil, err
 	}
 	defer cursor.Close(ctx)
+
 	var transcriptions []*models.Transcription
 	for cursor.Next(ctx) {
 		var result models.Transcription
-		err := cursor.Decode(&result)
-		if err != nil {
+		if err := cursor.Decode(&result); err != nil {
 			log.Printf("Error decoding transcription: %v", err)
-			return nil
+			return nil, err
 		}
 		transcriptions = append(transcriptions, &result)
 	}
-	return transcriptions
+	if err := cursor.Err(); err != nil {
+		log.Printf("Error getting transcriptions: %v", err)
+		return nil, err
+	}
+	return transcriptions, nil
 }
 
-func (m *MongoDb) UpdateTranscription(t *models.Transcription) (*models.Transcription, error) {
-	collection := m.client.Database("whishper").Collection("transcriptions")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	filter := bson.D{primitive.E{Key: "_id", Value: t.ID}}
-	updateQuery := bson.D{primitive.E{Key: "$set", Value: t}}
-	updateResult, err := collection.UpdateOne(ctx, filter, updateQuery)
+// findFull is find with the segments of the results loaded.
+func (m *MongoDb) findFull(ctx context.Context, filter interface{}, opts ...*options.FindOptions) ([]*models.Transcription, error) {
+	transcriptions, err := m.find(ctx, filter, opts...)
 	if err != nil {
 		return nil, err
 	}
-
-	if updateResult.MatchedCount == 0 {
-		return nil, errors.New("no documents matched the filter")
-	}
-	if updateResult.ModifiedCount == 0 {
-		return nil, errors.New("no documents were modified")
+	if err := m.hydrate(ctx, transcriptions...); err != nil {
+		return nil, err
 	}
+	return transcriptions, nil
+}
 
-	return t, nil
+// objectID parses a hex transcription id, wrapping ErrInvalidID on failure.
+func objectID(id string) (primitive.ObjectID, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		log.Debug().Msgf("Error converting id %q to object id", id)
+		return primitive.NilObjectID, fmt.Errorf("%w: %q", ErrInvalidID, id)
+	}
+	return oid, nil
 }
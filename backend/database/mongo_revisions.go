@@ -0,0 +1,142 @@
+package database
+
+import (
+	"context"
+	"errors"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+// Revisions keep their segments in segment sets of their own, like
+// transcriptions, since a revision is as large as the result it saves.
+
+func (m *MongoDb) revisions() *mongo.Collection {
+	return m.client.Database("whishper").Collection("revisions")
+}
+
+func (m *MongoDb) AddRevision(ctx context.Context, r *models.Revision) (*models.Revision, error) {
+	prepareRevision(r)
+	doc := *r
+	doc.Translations = nil
+	if r.Translations != nil {
+		doc.Translations = make([]models.Translation, len(r.Translations))
+		copy(doc.Translations, r.Translations)
+	}
+
+	results := []*models.WhisperResult{&doc.Result}
+	for i := range doc.Translations {
+		results = append(results, &doc.Translations[i].Result)
+	}
+	var created []primitive.ObjectID
+	for _, result := range results {
+		if err := m.storeSegments(ctx, result); err != nil {
+			m.dropSegments(ctx, created...)
+			return nil, err
+		}
+		if !result.SegmentsID.IsZero() {
+			created = append(created, result.SegmentsID)
+		}
+	}
+
+	if _, err := m.revisions().InsertOne(ctx, doc); err != nil {
+		log.Printf("Error saving revision: %v", err)
+		m.dropSegments(ctx, created...)
+		return nil, err
+	}
+	return r, nil
+}
+
+func (m *MongoDb) ListRevisions(ctx context.Context, transcriptionID string) ([]*models.Revision, error) {
+	oid, err := objectID(transcriptionID)
+	if err != nil {
+		return nil, err
+	}
+	opts := options.Find().
+		SetSort(bson.D{primitive.E{Key: "_id", Value: -1}}).
+		SetProjection(bson.D{primitive.E{Key: "result", Value: 0}, primitive.E{Key: "translations", Value: 0}})
+	cursor, err := m.revisions().Find(ctx, bson.D{primitive.E{Key: "transcription_id", Value: oid}}, opts)
+	if err != nil {
+		log.Printf("Error getting revisions: %v", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var revisions []*models.Revision
+	for cursor.Next(ctx) {
+		var r models.Revision
+		if err := cursor.Decode(&r); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revisionListItem(&r))
+	}
+	return revisions, cursor.Err()
+}
+
+func (m *MongoDb) GetRevision(ctx context.Context, transcriptionID string, revisionID string) (*models.Revision, error) {
+	oid, err := objectID(transcriptionID)
+	if err != nil {
+		return nil, err
+	}
+	rid, err := parseRevisionID(revisionID)
+	if err != nil {
+		return nil, err
+	}
+
+	var r models.Revision
+	filter := bson.D{primitive.E{Key: "_id", Value: rid}, primitive.E{Key: "transcription_id", Value: oid}}
+	err = m.revisions().FindOne(ctx, filter).Decode(&r)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrRevisionNotFound
+	}
+	if err != nil {
+		log.Printf("Error getting revision: %v", err)
+		return nil, err
+	}
+	results := []*models.WhisperResult{&r.Result}
+	for i := range r.Translations {
+		results = append(results, &r.Translations[i].Result)
+	}
+	if err := m.hydrateResults(ctx, results...); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// deleteRevisions deletes the revisions of a transcription and their
+// segments.
+func (m *MongoDb) deleteRevisions(ctx context.Context, transcriptionID primitive.ObjectID) error {
+	filter := bson.D{primitive.E{Key: "transcription_id", Value: transcriptionID}}
+	opts := options.Find().SetProjection(bson.D{
+		primitive.E{Key: "result.segments_id", Value: 1},
+		primitive.E{Key: "translations.result.segments_id", Value: 1},
+	})
+	cursor, err := m.revisions().Find(ctx, filter, opts)
+	if err != nil {
+		return err
+	}
+	var sets []primitive.ObjectID
+	for cursor.Next(ctx) {
+		var r models.Revision
+		if err := cursor.Decode(&r); err != nil {
+			cursor.Close(ctx)
+			return err
+		}
+		sets = append(sets, segmentSets(&models.Transcription{Result: r.Result, Translations: r.Translations})...)
+	}
+	cursor.Close(ctx)
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	if _, err := m.revisions().DeleteMany(ctx, filter); err != nil {
+		return err
+	}
+	m.dropSegments(ctx, sets...)
+	return nil
+}
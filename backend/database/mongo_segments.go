@@ -0,0 +1,286 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"reflect"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+// MongoDb keeps the segments of results out of the transcription documents,
+// so that long recordings with word timestamps and several translations stay
+// under the 16MB document limit. A result stores the id of its segment set in
+// result.segments_id, and the set is one document per segment in the
+// segments collection.
+//
+// A new result always gets a new set, and the old one is dropped once the
+// transcription points to the new one, so readers never see a half written
+// result. Only PatchSegment changes a set in place.
+
+// segmentDoc is one segment of a set.
+type segmentDoc struct {
+	SetID   primitive.ObjectID `bson:"set_id"`
+	Index   int                `bson:"index"`
+	Segment models.Segment     `bson:"segment"`
+}
+
+func (m *MongoDb) segments() *mongo.Collection {
+	return m.client.Database("whishper").Collection("segments")
+}
+
+// storeSegments moves the segments of r to a new set, leaving the set id in r.
+func (m *MongoDb) storeSegments(ctx context.Context, r *models.WhisperResult) error {
+	if len(r.Segments) == 0 {
+		return nil
+	}
+	id := primitive.NewObjectID()
+	docs := make([]interface{}, len(r.Segments))
+	for i, seg := range r.Segments {
+		docs[i] = segmentDoc{SetID: id, Index: i, Segment: seg}
+	}
+	if _, err := m.segments().InsertMany(ctx, docs); err != nil {
+		log.Error().Err(err).Msg("Error storing segments")
+		m.dropSegments(ctx, id)
+		return err
+	}
+	r.SegmentsID = id
+	r.Segments = nil
+	return nil
+}
+
+// dropSegments deletes segment sets nothing points to anymore. Errors are only
+// logged: a leftover set wastes space but is never read.
+func (m *MongoDb) dropSegments(ctx context.Context, ids ...primitive.ObjectID) {
+	if len(ids) == 0 {
+		return
+	}
+	filter := bson.D{primitive.E{Key: "set_id", Value: bson.D{primitive.E{Key: "$in", Value: ids}}}}
+	if _, err := m.segments().DeleteMany(ctx, filter); err != nil {
+		log.Warn().Err(err).Msgf("Error deleting %v unused segment sets", len(ids))
+	}
+}
+
+// hydrate loads the segments of every result of ts.
+func (m *MongoDb) hydrate(ctx context.Context, ts ...*models.Transcription) error {
+	var results []*models.WhisperResult
+	for _, t := range ts {
+		results = append(results, &t.Result)
+		for i := range t.Translations {
+			results = append(results, &t.Translations[i].Result)
+		}
+	}
+	return m.hydrateResults(ctx, results...)
+}
+
+// hydrateResults loads the segments of every result of rs. Results still
+// holding their segments inline, from before they were moved out, are left
+// as is.
+func (m *MongoDb) hydrateResults(ctx context.Context, rs ...*models.WhisperResult) error {
+	results := map[primitive.ObjectID]*models.WhisperResult{}
+	for _, r := range rs {
+		if !r.SegmentsID.IsZero() {
+			results[r.SegmentsID] = r
+			r.Segments = []models.Segment{}
+		}
+	}
+	if len(results) == 0 {
+		return nil
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(results))
+	for id := range results {
+		ids = append(ids, id)
+	}
+	filter := bson.D{primitive.E{Key: "set_id", Value: bson.D{primitive.E{Key: "$in", Value: ids}}}}
+	opts := options.Find().SetSort(bson.D{primitive.E{Key: "set_id", Value: 1}, primitive.E{Key: "index", Value: 1}})
+	cursor, err := m.segments().Find(ctx, filter, opts)
+	if err != nil {
+		log.Printf("Error getting segments: %v", err)
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var doc segmentDoc
+		if err := cursor.Decode(&doc); err != nil {
+			log.Printf("Error decoding segment: %v", err)
+			return err
+		}
+		r := results[doc.SetID]
+		r.Segments = append(r.Segments, doc.Segment)
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	for _, r := range results {
+		r.SegmentsID = primitive.NilObjectID
+	}
+	return nil
+}
+
+// segmentSets returns the segment sets the stored transcription t points to.
+func segmentSets(t *models.Transcription) []primitive.ObjectID {
+	var ids []primitive.ObjectID
+	if !t.Result.SegmentsID.IsZero() {
+		ids = append(ids, t.Result.SegmentsID)
+	}
+	for _, tr := range t.Translations {
+		if !tr.Result.SegmentsID.IsZero() {
+			ids = append(ids, tr.Result.SegmentsID)
+		}
+	}
+	return ids
+}
+
+// unusedSets returns the sets of before that after doesn't point to anymore.
+func unusedSets(before, after []primitive.ObjectID) []primitive.ObjectID {
+	kept := map[primitive.ObjectID]bool{}
+	for _, id := range after {
+		kept[id] = true
+	}
+	var unused []primitive.ObjectID
+	for _, id := range before {
+		if !kept[id] {
+			unused = append(unused, id)
+		}
+	}
+	return unused
+}
+
+// externalize returns the document to store for t, with the segments of
+// every result moved to a set, and the sets it created. When stored, the
+// current document, and current, the same document with its segments
+// loaded, are given, results whose segments didn't change keep their set.
+func (m *MongoDb) externalize(ctx context.Context, t, stored, current *models.Transcription) (*models.Transcription, []primitive.ObjectID, error) {
+	doc := *t
+	doc.Translations = nil
+	if t.Translations != nil {
+		doc.Translations = make([]models.Translation, len(t.Translations))
+		copy(doc.Translations, t.Translations)
+	}
+
+	var created []primitive.ObjectID
+	move := func(r *models.WhisperResult, storedResult, currentResult *models.WhisperResult) error {
+		if currentResult != nil && !storedResult.SegmentsID.IsZero() && sameSegments(r.Segments, currentResult.Segments) {
+			r.SegmentsID = storedResult.SegmentsID
+			r.Segments = nil
+			return nil
+		}
+		if err := m.storeSegments(ctx, r); err != nil {
+			return err
+		}
+		if !r.SegmentsID.IsZero() {
+			created = append(created, r.SegmentsID)
+		}
+		return nil
+	}
+
+	var storedResult, currentResult *models.WhisperResult
+	if current != nil {
+		storedResult, currentResult = &stored.Result, &current.Result
+	}
+	err := move(&doc.Result, storedResult, currentResult)
+	for i := 0; err == nil && i < len(doc.Translations); i++ {
+		storedResult, currentResult = nil, nil
+		if current != nil && i < len(current.Translations) && current.Translations[i].TargetLanguage == doc.Translations[i].TargetLanguage {
+			storedResult, currentResult = &stored.Translations[i].Result, &current.Translations[i].Result
+		}
+		err = move(&doc.Translations[i].Result, storedResult, currentResult)
+	}
+	if err != nil {
+		m.dropSegments(ctx, created...)
+		return nil, nil, err
+	}
+	return &doc, created, nil
+}
+
+func sameSegments(a, b []models.Segment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !reflect.DeepEqual(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// MoveSegmentsOut moves the segments still stored inside transcription
+// documents to segment sets. It returns how many documents were moved.
+func (m *MongoDb) MoveSegmentsOut(ctx context.Context) (int, error) {
+	filter := bson.D{primitive.E{Key: "$or", Value: bson.A{
+		bson.D{primitive.E{Key: "result.segments.0", Value: bson.D{primitive.E{Key: "$exists", Value: true}}}},
+		bson.D{primitive.E{Key: "translations.result.segments.0", Value: bson.D{primitive.E{Key: "$exists", Value: true}}}},
+	}}}
+	inline, err := m.find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, t := range inline {
+		doc, created, err := m.externalize(ctx, t, nil, nil)
+		if err != nil {
+			return moved, err
+		}
+		// The version is kept: the transcription itself doesn't change.
+		res, err := m.transcriptions().UpdateOne(ctx,
+			bson.D{primitive.E{Key: "_id", Value: t.ID}, versionFilter(t.Version)},
+			bson.D{primitive.E{Key: "$set", Value: bson.D{
+				primitive.E{Key: "result", Value: doc.Result},
+				primitive.E{Key: "translations", Value: doc.Translations},
+			}}})
+		if err != nil {
+			m.dropSegments(ctx, created...)
+			return moved, err
+		}
+		if res.MatchedCount == 0 {
+			// Written meanwhile: the writer moved the segments already.
+			m.dropSegments(ctx, created...)
+			continue
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// patchSetSegment replaces the segment of the set id with the same id as
+// segment.
+func (m *MongoDb) patchSetSegment(ctx context.Context, id primitive.ObjectID, segment models.Segment) error {
+	res, err := m.segments().UpdateOne(ctx,
+		bson.D{primitive.E{Key: "set_id", Value: id}, primitive.E{Key: "segment.id", Value: segment.ID}},
+		bson.D{primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "segment", Value: segment}}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrSegmentNotFound
+	}
+	return nil
+}
+
+// textUpdate sets the result text and its words count, after a segment of
+// the result was patched in its set. Only MongoDB applies the dotted path.
+func textUpdate(text string) fieldUpdate {
+	return fieldUpdate{set: bson.D{
+		primitive.E{Key: "result.text", Value: text},
+		primitive.E{Key: "words_count", Value: models.WhisperResult{Text: text}.WordsCount()},
+	}}
+}
+
+// storedTranscription returns the document id as stored, without loading
+// its segments.
+func (m *MongoDb) storedTranscription(ctx context.Context, oid primitive.ObjectID) (bson.Raw, error) {
+	raw, err := m.transcriptions().FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: oid}}).DecodeBytes()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	return raw, err
+}
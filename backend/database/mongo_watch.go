@@ -0,0 +1,123 @@
+package database
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+// watchRetry is how long WatchTranscriptions waits before reopening an
+// interrupted change stream.
+const watchRetry = 5 * time.Second
+
+// changeEvent is the part of a change stream event WatchTranscriptions reads.
+type changeEvent struct {
+	OperationType     string                `bson:"operationType"`
+	FullDocument      *models.Transcription `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields bson.Raw `bson:"updatedFields"`
+	} `bson:"updateDescription"`
+}
+
+// changesSegments reports whether the event may change the segments of the
+// transcription, so they have to be loaded again. Updates of other fields,
+// like the frequent progress ones, are streamed without the segments.
+func (e *changeEvent) changesSegments() bool {
+	if e.OperationType != "update" {
+		return true
+	}
+	fields, err := e.UpdateDescription.UpdatedFields.Elements()
+	if err != nil {
+		return true
+	}
+	for _, field := range fields {
+		switch strings.SplitN(field.Key(), ".", 2)[0] {
+		case "result", "translations":
+			return true
+		}
+	}
+	return false
+}
+
+// WatchTranscriptions streams every transcription inserted or updated by any
+// instance until ctx is done. The segments are loaded when the change may
+// have touched them. It relies on change
+// streams, which MongoDB only offers on replica sets.
+func (m *MongoDb) WatchTranscriptions(ctx context.Context) (<-chan *models.Transcription, error) {
+	pipeline := mongo.Pipeline{bson.D{primitive.E{Key: "$match", Value: bson.D{
+		primitive.E{Key: "operationType", Value: bson.D{primitive.E{Key: "$in", Value: bson.A{"insert", "update", "replace"}}}},
+	}}}}
+	watch := func(resumeToken bson.Raw) (*mongo.ChangeStream, error) {
+		opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+		if resumeToken != nil {
+			opts.SetResumeAfter(resumeToken)
+		}
+		return m.transcriptions().Watch(ctx, pipeline, opts)
+	}
+
+	stream, err := watch(nil)
+	if err != nil {
+		log.Error().Err(err).Msg("Error opening the transcriptions change stream")
+		return nil, err
+	}
+
+	ch := make(chan *models.Transcription, 64)
+	go func() {
+		defer close(ch)
+		for {
+			for stream.Next(ctx) {
+				var event changeEvent
+				if err := stream.Decode(&event); err != nil {
+					log.Error().Err(err).Msg("Error decoding a change event")
+					continue
+				}
+				if event.FullDocument == nil {
+					// Deleted before the lookup.
+					continue
+				}
+				if event.changesSegments() {
+					if err := m.hydrate(ctx, event.FullDocument); err != nil {
+						log.Warn().Err(err).Msgf("Error loading the segments of transcription %v", event.FullDocument.ID.Hex())
+					}
+				}
+				select {
+				case ch <- event.FullDocument:
+				case <-ctx.Done():
+				}
+			}
+			resumeToken := stream.ResumeToken()
+			streamErr := stream.Err()
+			stream.Close(context.Background())
+			if ctx.Err() != nil {
+				return
+			}
+
+			// The driver resumes on transient errors by itself, so this is
+			// a longer outage. Pick up where the stream stopped if the
+			// oplog still has it, and from now on otherwise.
+			log.Warn().Err(streamErr).Msg("The transcriptions change stream stopped, reopening it")
+			for {
+				select {
+				case <-time.After(watchRetry):
+				case <-ctx.Done():
+					return
+				}
+				stream, err = watch(resumeToken)
+				if err == nil {
+					break
+				}
+				log.Warn().Err(err).Msg("Error reopening the transcriptions change stream")
+				resumeToken = nil
+			}
+		}
+	}()
+	return ch, nil
+}
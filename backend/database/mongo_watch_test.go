@@ -0,0 +1,43 @@
+package database
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestChangesSegments(t *testing.T) {
+	tests := []struct {
+		name    string
+		op      string
+		updated bson.D
+		want    bool
+	}{
+		{name: "insert", op: "insert", want: true},
+		{name: "replace", op: "replace", want: true},
+		{name: "progress", op: "update", updated: bson.D{{Key: "progress", Value: 0.5}, {Key: "version", Value: 3}}},
+		{name: "status", op: "update", updated: bson.D{{Key: "status", Value: 2}, {Key: "lease_owner", Value: "w1"}}},
+		{name: "result", op: "update", updated: bson.D{{Key: "status", Value: 2}, {Key: "result", Value: bson.D{}}}, want: true},
+		{name: "result text", op: "update", updated: bson.D{{Key: "result.text", Value: "hello"}}, want: true},
+		{name: "translation", op: "update", updated: bson.D{{Key: "translations.1", Value: bson.D{}}}, want: true},
+		{name: "no description", op: "update", want: true},
+	}
+	for _, tt := range tests {
+		doc := bson.D{{Key: "operationType", Value: tt.op}}
+		if tt.updated != nil {
+			doc = append(doc, primitive.E{Key: "updateDescription", Value: bson.D{{Key: "updatedFields", Value: tt.updated}}})
+		}
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var event changeEvent
+		if err := bson.Unmarshal(raw, &event); err != nil {
+			t.Fatal(err)
+		}
+		if got := event.changesSegments(); got != tt.want {
+			t.Errorf("%v: changesSegments() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
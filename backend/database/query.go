@@ -0,0 +1,249 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+// Fields a listing can be sorted by. Ties are always broken by id, which
+// follows the creation order.
+const (
+	SortByCreated  = "created"
+	SortByFileName = "fileName"
+	SortByStatus   = "status"
+	SortByLanguage = "language"
+	SortByDuration = "duration"
+)
+
+// ErrInvalidCursor is returned when a listing cursor can't be decoded or was
+// issued for a different sort order.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ListOptions selects, orders and pages the transcriptions returned by
+// ListTranscriptions. Zero values mean "no filter".
+type ListOptions struct {
+	Status     []int
+	Language   string
+	ModelSize  string
+	Device     string
+	SourceType string // models.SourceTypeFile or models.SourceTypeURL
+	// From (inclusive) and To (exclusive) bound the creation time, which is
+	// taken from the transcription id.
+	From time.Time
+	To   time.Time
+	// Trashed lists the transcriptions in the trash instead of the others.
+	// TrashedBefore then only keeps those trashed before that time.
+	Trashed       bool
+	TrashedBefore time.Time
+
+	SortBy string // One of the SortBy* constants, SortByCreated if empty.
+	Desc   bool
+	// Limit is the page size; 0 returns every match in a single page.
+	Limit int
+	// Cursor is the NextCursor of the previous page.
+	Cursor string
+}
+
+// ListPage is one page of a listing. Items never carry the result segments
+// nor the translation results. NextCursor is empty on the last page.
+type ListPage struct {
+	Items      []*models.Transcription
+	Total      int64
+	NextCursor string
+}
+
+// ValidSortBy reports whether field is one of the SortBy* constants.
+func ValidSortBy(field string) bool {
+	switch field {
+	case SortByCreated, SortByFileName, SortByStatus, SortByLanguage, SortByDuration:
+		return true
+	}
+	return false
+}
+
+func (o *ListOptions) sortBy() string {
+	if o.SortBy == "" {
+		return SortByCreated
+	}
+	return o.SortBy
+}
+
+// matches applies the filters of o to t. Backends that can't filter in their
+// query language use it directly.
+func (o *ListOptions) matches(t *models.Transcription) bool {
+	if (t.DeletedAt != nil) != o.Trashed {
+		return false
+	}
+	if o.Trashed && !o.TrashedBefore.IsZero() && !t.DeletedAt.Before(o.TrashedBefore) {
+		return false
+	}
+	if len(o.Status) > 0 {
+		found := false
+		for _, st := range o.Status {
+			if t.Status == st {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if o.Language != "" && t.Language != o.Language {
+		return false
+	}
+	if o.ModelSize != "" && t.ModelSize != o.ModelSize {
+		return false
+	}
+	if o.Device != "" && t.Device != o.Device {
+		return false
+	}
+	switch o.SourceType {
+	case models.SourceTypeURL:
+		if t.SourceUrl == "" {
+			return false
+		}
+	case models.SourceTypeFile:
+		if t.SourceUrl != "" {
+			return false
+		}
+	}
+	created := t.ID.Timestamp()
+	if !o.From.IsZero() && created.Before(o.From) {
+		return false
+	}
+	if !o.To.IsZero() && !created.Before(o.To) {
+		return false
+	}
+	return true
+}
+
+// sortValue returns the value t is ordered by.
+func sortValue(t *models.Transcription, sortBy string) interface{} {
+	switch sortBy {
+	case SortByFileName:
+		return t.FileName
+	case SortByStatus:
+		return t.Status
+	case SortByLanguage:
+		return t.Language
+	case SortByDuration:
+		return t.Result.Duration
+	}
+	return nil
+}
+
+// listCursor is the position right after the last item of a page.
+type listCursor struct {
+	SortBy string          `json:"s"`
+	Desc   bool            `json:"d"`
+	Value  json.RawMessage `json:"v,omitempty"`
+	ID     string          `json:"id"`
+
+	value interface{}
+	id    primitive.ObjectID
+}
+
+func encodeCursor(o *ListOptions, last *models.Transcription) string {
+	c := listCursor{SortBy: o.sortBy(), Desc: o.Desc, ID: last.ID.Hex()}
+	if v := sortValue(last, c.SortBy); v != nil {
+		c.Value, _ = json.Marshal(v)
+	}
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// cursor decodes o.Cursor. It returns nil if the listing starts at the top.
+func (o *ListOptions) cursor() (*listCursor, error) {
+	if o.Cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(o.Cursor, "="))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	var c listCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	if c.SortBy != o.sortBy() || c.Desc != o.Desc {
+		return nil, fmt.Errorf("%w: issued for another sort order", ErrInvalidCursor)
+	}
+	if c.id, err = primitive.ObjectIDFromHex(c.ID); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+
+	switch c.SortBy {
+	case SortByFileName, SortByLanguage:
+		var v string
+		err = json.Unmarshal(c.Value, &v)
+		c.value = v
+	case SortByStatus:
+		var v int
+		err = json.Unmarshal(c.Value, &v)
+		c.value = v
+	case SortByDuration:
+		var v float64
+		err = json.Unmarshal(c.Value, &v)
+		c.value = v
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	return &c, nil
+}
+
+// after reports whether t comes after the cursor position.
+func (c *listCursor) after(t *models.Transcription) bool {
+	cmp := compareValues(sortValue(t, c.SortBy), c.value)
+	if cmp == 0 {
+		cmp = compareValues(t.ID, c.id)
+	}
+	if c.Desc {
+		return cmp < 0
+	}
+	return cmp > 0
+}
+
+// compareValues orders two sort values of the same type.
+func compareValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case string:
+		return strings.Compare(a, b.(string))
+	case int:
+		b := b.(int)
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+	case float64:
+		b := b.(float64)
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+	case primitive.ObjectID:
+		b := b.(primitive.ObjectID)
+		return strings.Compare(string(a[:]), string(b[:]))
+	}
+	return 0
+}
+
+// listItem strips the heavy parts of t that listings never return.
+func listItem(t *models.Transcription) *models.Transcription {
+	t.Result.Segments = nil
+	for i := range t.Translations {
+		t.Translations[i].Result = models.WhisperResult{}
+	}
+	return t
+}
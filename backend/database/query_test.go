@@ -0,0 +1,148 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	last := &models.Transcription{
+		ID:       primitive.NewObjectID(),
+		FileName: "b.mp3",
+		Status:   models.TranscriptionStatusDone,
+		Language: "en",
+		Result:   models.WhisperResult{Duration: 12.5},
+	}
+	tests := []struct {
+		sortBy string
+		desc   bool
+		value  interface{}
+	}{
+		{SortByCreated, false, nil},
+		{SortByCreated, true, nil},
+		{SortByFileName, false, "b.mp3"},
+		{SortByStatus, true, models.TranscriptionStatusDone},
+		{SortByLanguage, false, "en"},
+		{SortByDuration, true, 12.5},
+	}
+	for _, tt := range tests {
+		opts := ListOptions{SortBy: tt.sortBy, Desc: tt.desc}
+		opts.Cursor = encodeCursor(&opts, last)
+		c, err := opts.cursor()
+		if err != nil {
+			t.Errorf("%v desc=%v: %v", tt.sortBy, tt.desc, err)
+			continue
+		}
+		if c.id != last.ID || c.value != tt.value {
+			t.Errorf("%v desc=%v: decoded id %v and value %v, want %v and %v", tt.sortBy, tt.desc, c.id, c.value, last.ID, tt.value)
+		}
+		if c.after(last) {
+			t.Errorf("%v desc=%v: the last item comes after its own cursor", tt.sortBy, tt.desc)
+		}
+	}
+}
+
+func TestInvalidCursor(t *testing.T) {
+	last := &models.Transcription{ID: primitive.NewObjectID(), FileName: "a.mp3"}
+	byName := ListOptions{SortBy: SortByFileName}
+	issued := encodeCursor(&byName, last)
+
+	tests := []struct {
+		name string
+		opts ListOptions
+	}{
+		{"not base64", ListOptions{Cursor: "!!!"}},
+		{"not json", ListOptions{Cursor: "bm90IGpzb24"}},
+		{"other sort field", ListOptions{SortBy: SortByLanguage, Cursor: issued}},
+		{"other direction", ListOptions{SortBy: SortByFileName, Desc: true, Cursor: issued}},
+	}
+	for _, tt := range tests {
+		if _, err := tt.opts.cursor(); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("%v: got error %v, want ErrInvalidCursor", tt.name, err)
+		}
+	}
+}
+
+func TestCursorTieBreak(t *testing.T) {
+	first, second := primitive.NewObjectID(), primitive.NewObjectID()
+	a := &models.Transcription{ID: first, FileName: "same.mp3"}
+	b := &models.Transcription{ID: second, FileName: "same.mp3"}
+	tests := []struct {
+		desc bool
+		last *models.Transcription
+		next *models.Transcription
+	}{
+		{false, a, b},
+		{true, b, a},
+	}
+	for _, tt := range tests {
+		opts := ListOptions{SortBy: SortByFileName, Desc: tt.desc}
+		opts.Cursor = encodeCursor(&opts, tt.last)
+		c, err := opts.cursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.after(tt.next) {
+			t.Errorf("desc=%v: equal file names aren't ordered by id", tt.desc)
+		}
+		if c.after(tt.last) {
+			t.Errorf("desc=%v: the last item comes after its own cursor", tt.desc)
+		}
+	}
+}
+
+// Paging through a listing with ties on the sort field returns every
+// transcription once, in order.
+func TestListPages(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Db) {
+		ctx := context.Background()
+		var ids []primitive.ObjectID
+		for _, name := range []string{"b.mp3", "a.mp3", "b.mp3", "a.mp3", "b.mp3"} {
+			tr, err := db.NewTranscription(ctx, &models.Transcription{FileName: name})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, tr.ID)
+		}
+		// By file name, then by id.
+		ascending := []primitive.ObjectID{ids[1], ids[3], ids[0], ids[2], ids[4]}
+
+		for _, desc := range []bool{false, true} {
+			want := ascending
+			if desc {
+				want = []primitive.ObjectID{ids[4], ids[2], ids[0], ids[3], ids[1]}
+			}
+			opts := ListOptions{SortBy: SortByFileName, Desc: desc, Limit: 2}
+			var got []primitive.ObjectID
+			for {
+				page, err := db.ListTranscriptions(ctx, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if page.Total != 5 {
+					t.Errorf("desc=%v: total %v, want 5", desc, page.Total)
+				}
+				for _, item := range page.Items {
+					got = append(got, item.ID)
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				opts.Cursor = page.NextCursor
+			}
+			if len(got) != len(want) {
+				t.Fatalf("desc=%v: listed %v, want %v", desc, got, want)
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("desc=%v: listed %v, want %v", desc, got, want)
+				}
+			}
+		}
+	})
+}
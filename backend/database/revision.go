@@ -0,0 +1,41 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+// ErrRevisionNotFound is returned when a transcription has no revision with
+// the given id.
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// prepareRevision gives a new revision its id and creation time.
+func prepareRevision(r *models.Revision) {
+	if r.ID == primitive.NilObjectID {
+		r.ID = primitive.NewObjectID()
+	}
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = writeTime()
+	}
+}
+
+// revisionListItem strips the result and translations listings never return.
+func revisionListItem(r *models.Revision) *models.Revision {
+	r.Result = models.WhisperResult{}
+	r.Translations = nil
+	return r
+}
+
+// parseRevisionID parses a hex revision id, wrapping ErrRevisionNotFound on
+// failure since no revision can have it.
+func parseRevisionID(id string) (primitive.ObjectID, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("%w: %q", ErrRevisionNotFound, id)
+	}
+	return oid, nil
+}
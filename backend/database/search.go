@@ -0,0 +1,207 @@
+package database
+
+import (
+	"html"
+	"sort"
+	"strings"
+	"unicode"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+// SearchOptions describes a full-text search. Query is a list of words;
+// double quoted parts are matched as a phrase. Every word or phrase must be
+// present as whole words, case insensitively. Every backend matches the same
+// way: their indexes only narrow down the candidates, searchTranscription
+// decides.
+type SearchOptions struct {
+	Query string
+	// Limit caps the number of transcriptions returned, 0 means no limit.
+	Limit int
+}
+
+// SearchHit is a transcription matching a search, with the places where it
+// matched.
+type SearchHit struct {
+	TranscriptionID string        `json:"transcriptionId"`
+	FileName        string        `json:"fileName"`
+	Matches         []SearchMatch `json:"matches"`
+}
+
+// SearchMatch is a single match inside a transcription. Language is empty for
+// the transcription result and holds the target language for translations.
+// SegmentID, Start and End are only set for segment matches. Snippet is HTML
+// escaped text with every match wrapped in <mark></mark>.
+type SearchMatch struct {
+	Language  string  `json:"language,omitempty"`
+	SegmentID string  `json:"segmentId,omitempty"`
+	Start     float64 `json:"start"`
+	End       float64 `json:"end"`
+	Snippet   string  `json:"snippet"`
+}
+
+// snippetContext is how many characters are kept around the first match of
+// a snippet taken from a full text.
+const snippetContext = 60
+
+// SearchTerms splits a query into lower cased words and quoted phrases.
+func SearchTerms(query string) []string {
+	var terms []string
+	for i, part := range strings.Split(query, `"`) {
+		if i%2 == 1 {
+			// Inside quotes: keep the phrase whole.
+			if phrase := strings.Join(strings.Fields(part), " "); phrase != "" {
+				terms = append(terms, lowerRunes(phrase))
+			}
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			terms = append(terms, lowerRunes(word))
+		}
+	}
+	return terms
+}
+
+// lowerRunes lower cases s rune by rune, so that the result has as many runes
+// as s. strings.ToLower may not, which would shift the highlighted ranges.
+func lowerRunes(s string) string {
+	runes := []rune(s)
+	for i, r := range runes {
+		runes[i] = unicode.ToLower(r)
+	}
+	return string(runes)
+}
+
+// searchTranscription returns the matches of terms inside t, or nil if t
+// does not match. Backends use it on the candidates found by their index so
+// that every backend reports matches the same way.
+func searchTranscription(t *models.Transcription, terms []string) *SearchHit {
+	if len(terms) == 0 {
+		return nil
+	}
+	hit := &SearchHit{
+		TranscriptionID: t.ID.Hex(),
+		FileName:        t.FileName,
+	}
+	hit.Matches = append(hit.Matches, searchResult(&t.Result, "", terms)...)
+	for i := range t.Translations {
+		tr := &t.Translations[i]
+		hit.Matches = append(hit.Matches, searchResult(&tr.Result, tr.TargetLanguage, terms)...)
+	}
+	if len(hit.Matches) == 0 {
+		return nil
+	}
+	return hit
+}
+
+// searchResult matches every segment of r. If no single segment matches, the
+// full text is tried, since the terms may be spread over several segments.
+func searchResult(r *models.WhisperResult, language string, terms []string) []SearchMatch {
+	var matches []SearchMatch
+	for _, seg := range r.Segments {
+		if snippet, ok := highlight(seg.Text, terms, 0); ok {
+			matches = append(matches, SearchMatch{
+				Language:  language,
+				SegmentID: seg.ID,
+				Start:     seg.Start,
+				End:       seg.End,
+				Snippet:   snippet,
+			})
+		}
+	}
+	if len(matches) == 0 {
+		if snippet, ok := highlight(r.Text, terms, snippetContext); ok {
+			matches = append(matches, SearchMatch{
+				Language: language,
+				Snippet:  snippet,
+			})
+		}
+	}
+	return matches
+}
+
+// highlight reports whether text contains every term as whole words and
+// returns the highlighted snippet. With around > 0 the snippet is cut to that many
+// characters on each side of the first match.
+func highlight(text string, terms []string, around int) (string, bool) {
+	runes := []rune(text)
+	lower := []rune(lowerRunes(text))
+
+	// Collect the [start, end) rune ranges of every occurrence of every term.
+	var ranges [][2]int
+	for _, term := range terms {
+		needle := []rune(term)
+		found := false
+		for i := 0; i+len(needle) <= len(lower); i++ {
+			end := i + len(needle)
+			if string(lower[i:end]) != term {
+				continue
+			}
+			if (i > 0 && wordRune(lower[i-1])) || (end < len(lower) && wordRune(lower[end])) {
+				// Part of a longer word.
+				continue
+			}
+			ranges = append(ranges, [2]int{i, end})
+			found = true
+		}
+		if !found {
+			return "", false
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+
+	from, to := 0, len(runes)
+	if around > 0 {
+		if ranges[0][0]-around > from {
+			from = ranges[0][0] - around
+		}
+		if ranges[0][1]+around < to {
+			to = ranges[0][1] + around
+		}
+	}
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+	pos := from
+	for _, r := range ranges {
+		start, end := r[0], r[1]
+		if start < pos {
+			start = pos
+		}
+		if end > to {
+			end = to
+		}
+		if start >= end {
+			continue
+		}
+		b.WriteString(html.EscapeString(string(runes[pos:start])))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(string(runes[start:end])))
+		b.WriteString("</mark>")
+		pos = end
+	}
+	b.WriteString(html.EscapeString(string(runes[pos:to])))
+	if to < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String(), true
+}
+
+// wordRune reports whether r belongs to a word, so words end next to the
+// other runes.
+func wordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// rankHits orders hits by number of matches and keeps at most limit of them.
+func rankHits(hits []SearchHit, limit int) []SearchHit {
+	sort.SliceStable(hits, func(i, j int) bool {
+		return len(hits[i].Matches) > len(hits[j].Matches)
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits
+}
@@ -0,0 +1,236 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+func TestSearchTerms(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", nil},
+		{"Hello  World", []string{"hello", "world"}},
+		{`fox "Big  Brown" dog`, []string{"fox", "big brown", "dog"}},
+		{`"unterminated phrase`, []string{"unterminated phrase"}},
+		{`"" empty`, []string{"empty"}},
+	}
+	for _, tt := range tests {
+		if got := SearchTerms(tt.query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SearchTerms(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		text   string
+		terms  []string
+		around int
+		want   string
+		ok     bool
+	}{
+		{"Hello World", []string{"world"}, 0, "Hello <mark>World</mark>", true},
+		{"Hello World", []string{"world", "moon"}, 0, "", false},
+		{"Ünïcode café", []string{"café", "ünïcode"}, 0, "<mark>Ünïcode</mark> <mark>café</mark>", true},
+		// Whole words only, like the indexes of the other backends.
+		{"Ünïcode café", []string{"ünï"}, 0, "", false},
+		{"foxes and fox", []string{"fox"}, 0, "foxes and <mark>fox</mark>", true},
+		{"Hello, world!", []string{"hello", "world"}, 0, "<mark>Hello</mark>, <mark>world</mark>!", true},
+		{"don't stop", []string{"don"}, 0, "<mark>don</mark>&#39;t stop", true},
+		{"a <b> & c", []string{"c"}, 0, "a &lt;b&gt; &amp; <mark>c</mark>", true},
+		{"fox and fox", []string{"fox"}, 0, "<mark>fox</mark> and <mark>fox</mark>", true},
+		{"one two three four five", []string{"three"}, 3, "…wo <mark>three</mark> fo…", true},
+		{"one two three", []string{"one"}, 4, "<mark>one</mark> two…", true},
+	}
+	for _, tt := range tests {
+		got, ok := highlight(tt.text, tt.terms, tt.around)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("highlight(%q, %q, %v) = %q, %v, want %q, %v", tt.text, tt.terms, tt.around, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRankHits(t *testing.T) {
+	hit := func(id string, matches int) SearchHit {
+		return SearchHit{TranscriptionID: id, Matches: make([]SearchMatch, matches)}
+	}
+	tests := []struct {
+		name  string
+		hits  []SearchHit
+		limit int
+		want  []string
+	}{
+		{"by matches", []SearchHit{hit("a", 1), hit("b", 3), hit("c", 2)}, 0, []string{"b", "c", "a"}},
+		{"ties keep their order", []SearchHit{hit("a", 1), hit("b", 2), hit("c", 1)}, 0, []string{"b", "a", "c"}},
+		{"limit", []SearchHit{hit("a", 1), hit("b", 3), hit("c", 2)}, 2, []string{"b", "c"}},
+		{"limit above count", []SearchHit{hit("a", 1)}, 5, []string{"a"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, h := range rankHits(tt.hits, tt.limit) {
+			got = append(got, h.TranscriptionID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: ranked %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSearchTranscriptions(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Db) {
+		ctx := context.Background()
+		fox, err := db.NewTranscription(ctx, &models.Transcription{
+			FileName: "fox.mp3",
+			Result: models.WhisperResult{
+				Text: "The quick brown fox jumps over the lazy dog",
+				Segments: []models.Segment{
+					{ID: "1", Start: 0, End: 2, Text: "The quick brown fox"},
+					{ID: "2", Start: 2, End: 4, Text: "jumps over the lazy dog"},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		translated, err := db.NewTranscription(ctx, &models.Transcription{
+			FileName: "translated.mp3",
+			Result:   models.WhisperResult{Text: "A fox", Segments: []models.Segment{{ID: "1", Text: "A fox"}}},
+			Translations: []models.Translation{{
+				SourceLanguage: "en",
+				TargetLanguage: "es",
+				Result:         models.WhisperResult{Text: "Un zorro", Segments: []models.Segment{{ID: "1", Text: "Un zorro"}}},
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		trashed, err := db.NewTranscription(ctx, &models.Transcription{
+			FileName: "trashed.mp3",
+			Result:   models.WhisperResult{Text: "zorro", Segments: []models.Segment{{ID: "1", Text: "zorro"}}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.TrashTranscription(ctx, trashed.ID.Hex()); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			query string
+			limit int
+			want  []SearchHit
+		}{
+			{
+				query: "FOX",
+				want: []SearchHit{
+					{TranscriptionID: fox.ID.Hex(), FileName: "fox.mp3", Matches: []SearchMatch{
+						{SegmentID: "1", Start: 0, End: 2, Snippet: "The quick brown <mark>fox</mark>"},
+					}},
+					{TranscriptionID: translated.ID.Hex(), FileName: "translated.mp3", Matches: []SearchMatch{
+						{SegmentID: "1", Snippet: "A <mark>fox</mark>"},
+					}},
+				},
+			},
+			{
+				query: "zorro",
+				want: []SearchHit{
+					{TranscriptionID: translated.ID.Hex(), FileName: "translated.mp3", Matches: []SearchMatch{
+						{Language: "es", SegmentID: "1", Snippet: "Un <mark>zorro</mark>"},
+					}},
+				},
+			},
+			{
+				// No single segment holds both, the full text does.
+				query: `"brown fox" lazy`,
+				want: []SearchHit{
+					{TranscriptionID: fox.ID.Hex(), FileName: "fox.mp3", Matches: []SearchMatch{
+						{Snippet: "The quick <mark>brown fox</mark> jumps over the <mark>lazy</mark> dog"},
+					}},
+				},
+			},
+			{query: "fox", limit: 1, want: nil},
+			{query: "wolf", want: nil},
+			// Every backend matches whole words only.
+			{query: "bro", want: nil},
+			{query: "zorr", want: nil},
+			{query: "  ", want: nil},
+		}
+		for _, tt := range tests {
+			hits, err := db.SearchTranscriptions(ctx, SearchOptions{Query: tt.query, Limit: tt.limit})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.limit > 0 {
+				if len(hits) != tt.limit {
+					t.Errorf("search %q with limit %v found %v hits", tt.query, tt.limit, len(hits))
+				}
+				continue
+			}
+			if len(hits) != len(tt.want) {
+				t.Errorf("search %q found %+v, want %+v", tt.query, hits, tt.want)
+				continue
+			}
+			// Hits with as many matches may come in any order.
+			for _, want := range tt.want {
+				found := false
+				for _, got := range hits {
+					found = found || reflect.DeepEqual(got, want)
+				}
+				if !found {
+					t.Errorf("search %q found %+v, want %+v among them", tt.query, hits, want)
+				}
+			}
+		}
+	})
+}
+
+// The result text follows segment edits, so that searches find the new text
+// and no longer the old one.
+func TestSearchEditedSegment(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Db) {
+		ctx := context.Background()
+		tr, err := db.NewTranscription(ctx, &models.Transcription{
+			FileName: "a.mp3",
+			Result: models.WhisperResult{
+				Text: "Hello world. Good night.",
+				Segments: []models.Segment{
+					{ID: "1", Text: " Hello world."},
+					{ID: "2", Text: " Good night."},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		patched, err := db.PatchSegment(ctx, tr.ID.Hex(), models.Segment{ID: "2", Text: " Good  morning, everyone."})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "Hello world. Good morning, everyone."; patched.Result.Text != want || patched.WordsCount != 5 {
+			t.Errorf("patched text %q with %v words, want %q with 5", patched.Result.Text, patched.WordsCount, want)
+		}
+
+		tests := []struct {
+			query string
+			found bool
+		}{
+			{"morning", true},
+			{`"world. good morning"`, true},
+			{"night", false},
+		}
+		for _, tt := range tests {
+			hits, err := db.SearchTranscriptions(ctx, SearchOptions{Query: tt.query})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found := len(hits) == 1 && hits[0].TranscriptionID == tr.ID.Hex(); found != tt.found || len(hits) > 1 {
+				t.Errorf("search %q found %+v, want found=%v", tt.query, hits, tt.found)
+			}
+		}
+	})
+}
@@ -0,0 +1,987 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	_ "modernc.org/sqlite"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+// SqliteDb implements Db on top of an embedded SQLite file. Every
+// transcription is stored as a BSON document, so updates follow the same
+// $set rules as MongoDb. The columns next to the document are only there to
+// filter and order rows.
+type SqliteDb struct {
+	db *sql.DB
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS transcriptions (
+	seq    INTEGER PRIMARY KEY AUTOINCREMENT,
+	id     TEXT    NOT NULL UNIQUE,
+	status INTEGER NOT NULL,
+	doc    BLOB    NOT NULL
+);
+CREATE TABLE IF NOT EXISTS meta (
+	key   TEXT    PRIMARY KEY,
+	value INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS revisions (
+	seq              INTEGER PRIMARY KEY AUTOINCREMENT,
+	id               TEXT    NOT NULL UNIQUE,
+	transcription_id TEXT    NOT NULL,
+	doc              BLOB    NOT NULL
+);
+`
+
+// sqliteColumn is a column derived from the stored document. Columns are
+// added to existing databases on startup and filled from the documents.
+type sqliteColumn struct {
+	name  string
+	decl  string
+	value func(t *models.Transcription) interface{}
+}
+
+var sqliteColumns = []sqliteColumn{
+	{"status", "INTEGER NOT NULL DEFAULT 0", func(t *models.Transcription) interface{} { return t.Status }},
+	{"created_at", "INTEGER", func(t *models.Transcription) interface{} { return t.ID.Timestamp().Unix() }},
+	{"language", "TEXT", func(t *models.Transcription) interface{} { return t.Language }},
+	{"model_size", "TEXT", func(t *models.Transcription) interface{} { return t.ModelSize }},
+	{"device", "TEXT", func(t *models.Transcription) interface{} { return t.Device }},
+	{"file_name", "TEXT", func(t *models.Transcription) interface{} { return t.FileName }},
+	{"source_url", "TEXT", func(t *models.Transcription) interface{} { return t.SourceUrl }},
+	{"priority", "INTEGER NOT NULL DEFAULT 0", func(t *models.Transcription) interface{} { return t.Priority }},
+	{"not_before", "INTEGER", func(t *models.Transcription) interface{} {
+		if t.NotBefore == nil {
+			return nil
+		}
+		return t.NotBefore.UnixMilli()
+	}},
+	{"duration", "REAL", func(t *models.Transcription) interface{} { return t.Result.Duration }},
+	{"deleted_at", "INTEGER", func(t *models.Transcription) interface{} {
+		if t.DeletedAt == nil {
+			return nil
+		}
+		return t.DeletedAt.UnixMilli()
+	}},
+	// summary is the document without segments, which is all a listing needs.
+	{"summary", "BLOB", func(t *models.Transcription) interface{} {
+		summary := *t
+		if t.Translations != nil {
+			summary.Translations = make([]models.Translation, len(t.Translations))
+			copy(summary.Translations, t.Translations)
+		}
+		b, _ := bson.Marshal(listItem(&summary))
+		return b
+	}},
+}
+
+// sqliteSearchSchema is the full-text index used by SearchTranscriptions.
+// It holds one row per transcription with all of its text.
+const sqliteSearchSchema = `
+CREATE VIRTUAL TABLE transcriptions_search USING fts5 (id UNINDEXED, body);
+`
+
+// sqliteIndexes are the indexes on the derived columns the SqliteDb queries
+// rely on.
+var sqliteIndexes = []Index{
+	{Collection: "transcriptions", Name: "transcriptions_queue", Keys: []string{"status", "-priority", "seq"}},
+	{Collection: "transcriptions", Name: "transcriptions_created_at", Keys: []string{"created_at"}},
+	{Collection: "transcriptions", Name: "transcriptions_file_name", Keys: []string{"file_name", "id"}},
+	{Collection: "transcriptions", Name: "transcriptions_language", Keys: []string{"language", "id"}},
+	{Collection: "transcriptions", Name: "transcriptions_source_url", Keys: []string{"source_url"}},
+	{Collection: "transcriptions", Name: "transcriptions_deleted_at", Keys: []string{"deleted_at"}, Sparse: true},
+	{Collection: "revisions", Name: "revisions_transcription_id", Keys: []string{"transcription_id"}},
+}
+
+func NewSqliteDb(path string) (*SqliteDb, error) {
+	dsn := fmt.Sprintf("file:%v?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_txlock=immediate", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		log.Error().Err(err).Msgf("Error opening sqlite database %v", path)
+		return nil, err
+	}
+	s := &SqliteDb{
+		db: db,
+	}
+	if err := s.upgrade(context.Background()); err != nil {
+		log.Error().Err(err).Msgf("Error creating sqlite schema in %v", path)
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// upgrade creates the schema, adds the columns missing from databases made by
+// older versions and fills them in.
+func (s *SqliteDb) upgrade(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, sqliteSchema); err != nil {
+		return err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT name FROM pragma_table_info('transcriptions')`)
+	if err != nil {
+		return err
+	}
+	existing := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+
+	var hasSearch int
+	err = s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE name = 'transcriptions_search'`).Scan(&hasSearch)
+	if err != nil {
+		return err
+	}
+	added := false
+	if hasSearch == 0 {
+		log.Info().Msg("Creating the sqlite full-text search index")
+		if _, err := s.db.ExecContext(ctx, sqliteSearchSchema); err != nil {
+			return err
+		}
+		added = true
+	}
+	for _, c := range sqliteColumns {
+		if existing[c.name] {
+			continue
+		}
+		log.Info().Msgf("Adding column %v to the sqlite transcriptions table", c.name)
+		if _, err := s.db.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE transcriptions ADD COLUMN %v %v`, c.name, c.decl)); err != nil {
+			return err
+		}
+		added = true
+	}
+	if added {
+		return s.refreshColumns(ctx)
+	}
+	return nil
+}
+
+// refreshColumns recomputes the derived columns and the search index of every
+// row.
+func (s *SqliteDb) refreshColumns(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `SELECT doc FROM transcriptions`)
+	if err != nil {
+		return err
+	}
+	var docs [][]byte
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			rows.Close()
+			return err
+		}
+		docs = append(docs, raw)
+	}
+	rows.Close()
+
+	for _, raw := range docs {
+		if err := s.writeRow(ctx, tx, raw, false, true); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// sqlExecer is satisfied by both *sql.DB and *sql.Tx.
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// writeRow inserts or updates the row holding the document raw, along with
+// its derived columns. The search index is only rewritten when reindex is set,
+// since progress updates don't change any text.
+func (s *SqliteDb) writeRow(ctx context.Context, ex sqlExecer, raw []byte, insert bool, reindex bool) error {
+	t, err := decodeTranscription(raw)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(sqliteColumns)+2)
+	args := make([]interface{}, 0, len(sqliteColumns)+2)
+	for _, c := range sqliteColumns {
+		names = append(names, c.name)
+		args = append(args, c.value(t))
+	}
+	names = append(names, "doc")
+	args = append(args, raw)
+
+	if insert {
+		names = append(names, "id")
+		args = append(args, t.ID.Hex())
+		query := fmt.Sprintf(`INSERT INTO transcriptions (%v) VALUES (?%v)`, strings.Join(names, ", "), strings.Repeat(", ?", len(names)-1))
+		if _, err := ex.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	} else {
+		query := fmt.Sprintf(`UPDATE transcriptions SET %v = ? WHERE id = ?`, strings.Join(names, " = ?, "))
+		if _, err := ex.ExecContext(ctx, query, append(args, t.ID.Hex())...); err != nil {
+			return err
+		}
+	}
+
+	if !reindex && !insert {
+		return nil
+	}
+	if _, err := ex.ExecContext(ctx, `DELETE FROM transcriptions_search WHERE id = ?`, t.ID.Hex()); err != nil {
+		return err
+	}
+	_, err = ex.ExecContext(ctx, `INSERT INTO transcriptions_search (id, body) VALUES (?, ?)`, t.ID.Hex(), searchBody(t))
+	return err
+}
+
+// searchBody is the text of t indexed for full-text search.
+func searchBody(t *models.Transcription) string {
+	var b strings.Builder
+	add := func(r *models.WhisperResult) {
+		b.WriteString(r.Text)
+		b.WriteByte('\n')
+		for _, seg := range r.Segments {
+			b.WriteString(seg.Text)
+			b.WriteByte('\n')
+		}
+	}
+	add(&t.Result)
+	for i := range t.Translations {
+		add(&t.Translations[i].Result)
+	}
+	return b.String()
+}
+
+// textChanged reports whether an update changed the text of a transcription.
+func textChanged(current, updated bson.Raw) bool {
+	for _, field := range []string{"result", "translations"} {
+		a, b := current.Lookup(field), updated.Lookup(field)
+		if a.Type != b.Type || !bytes.Equal(a.Value, b.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SqliteDb) GetTranscription(ctx context.Context, id string) (*models.Transcription, error) {
+	oid, err := objectID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw []byte
+	err = s.db.QueryRowContext(ctx, `SELECT doc FROM transcriptions WHERE id = ?`, oid.Hex()).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		log.Printf("Error getting transcription: %v", err)
+		return nil, err
+	}
+	return decodeTranscription(raw)
+}
+
+func (s *SqliteDb) DeleteTranscription(ctx context.Context, id string) error {
+	_, err := s.delete(ctx, id, "")
+	return err
+}
+
+func (s *SqliteDb) PurgeTranscription(ctx context.Context, id string, trashedBefore time.Time) (*models.Transcription, error) {
+	if trashedBefore.IsZero() {
+		return s.delete(ctx, id, "deleted_at IS NOT NULL")
+	}
+	return s.delete(ctx, id, "deleted_at IS NOT NULL AND deleted_at < ?", trashedBefore.UnixMilli())
+}
+
+// delete deletes the transcription id and its revisions if the row matches
+// the condition where, or in any case if it is empty. It returns ErrConflict
+// if the transcription exists but doesn't match.
+func (s *SqliteDb) delete(ctx context.Context, id string, where string, args ...interface{}) (*models.Transcription, error) {
+	oid, err := objectID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var doc []byte
+	err = tx.QueryRowContext(ctx, `SELECT doc FROM transcriptions WHERE id = ?`, oid.Hex()).Scan(&doc)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	query := `DELETE FROM transcriptions WHERE id = ?`
+	if where != "" {
+		query += " AND " + where
+	}
+	res, err := tx.ExecContext(ctx, query, append([]interface{}{oid.Hex()}, args...)...)
+	if err != nil {
+		log.Debug().Msg("Error deleting transcription")
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, ErrConflict
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM transcriptions_search WHERE id = ?`, oid.Hex()); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM revisions WHERE transcription_id = ?`, oid.Hex()); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return decodeTranscription(doc)
+}
+
+func (s *SqliteDb) NewTranscription(ctx context.Context, t *models.Transcription) (*models.Transcription, error) {
+	id := t.ID
+	if id == primitive.NilObjectID {
+		id = primitive.NewObjectID()
+	}
+	doc := *t
+	doc.ID = id
+	prepareNew(&doc)
+	raw, err := bson.Marshal(&doc)
+	if err != nil {
+		log.Printf("Error creating new transcription: %v", err)
+		return nil, err
+	}
+
+	if err := s.writeRow(ctx, s.db, raw, true, true); err != nil {
+		log.Printf("Error creating new transcription: %v", err)
+		return nil, err
+	}
+	t.ID = id
+	t.Version, t.CreatedAt, t.UpdatedAt = doc.Version, doc.CreatedAt, doc.UpdatedAt
+	return t, nil
+}
+
+func (s *SqliteDb) GetAllTranscriptions(ctx context.Context) ([]*models.Transcription, error) {
+	return s.find(ctx, `SELECT doc FROM transcriptions ORDER BY seq`)
+}
+
+func (s *SqliteDb) GetPendingTranscriptions(ctx context.Context) ([]*models.Transcription, error) {
+	return s.find(ctx, `SELECT doc FROM transcriptions WHERE status = ? AND deleted_at IS NULL ORDER BY priority DESC, seq`, models.TranscriptionStatusPending)
+}
+
+func (s *SqliteDb) GetRunningTranscription(ctx context.Context) ([]*models.Transcription, error) {
+	return s.find(ctx, `SELECT doc FROM transcriptions WHERE status = ? ORDER BY seq`, models.TranscriptionStatusRunning)
+}
+
+func (s *SqliteDb) UpdateTranscription(ctx context.Context, t *models.Transcription) (*models.Transcription, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var current []byte
+	err = tx.QueryRowContext(ctx, `SELECT doc FROM transcriptions WHERE id = ?`, t.ID.Hex()).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	merged, err := replaceUpdate(current, t)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.writeRow(ctx, tx, merged, false, textChanged(current, merged)); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *SqliteDb) find(ctx context.Context, query string, args ...interface{}) ([]*models.Transcription, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Printf("Error getting transcriptions: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transcriptions []*models.Transcription
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			log.Printf("Error decoding transcription: %v", err)
+			return nil, err
+		}
+		t, err := decodeTranscription(raw)
+		if err != nil {
+			log.Printf("Error decoding transcription: %v", err)
+			return nil, err
+		}
+		transcriptions = append(transcriptions, t)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error getting transcriptions: %v", err)
+		return nil, err
+	}
+	return transcriptions, nil
+}
+
+func (s *SqliteDb) ListTranscriptions(ctx context.Context, opts ListOptions) (*ListPage, error) {
+	cur, err := opts.cursor()
+	if err != nil {
+		return nil, err
+	}
+
+	where := []string{"deleted_at IS NULL"}
+	var args []interface{}
+	if opts.Trashed {
+		where[0] = "deleted_at IS NOT NULL"
+		if !opts.TrashedBefore.IsZero() {
+			where = append(where, "deleted_at < ?")
+			args = append(args, opts.TrashedBefore.UnixMilli())
+		}
+	}
+	if len(opts.Status) > 0 {
+		where = append(where, "status IN (?"+strings.Repeat(", ?", len(opts.Status)-1)+")")
+		for _, st := range opts.Status {
+			args = append(args, st)
+		}
+	}
+	for column, value := range map[string]string{"language": opts.Language, "model_size": opts.ModelSize, "device": opts.Device} {
+		if value != "" {
+			where = append(where, column+" = ?")
+			args = append(args, value)
+		}
+	}
+	switch opts.SourceType {
+	case models.SourceTypeURL:
+		where = append(where, "source_url <> ''")
+	case models.SourceTypeFile:
+		where = append(where, "source_url = ''")
+	}
+	if !opts.From.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, opts.From.Unix())
+	}
+	if !opts.To.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, opts.To.Unix())
+	}
+
+	page := &ListPage{}
+	err = s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM transcriptions`+sqlWhere(where), args...).Scan(&page.Total)
+	if err != nil {
+		log.Printf("Error counting transcriptions: %v", err)
+		return nil, err
+	}
+
+	column := map[string]string{
+		SortByCreated:  "id",
+		SortByFileName: "file_name",
+		SortByStatus:   "status",
+		SortByLanguage: "language",
+		SortByDuration: "duration",
+	}[opts.sortBy()]
+	op, dir := ">", "ASC"
+	if opts.Desc {
+		op, dir = "<", "DESC"
+	}
+	if cur != nil {
+		if column == "id" {
+			where = append(where, "id "+op+" ?")
+			args = append(args, cur.ID)
+		} else {
+			where = append(where, fmt.Sprintf("(%[1]v %[2]v ? OR (%[1]v = ? AND id %[2]v ?))", column, op))
+			args = append(args, cur.value, cur.value, cur.ID)
+		}
+	}
+	query := `SELECT summary FROM transcriptions` + sqlWhere(where) + fmt.Sprintf(` ORDER BY %v %v`, column, dir)
+	if column != "id" {
+		query += ", id " + dir
+	}
+	if opts.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", opts.Limit+1)
+	}
+
+	items, err := s.find(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Limit > 0 && len(items) > opts.Limit {
+		items = items[:opts.Limit]
+		page.NextCursor = encodeCursor(&opts, items[len(items)-1])
+	}
+	page.Items = items
+	return page, nil
+}
+
+func (s *SqliteDb) SearchTranscriptions(ctx context.Context, opts SearchOptions) ([]SearchHit, error) {
+	terms := SearchTerms(opts.Query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	// Every term becomes a phrase, which FTS5 matches as whole words, and
+	// FTS5 requires all of them.
+	phrases := make([]string, len(terms))
+	for i, term := range terms {
+		phrases[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+	}
+	candidates, err := s.find(ctx, `SELECT t.doc FROM transcriptions_search
+		JOIN transcriptions t ON t.id = transcriptions_search.id
+		WHERE transcriptions_search MATCH ? AND t.deleted_at IS NULL ORDER BY rank`, strings.Join(phrases, " "))
+	if err != nil {
+		return nil, err
+	}
+
+	var hits []SearchHit
+	for _, t := range candidates {
+		if hit := searchTranscription(t, terms); hit != nil {
+			hits = append(hits, *hit)
+		}
+	}
+	return rankHits(hits, opts.Limit), nil
+}
+
+func (s *SqliteDb) ClaimNextPending(ctx context.Context, req ClaimRequest) (*models.Transcription, error) {
+	// Transactions start with BEGIN IMMEDIATE, so no other connection or
+	// process can claim the same row in between.
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	where := []string{"status = ?", "deleted_at IS NULL"}
+	args := []interface{}{models.TranscriptionStatusPending}
+	for column, skip := range map[string][]string{"device": req.SkipDevices, "model_size": req.SkipModelSizes} {
+		if len(skip) == 0 {
+			continue
+		}
+		where = append(where, column+" NOT IN (?"+strings.Repeat(", ?", len(skip)-1)+")")
+		for _, v := range skip {
+			args = append(args, v)
+		}
+	}
+	var current []byte
+	err = tx.QueryRowContext(ctx, `SELECT doc FROM transcriptions`+sqlWhere(where)+` ORDER BY priority DESC, seq LIMIT 1`, args...).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	merged, err := s.setFields(ctx, tx, current, claimUpdate(req, time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return decodeTranscription(merged)
+}
+
+func (s *SqliteDb) ReleaseScheduled(ctx context.Context, now time.Time) ([]*models.Transcription, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `SELECT doc FROM transcriptions WHERE status = ? AND deleted_at IS NULL AND (not_before IS NULL OR not_before <= ?) ORDER BY seq`,
+		models.TranscriptionStatusScheduled, now.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	var docs [][]byte
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		docs = append(docs, raw)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var released []*models.Transcription
+	for _, raw := range docs {
+		merged, err := s.setFields(ctx, tx, raw, releaseUpdate())
+		if err != nil {
+			return nil, err
+		}
+		t, err := decodeTranscription(merged)
+		if err != nil {
+			return nil, err
+		}
+		released = append(released, t)
+	}
+	return released, tx.Commit()
+}
+
+func (s *SqliteDb) SchemaVersion(ctx context.Context) (int, error) {
+	var version int
+	err := s.db.QueryRowContext(ctx, `SELECT value FROM meta WHERE key = 'schema_version'`).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return version, err
+}
+
+func (s *SqliteDb) SetSchemaVersion(ctx context.Context, version int) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO meta (key, value) VALUES ('schema_version', ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value`, version)
+	return err
+}
+
+func (s *SqliteDb) EnsureIndexes(ctx context.Context) error {
+	for _, ix := range sqliteIndexes {
+		columns := make([]string, len(ix.Keys))
+		for i, key := range ix.Keys {
+			field, desc := indexKey(key)
+			columns[i] = field
+			if desc {
+				columns[i] += " DESC"
+			}
+		}
+		unique, where := "", ""
+		if ix.Unique {
+			unique = "UNIQUE "
+		}
+		if ix.Sparse {
+			field, _ := indexKey(ix.Keys[0])
+			where = fmt.Sprintf(" WHERE %v IS NOT NULL", field)
+		}
+		query := fmt.Sprintf(`CREATE %vINDEX IF NOT EXISTS %v ON %v (%v)%v`, unique, ix.Name, ix.Collection, strings.Join(columns, ", "), where)
+		if _, err := s.db.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("creating index %v: %w", ix.Name, err)
+		}
+	}
+	return nil
+}
+
+func (s *SqliteDb) IndexStatus(ctx context.Context) ([]IndexStatus, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT m.tbl_name, m.name, i.name, i.desc, l."unique"
+		FROM sqlite_master m
+		JOIN pragma_index_list(m.tbl_name) l ON l.name = m.name
+		JOIN pragma_index_xinfo(m.name) i ON i.key = 1
+		WHERE m.type = 'index' AND m.name NOT LIKE 'sqlite_autoindex_%'
+		ORDER BY m.name, i.seqno`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var existing []IndexStatus
+	for rows.Next() {
+		var table, name, column string
+		var desc, unique bool
+		if err := rows.Scan(&table, &name, &column, &desc, &unique); err != nil {
+			return nil, err
+		}
+		if desc {
+			column = "-" + column
+		}
+		if n := len(existing); n > 0 && existing[n-1].Name == name {
+			existing[n-1].Keys = append(existing[n-1].Keys, column)
+			continue
+		}
+		existing = append(existing, IndexStatus{Collection: table, Name: name, Keys: []string{column}, Unique: unique})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return indexStatus(sqliteIndexes, existing), nil
+}
+
+func (s *SqliteDb) AddRevision(ctx context.Context, r *models.Revision) (*models.Revision, error) {
+	prepareRevision(r)
+	raw, err := bson.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO revisions (id, transcription_id, doc) VALUES (?, ?, ?)`,
+		r.ID.Hex(), r.TranscriptionID.Hex(), raw)
+	if err != nil {
+		log.Printf("Error saving revision: %v", err)
+		return nil, err
+	}
+	return r, nil
+}
+
+func (s *SqliteDb) ListRevisions(ctx context.Context, transcriptionID string) ([]*models.Revision, error) {
+	oid, err := objectID(transcriptionID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT doc FROM revisions WHERE transcription_id = ? ORDER BY seq DESC`, oid.Hex())
+	if err != nil {
+		log.Printf("Error getting revisions: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []*models.Revision
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		var r models.Revision
+		if err := bson.Unmarshal(raw, &r); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revisionListItem(&r))
+	}
+	return revisions, rows.Err()
+}
+
+func (s *SqliteDb) GetRevision(ctx context.Context, transcriptionID string, revisionID string) (*models.Revision, error) {
+	oid, err := objectID(transcriptionID)
+	if err != nil {
+		return nil, err
+	}
+	rid, err := parseRevisionID(revisionID)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw []byte
+	err = s.db.QueryRowContext(ctx, `SELECT doc FROM revisions WHERE id = ? AND transcription_id = ?`, rid.Hex(), oid.Hex()).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRevisionNotFound
+	}
+	if err != nil {
+		log.Printf("Error getting revision: %v", err)
+		return nil, err
+	}
+	var r models.Revision
+	if err := bson.Unmarshal(raw, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (s *SqliteDb) RenewLease(ctx context.Context, id string, workerID string, until time.Time) error {
+	oid, err := objectID(id)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current []byte
+	err = tx.QueryRowContext(ctx, `SELECT doc FROM transcriptions WHERE id = ? AND status = ?`, oid.Hex(), models.TranscriptionStatusRunning).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrLeaseLost
+	}
+	if err != nil {
+		return err
+	}
+	if owner, _ := bson.Raw(current).Lookup("lease_owner").StringValueOK(); owner != workerID {
+		return ErrLeaseLost
+	}
+	if _, err := s.setFields(ctx, tx, current, renewUpdate(until)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SqliteDb) FinishJob(ctx context.Context, id string, workerID string, outcome JobOutcome) (*models.Transcription, error) {
+	t, err := s.modify(ctx, id, func(t *models.Transcription) (fieldUpdate, error) {
+		if !holdsLease(t, workerID) {
+			return fieldUpdate{}, ErrLeaseLost
+		}
+		return finishUpdate(outcome), nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrLeaseLost
+	}
+	return t, err
+}
+
+func (s *SqliteDb) SetProgress(ctx context.Context, id string, progress float64, downloadingModel bool) (*models.Transcription, error) {
+	return s.modify(ctx, id, func(*models.Transcription) (fieldUpdate, error) {
+		return progressUpdate(progress, downloadingModel), nil
+	})
+}
+
+func (s *SqliteDb) SetStatus(ctx context.Context, id string, status int) (*models.Transcription, error) {
+	return s.modify(ctx, id, func(*models.Transcription) (fieldUpdate, error) {
+		return statusUpdate(status), nil
+	})
+}
+
+func (s *SqliteDb) SetError(ctx context.Context, id string, jobErr *models.JobError) (*models.Transcription, error) {
+	return s.modify(ctx, id, func(*models.Transcription) (fieldUpdate, error) {
+		return errorUpdate(jobErr), nil
+	})
+}
+
+func (s *SqliteDb) SetPriority(ctx context.Context, id string, priority int) (*models.Transcription, error) {
+	return s.modify(ctx, id, func(t *models.Transcription) (fieldUpdate, error) {
+		if t.Status != models.TranscriptionStatusPending || t.DeletedAt != nil {
+			return fieldUpdate{}, ErrConflict
+		}
+		return priorityUpdate(priority), nil
+	})
+}
+
+func (s *SqliteDb) SetResult(ctx context.Context, id string, result models.WhisperResult) (*models.Transcription, error) {
+	return s.modify(ctx, id, func(*models.Transcription) (fieldUpdate, error) {
+		return resultUpdate(result), nil
+	})
+}
+
+func (s *SqliteDb) AppendTranslation(ctx context.Context, id string, translation models.Translation) (*models.Transcription, error) {
+	return s.modify(ctx, id, func(t *models.Transcription) (fieldUpdate, error) {
+		return translationAppend(t, translation), nil
+	})
+}
+
+func (s *SqliteDb) RecoverTranscription(ctx context.Context, id string, version int64, status int, jobErr *models.JobError) (*models.Transcription, error) {
+	return s.modify(ctx, id, func(t *models.Transcription) (fieldUpdate, error) {
+		if t.Version != version || t.Status != models.TranscriptionStatusRunning {
+			return fieldUpdate{}, ErrConflict
+		}
+		return recoverUpdate(status, jobErr), nil
+	})
+}
+
+func (s *SqliteDb) CancelTranscription(ctx context.Context, id string) (*models.Transcription, error) {
+	return s.modify(ctx, id, func(t *models.Transcription) (fieldUpdate, error) {
+		if !cancellable(t.Status) {
+			return fieldUpdate{}, ErrNotModified
+		}
+		return cancelUpdate(), nil
+	})
+}
+
+func (s *SqliteDb) Retranscribe(ctx context.Context, t *models.Transcription) (*models.Transcription, error) {
+	return s.modify(ctx, t.ID.Hex(), func(current *models.Transcription) (fieldUpdate, error) {
+		if current.Version != t.Version || !finished(current.Status) {
+			return fieldUpdate{}, ErrConflict
+		}
+		return retranscribeUpdate(t), nil
+	})
+}
+
+func (s *SqliteDb) TrashTranscription(ctx context.Context, id string) (*models.Transcription, error) {
+	return s.modify(ctx, id, func(t *models.Transcription) (fieldUpdate, error) {
+		if t.DeletedAt != nil {
+			return fieldUpdate{}, ErrNotModified
+		}
+		return trashUpdate(writeTime()), nil
+	})
+}
+
+func (s *SqliteDb) RestoreTranscription(ctx context.Context, id string) (*models.Transcription, error) {
+	return s.modify(ctx, id, func(t *models.Transcription) (fieldUpdate, error) {
+		if t.DeletedAt == nil {
+			return fieldUpdate{}, ErrNotModified
+		}
+		return restoreUpdate(), nil
+	})
+}
+
+func (s *SqliteDb) RenameFile(ctx context.Context, id string, fileName string) (*models.Transcription, error) {
+	return s.modify(ctx, id, func(*models.Transcription) (fieldUpdate, error) {
+		return fileNameUpdate(fileName), nil
+	})
+}
+
+func (s *SqliteDb) PatchSegment(ctx context.Context, id string, segment models.Segment) (*models.Transcription, error) {
+	return s.modify(ctx, id, func(t *models.Transcription) (fieldUpdate, error) {
+		return segmentPatch(t, segment)
+	})
+}
+
+// modify applies the update built by change from the current document id,
+// inside a transaction, and returns the updated document.
+func (s *SqliteDb) modify(ctx context.Context, id string, change func(*models.Transcription) (fieldUpdate, error)) (*models.Transcription, error) {
+	oid, err := objectID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var current []byte
+	err = tx.QueryRowContext(ctx, `SELECT doc FROM transcriptions WHERE id = ?`, oid.Hex()).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	t, err := decodeTranscription(current)
+	if err != nil {
+		return nil, err
+	}
+	u, err := change(t)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := s.setFields(ctx, tx, current, u)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return decodeTranscription(merged)
+}
+
+// setFields applies u to the document current inside tx and returns the
+// updated document.
+func (s *SqliteDb) setFields(ctx context.Context, tx *sql.Tx, current []byte, u fieldUpdate) (bson.Raw, error) {
+	merged, err := u.apply(current)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.writeRow(ctx, tx, merged, false, textChanged(current, merged)); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+func sqlWhere(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
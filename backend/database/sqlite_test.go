@@ -0,0 +1,102 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+func TestSqliteReopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "whishper.db")
+	db := newTestSqlite(t, path)
+	tr, err := db.NewTranscription(ctx, &models.Transcription{FileName: "a.mp3", Language: "en"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetSchemaVersion(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	db.db.Close()
+
+	db = newTestSqlite(t, path)
+	got, err := db.GetTranscription(ctx, tr.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FileName != "a.mp3" || got.Language != "en" {
+		t.Errorf("reopened transcription %+v, want the saved one", got)
+	}
+	if v, _ := db.SchemaVersion(ctx); v != 3 {
+		t.Errorf("reopened schema version %v, want 3", v)
+	}
+}
+
+// Databases made by the first version only have the document, and get the
+// derived columns and the search index on startup.
+func TestSqliteUpgrade(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "whishper.db")
+	old, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := primitive.NewObjectID()
+	doc, err := bson.Marshal(&models.Transcription{
+		ID:       id,
+		Status:   models.TranscriptionStatusDone,
+		FileName: "old.mp3",
+		Language: "de",
+		Result:   models.WhisperResult{Text: "guten morgen"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.Exec(`CREATE TABLE transcriptions (seq INTEGER PRIMARY KEY AUTOINCREMENT, id TEXT NOT NULL UNIQUE, status INTEGER NOT NULL, doc BLOB NOT NULL);
+		INSERT INTO transcriptions (id, status, doc) VALUES (?, ?, ?)`, id.Hex(), models.TranscriptionStatusDone, doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+
+	db := newTestSqlite(t, path)
+	page, err := db.ListTranscriptions(ctx, ListOptions{Language: "de"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 1 || page.Items[0].FileName != "old.mp3" {
+		t.Fatalf("listed %+v, want the old transcription", page.Items)
+	}
+	hits, err := db.SearchTranscriptions(ctx, SearchOptions{Query: "morgen"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].TranscriptionID != id.Hex() {
+		t.Errorf("search found %+v, want the old transcription", hits)
+	}
+}
+
+// Status filters use the prefix of the queue index.
+func TestSqliteStatusFilterPlan(t *testing.T) {
+	ctx := context.Background()
+	db := newTestSqlite(t, filepath.Join(t.TempDir(), "whishper.db"))
+	if err := db.EnsureIndexes(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var id, parent, notUsed int
+	var plan string
+	row := db.db.QueryRowContext(ctx, `EXPLAIN QUERY PLAN SELECT id FROM transcriptions WHERE status = ?`, models.TranscriptionStatusPending)
+	if err := row.Scan(&id, &parent, &notUsed, &plan); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(plan, "transcriptions_queue") {
+		t.Errorf("status filter plan %q, want the queue index", plan)
+	}
+}
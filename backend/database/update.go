@@ -0,0 +1,329 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+// ErrSegmentNotFound is returned by PatchSegment when the result has no
+// segment with the given id.
+var ErrSegmentNotFound = errors.New("segment not found")
+
+// fieldUpdate is a narrow update touching only a few top-level fields, the
+// equivalent of a MongoDB {$set: set, $unset: unset}.
+type fieldUpdate struct {
+	set   bson.D
+	unset []string
+}
+
+func (u fieldUpdate) mongo() bson.D {
+	update := bson.D{
+		primitive.E{Key: "$inc", Value: bson.D{primitive.E{Key: "version", Value: 1}}},
+		primitive.E{Key: "$set", Value: append(u.set, primitive.E{Key: "updated_at", Value: writeTime()})},
+	}
+	if len(u.unset) > 0 {
+		unset := bson.D{}
+		for _, key := range u.unset {
+			unset = append(unset, primitive.E{Key: key, Value: ""})
+		}
+		update = append(update, primitive.E{Key: "$unset", Value: unset})
+	}
+	return update
+}
+
+// apply returns current with the update applied and its version incremented.
+func (u fieldUpdate) apply(current bson.Raw) (bson.Raw, error) {
+	set, err := bson.Marshal(append(u.set,
+		primitive.E{Key: "version", Value: docVersion(current) + 1},
+		primitive.E{Key: "updated_at", Value: writeTime()},
+	))
+	if err != nil {
+		return nil, err
+	}
+	merged, err := applySet(current, set)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.unset) == 0 {
+		return merged, nil
+	}
+
+	var doc bson.D
+	if err := bson.Unmarshal(merged, &doc); err != nil {
+		return nil, err
+	}
+	kept := doc[:0]
+	for _, field := range doc {
+		unset := false
+		for _, key := range u.unset {
+			if field.Key == key {
+				unset = true
+				break
+			}
+		}
+		if !unset {
+			kept = append(kept, field)
+		}
+	}
+	return bson.Marshal(kept)
+}
+
+func progressUpdate(progress float64, downloadingModel bool) fieldUpdate {
+	return fieldUpdate{set: bson.D{
+		primitive.E{Key: "progress", Value: progress},
+		primitive.E{Key: "downloading_model", Value: downloadingModel},
+	}}
+}
+
+// statusUpdate sets the status. A job that isn't running anymore has no
+// lease, so the lease fields are removed for any other status.
+func statusUpdate(status int) fieldUpdate {
+	u := fieldUpdate{set: bson.D{primitive.E{Key: "status", Value: status}}}
+	if status != models.TranscriptionStatusRunning {
+		u.unset = []string{"lease_owner", "lease_expires_at"}
+	}
+	return u
+}
+
+// errorUpdate records the failure of the last attempt, or removes it if e is
+// nil.
+func errorUpdate(e *models.JobError) fieldUpdate {
+	if e == nil {
+		return fieldUpdate{unset: []string{"error"}}
+	}
+	return fieldUpdate{set: bson.D{primitive.E{Key: "error", Value: e}}}
+}
+
+// recoverUpdate takes a stale job from its worker and moves it to status,
+// recording why.
+func recoverUpdate(status int, jobErr *models.JobError) fieldUpdate {
+	u := statusUpdate(status)
+	u.set = append(u.set,
+		primitive.E{Key: "downloading_model", Value: false},
+		primitive.E{Key: "error", Value: jobErr},
+	)
+	if status == models.TranscriptionStatusPending {
+		u.set = append(u.set, primitive.E{Key: "progress", Value: 0.0})
+	}
+	return u
+}
+
+// cancelUpdate stops a pending or running job.
+func cancelUpdate() fieldUpdate {
+	u := statusUpdate(models.TranscriptionStatusCancelled)
+	u.set = append(u.set, primitive.E{Key: "downloading_model", Value: false})
+	return u
+}
+
+// cancellable reports whether a job with status can be cancelled.
+func cancellable(status int) bool {
+	return status == models.TranscriptionStatusPending || status == models.TranscriptionStatusRunning ||
+		status == models.TranscriptionStatusScheduled
+}
+
+// retranscribeUpdate queues a finished job again with the job parameters and
+// audio preprocessing of t. The result, translations and error of the
+// previous run are dropped.
+func retranscribeUpdate(t *models.Transcription) fieldUpdate {
+	u := statusUpdate(models.TranscriptionStatusPending)
+	u.set = append(u.set,
+		primitive.E{Key: "language", Value: t.Language},
+		primitive.E{Key: "modelSize", Value: t.ModelSize},
+		primitive.E{Key: "beam_size", Value: t.BeamSize},
+		primitive.E{Key: "initial_prompt", Value: t.InitialPrompt},
+		primitive.E{Key: "hotwords", Value: t.Hotwords},
+		primitive.E{Key: "vad_filter", Value: t.VadFilter},
+		primitive.E{Key: "normalize", Value: t.Normalize},
+		primitive.E{Key: "audio_filter", Value: t.AudioFilter},
+		primitive.E{Key: "result", Value: models.WhisperResult{}},
+		primitive.E{Key: "translations", Value: []models.Translation{}},
+	)
+	u.unset = append(u.unset, "words_count", "progress", "downloading_model", "error", "not_before")
+	optional := []struct {
+		key   string
+		value interface{}
+		set   bool
+	}{
+		{"vad_threshold", t.VadThreshold, t.VadThreshold != nil},
+		{"vad_min_speech_duration_ms", t.VadMinSpeechDurationMS, t.VadMinSpeechDurationMS != nil},
+		{"vad_min_silence_duration_ms", t.VadMinSilenceDurationMS, t.VadMinSilenceDurationMS != nil},
+	}
+	for _, field := range optional {
+		if field.set {
+			u.set = append(u.set, primitive.E{Key: field.key, Value: field.value})
+		} else {
+			u.unset = append(u.unset, field.key)
+		}
+	}
+	return u
+}
+
+// finished reports whether a job with status is over, so it can be run again.
+func finished(status int) bool {
+	return status == models.TranscriptionStatusDone || status == models.TranscriptionStatusError ||
+		status == models.TranscriptionStatusCancelled
+}
+
+// releaseUpdate queues a scheduled job whose time has come.
+func releaseUpdate() fieldUpdate {
+	return statusUpdate(models.TranscriptionStatusPending)
+}
+
+func resultUpdate(result models.WhisperResult) fieldUpdate {
+	return fieldUpdate{set: bson.D{
+		primitive.E{Key: "result", Value: result},
+		primitive.E{Key: "words_count", Value: result.WordsCount()},
+	}}
+}
+
+// trashUpdate moves a transcription to the trash at the given time.
+func trashUpdate(at time.Time) fieldUpdate {
+	return fieldUpdate{set: bson.D{primitive.E{Key: "deleted_at", Value: at}}}
+}
+
+func restoreUpdate() fieldUpdate {
+	return fieldUpdate{unset: []string{"deleted_at"}}
+}
+
+func priorityUpdate(priority int) fieldUpdate {
+	return fieldUpdate{set: bson.D{primitive.E{Key: "priority", Value: priority}}}
+}
+
+func fileNameUpdate(fileName string) fieldUpdate {
+	return fieldUpdate{set: bson.D{primitive.E{Key: "fileName", Value: fileName}}}
+}
+
+// translationAppend adds translation to the translations of t. It is used by
+// the backends that rewrite the whole array instead of pushing to it.
+func translationAppend(t *models.Transcription, translation models.Translation) fieldUpdate {
+	translations := make([]models.Translation, 0, len(t.Translations)+1)
+	translations = append(translations, t.Translations...)
+	translations = append(translations, translation)
+	return fieldUpdate{set: bson.D{primitive.E{Key: "translations", Value: translations}}}
+}
+
+// segmentPatch replaces the segment of t with the same id as segment, and
+// the result text and words count with the ones of the edited segments.
+func segmentPatch(t *models.Transcription, segment models.Segment) (fieldUpdate, error) {
+	result := t.Result
+	result.Segments = make([]models.Segment, len(t.Result.Segments))
+	copy(result.Segments, t.Result.Segments)
+	for i := range result.Segments {
+		if result.Segments[i].ID == segment.ID {
+			result.Segments[i] = segment
+			result.Text = result.SegmentsText()
+			return resultUpdate(result), nil
+		}
+	}
+	return fieldUpdate{}, ErrSegmentNotFound
+}
+
+// replaceUpdate returns current with every field of t set, for a full
+// update of t. It returns ErrConflict if current isn't at t.Version anymore
+// and ErrNotModified if t changes nothing. On success, t.Version is
+// incremented to the version of the returned document.
+func replaceUpdate(current bson.Raw, t *models.Transcription) (bson.Raw, error) {
+	if docVersion(current) != t.Version {
+		return nil, ErrConflict
+	}
+	update, err := bson.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := applySet(current, update)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(current, merged) {
+		return nil, ErrNotModified
+	}
+
+	next := *t
+	next.Version++
+	next.UpdatedAt = writeTime()
+	if update, err = bson.Marshal(&next); err != nil {
+		return nil, err
+	}
+	if merged, err = applySet(current, update); err != nil {
+		return nil, err
+	}
+	t.Version = next.Version
+	t.UpdatedAt = next.UpdatedAt
+	return merged, nil
+}
+
+// prepareNew fills in the version and timestamps of a transcription about to
+// be inserted. Copies keep the ones they already have.
+func prepareNew(t *models.Transcription) {
+	if t.Version == 0 {
+		t.Version = 1
+	}
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = writeTime()
+	}
+	if t.UpdatedAt.IsZero() {
+		t.UpdatedAt = t.CreatedAt
+	}
+}
+
+// writeTime is the time stamped on a write, at the precision BSON keeps.
+func writeTime() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// docVersion returns the version of doc, 0 for documents written before
+// versions existed.
+func docVersion(doc bson.Raw) int64 {
+	v, err := doc.LookupErr("version")
+	if err != nil {
+		return 0
+	}
+	if n, ok := v.AsInt64OK(); ok {
+		return n
+	}
+	if n, ok := v.Int32OK(); ok {
+		return int64(n)
+	}
+	return 0
+}
+
+// versionFilter matches the documents at version. Version 0 also matches the
+// documents written before versions existed.
+func versionFilter(version int64) primitive.E {
+	if version == 0 {
+		return primitive.E{Key: "version", Value: bson.D{primitive.E{Key: "$in", Value: bson.A{0, nil}}}}
+	}
+	return primitive.E{Key: "version", Value: version}
+}
+
+// applySet returns current with every top-level field of update replaced or
+// appended, which is what a MongoDB {$set: update} does to a document.
+func applySet(current, update bson.Raw) (bson.Raw, error) {
+	var doc, set bson.D
+	if err := bson.Unmarshal(current, &doc); err != nil {
+		return nil, err
+	}
+	if err := bson.Unmarshal(update, &set); err != nil {
+		return nil, err
+	}
+	for _, field := range set {
+		replaced := false
+		for i := range doc {
+			if doc[i].Key == field.Key {
+				doc[i].Value = field.Value
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			doc = append(doc, field)
+		}
+	}
+	return bson.Marshal(doc)
+}
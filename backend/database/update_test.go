@@ -0,0 +1,221 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+func TestFieldUpdateApply(t *testing.T) {
+	current, err := bson.Marshal(bson.D{
+		primitive.E{Key: "_id", Value: primitive.NewObjectID()},
+		primitive.E{Key: "status", Value: 1},
+		primitive.E{Key: "lease_owner", Value: "w1"},
+		primitive.E{Key: "version", Value: int64(4)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err := fieldUpdate{
+		set:   bson.D{primitive.E{Key: "status", Value: 2}, primitive.E{Key: "progress", Value: 1.0}},
+		unset: []string{"lease_owner", "missing"},
+	}.apply(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := merged.Lookup("status").Int32(); v != 2 {
+		t.Errorf("status %v, want 2", v)
+	}
+	if v := merged.Lookup("progress").Double(); v != 1 {
+		t.Errorf("progress %v, want 1", v)
+	}
+	if _, err := merged.LookupErr("lease_owner"); err == nil {
+		t.Error("lease_owner wasn't unset")
+	}
+	if v := docVersion(merged); v != 5 {
+		t.Errorf("version %v, want 5", v)
+	}
+	if _, ok := merged.Lookup("updated_at").TimeOK(); !ok {
+		t.Error("updated_at wasn't set")
+	}
+}
+
+// Narrow updates only write their own fields, so writers working from the
+// same read don't undo each other.
+func TestNarrowUpdates(t *testing.T) {
+	jobErr := &models.JobError{Stage: models.ErrorStageTranscribe, Message: "boom", Attempts: 1}
+	tests := []struct {
+		name   string
+		update func(ctx context.Context, db Db, id string) (*models.Transcription, error)
+		check  func(t *models.Transcription) bool
+	}{
+		{
+			name: "progress",
+			update: func(ctx context.Context, db Db, id string) (*models.Transcription, error) {
+				return db.SetProgress(ctx, id, 0.5, true)
+			},
+			check: func(t *models.Transcription) bool { return t.Progress == 0.5 && t.DownloadingModel },
+		},
+		{
+			name: "error",
+			update: func(ctx context.Context, db Db, id string) (*models.Transcription, error) {
+				return db.SetError(ctx, id, jobErr)
+			},
+			check: func(t *models.Transcription) bool { return t.Error != nil && t.Error.Message == "boom" },
+		},
+		{
+			name: "priority",
+			update: func(ctx context.Context, db Db, id string) (*models.Transcription, error) {
+				return db.SetPriority(ctx, id, 7)
+			},
+			check: func(t *models.Transcription) bool { return t.Priority == 7 },
+		},
+		{
+			name: "file name",
+			update: func(ctx context.Context, db Db, id string) (*models.Transcription, error) {
+				return db.RenameFile(ctx, id, "b.mp3")
+			},
+			check: func(t *models.Transcription) bool { return t.FileName == "b.mp3" },
+		},
+		{
+			name: "translation",
+			update: func(ctx context.Context, db Db, id string) (*models.Transcription, error) {
+				return db.AppendTranslation(ctx, id, models.Translation{TargetLanguage: "es", Result: models.WhisperResult{Text: "hola"}})
+			},
+			check: func(t *models.Transcription) bool {
+				return len(t.Translations) == 1 && t.Translations[0].Result.Text == "hola"
+			},
+		},
+		{
+			name: "result",
+			update: func(ctx context.Context, db Db, id string) (*models.Transcription, error) {
+				return db.SetResult(ctx, id, models.WhisperResult{Text: "one two three"})
+			},
+			check: func(t *models.Transcription) bool { return t.Result.Text == "one two three" && t.WordsCount == 3 },
+		},
+		{
+			name: "clear error",
+			update: func(ctx context.Context, db Db, id string) (*models.Transcription, error) {
+				return db.SetError(ctx, id, nil)
+			},
+			check: func(t *models.Transcription) bool { return t.Error == nil },
+		},
+	}
+
+	forEachBackend(t, func(t *testing.T, db Db) {
+		ctx := context.Background()
+		tr, err := db.NewTranscription(ctx, &models.Transcription{FileName: "a.mp3", Language: "en"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := tr.ID.Hex()
+		version := tr.Version
+		for i, tt := range tests {
+			updated, err := tt.update(ctx, db, id)
+			if err != nil {
+				t.Fatalf("%v: %v", tt.name, err)
+			}
+			if updated.Version != version+1 {
+				t.Errorf("%v: version %v, want %v", tt.name, updated.Version, version+1)
+			}
+			version = updated.Version
+
+			got, err := db.GetTranscription(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Language != "en" {
+				t.Errorf("%v: language %q was overwritten", tt.name, got.Language)
+			}
+			// Every earlier update is still there, except the error that
+			// was cleared last.
+			for _, earlier := range tests[:i+1] {
+				if earlier.name == "error" && tt.name == "clear error" {
+					continue
+				}
+				if !earlier.check(got) {
+					t.Errorf("after the %v update, the %v update was lost: %+v", tt.name, earlier.name, got)
+				}
+			}
+		}
+	})
+}
+
+// Only pending transcriptions change priority, so that a job claimed or
+// trashed meanwhile isn't written.
+func TestSetPriorityQueued(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Db) {
+		ctx := context.Background()
+		newJob := func(status int, trashed bool) *models.Transcription {
+			tr, err := db.NewTranscription(ctx, &models.Transcription{Status: status})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if trashed {
+				if tr, err = db.TrashTranscription(ctx, tr.ID.Hex()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return tr
+		}
+		for _, tt := range []struct {
+			name string
+			job  *models.Transcription
+			want error
+		}{
+			{"pending", newJob(models.TranscriptionStatusPending, false), nil},
+			{"running", newJob(models.TranscriptionStatusRunning, false), ErrConflict},
+			{"scheduled", newJob(models.TranscriptionStatusScheduled, false), ErrConflict},
+			{"trashed", newJob(models.TranscriptionStatusPending, true), ErrConflict},
+			{"missing", &models.Transcription{ID: primitive.NewObjectID()}, ErrNotFound},
+		} {
+			_, err := db.SetPriority(ctx, tt.job.ID.Hex(), 3)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("%v: got error %v, want %v", tt.name, err, tt.want)
+			}
+			if tt.want != ErrConflict {
+				continue
+			}
+			got, err := db.GetTranscription(ctx, tt.job.ID.Hex())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Priority != 0 || got.Version != tt.job.Version {
+				t.Errorf("%v: written, with priority %v", tt.name, got.Priority)
+			}
+		}
+	})
+}
+
+func TestStatusDropsLease(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Db) {
+		ctx := context.Background()
+		tr, err := db.NewTranscription(ctx, &models.Transcription{Status: models.TranscriptionStatusPending})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.ClaimNextPending(ctx, ClaimRequest{WorkerID: "w1", Lease: time.Minute}); err != nil {
+			t.Fatal(err)
+		}
+		got, err := db.SetStatus(ctx, tr.ID.Hex(), models.TranscriptionStatusRunning)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.LeaseOwner != "w1" || got.LeaseExpiresAt == nil {
+			t.Errorf("running job lost its lease: %q until %v", got.LeaseOwner, got.LeaseExpiresAt)
+		}
+		got, err = db.SetStatus(ctx, tr.ID.Hex(), models.TranscriptionStatusDone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.LeaseOwner != "" || got.LeaseExpiresAt != nil {
+			t.Errorf("done job kept its lease: %q until %v", got.LeaseOwner, got.LeaseExpiresAt)
+		}
+	})
+}
@@ -0,0 +1,92 @@
+// Package events carries transcription updates to the websocket clients of
+// every backend instance.
+package events
+
+import (
+	"context"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+// Bus delivers the transcription updates published by any instance to the
+// subscribers of every instance.
+type Bus interface {
+	// Publish announces an update written by this instance.
+	Publish(ctx context.Context, t *models.Transcription) error
+	// Subscribe returns the updates published from now on, until ctx is
+	// done; the channel is closed then.
+	Subscribe(ctx context.Context) (<-chan *models.Transcription, error)
+}
+
+// subscriberBuffer is how many updates a subscriber can lag behind before
+// publishers wait for it.
+const subscriberBuffer = 64
+
+// Local is the in-process Bus, for a single backend instance.
+type Local struct {
+	mu          sync.RWMutex
+	subscribers map[chan *models.Transcription]context.Context
+}
+
+func NewLocal() *Local {
+	return &Local{subscribers: make(map[chan *models.Transcription]context.Context)}
+}
+
+func (l *Local) Publish(ctx context.Context, t *models.Transcription) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for ch, subCtx := range l.subscribers {
+		select {
+		case ch <- t:
+		case <-subCtx.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (l *Local) Subscribe(ctx context.Context) (<-chan *models.Transcription, error) {
+	ch := make(chan *models.Transcription, subscriberBuffer)
+	l.mu.Lock()
+	l.subscribers[ch] = ctx
+	l.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		l.mu.Lock()
+		delete(l.subscribers, ch)
+		l.mu.Unlock()
+		close(ch)
+	}()
+	return ch, nil
+}
+
+// Watcher is implemented by the databases that can stream the transcriptions
+// written by every instance.
+type Watcher interface {
+	WatchTranscriptions(ctx context.Context) (<-chan *models.Transcription, error)
+}
+
+// ChangeFeed is a Bus built on the change feed of the database, so that the
+// updates written by any instance sharing it reach every subscriber. Every
+// write is delivered, so publishing does nothing.
+type ChangeFeed struct {
+	watcher Watcher
+}
+
+func NewChangeFeed(w Watcher) *ChangeFeed {
+	return &ChangeFeed{watcher: w}
+}
+
+func (f *ChangeFeed) Publish(ctx context.Context, t *models.Transcription) error {
+	return nil
+}
+
+func (f *ChangeFeed) Subscribe(ctx context.Context) (<-chan *models.Transcription, error) {
+	log.Debug().Msg("Subscribing to the database change feed")
+	return f.watcher.WatchTranscriptions(ctx)
+}
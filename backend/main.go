@@ -1,16 +1,25 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
 	"codeberg.org/pluja/whishper/api"
+	"codeberg.org/pluja/whishper/asr"
+	"codeberg.org/pluja/whishper/backup"
 	"codeberg.org/pluja/whishper/database"
+	"codeberg.org/pluja/whishper/events"
+	"codeberg.org/pluja/whishper/migrations"
 	"codeberg.org/pluja/whishper/monitor"
+	"codeberg.org/pluja/whishper/utils"
 )
 
 func main() {
@@ -21,11 +30,34 @@ func main() {
 	listenAddr := flag.String("addr", ":8080", "server listen address")
 	uploadDir := flag.String("updir", "/app/uploads", "upload directory")
 	asrEndpoint := flag.String("asr", "127.0.0.1:8000", "asr endpoint, i.e. localhost:9888")
+	asrEndpoints := flag.String("asrendpoints", "", "asr endpoints with their capabilities, separated by semicolons, i.e. gpu:8000 devices=cuda maxmodel=large-v3 concurrency=1; cpu:8000 devices=cpu maxmodel=small. Overrides -asr")
 	dbHost := flag.String("db", "mongo:27017", "database endpoint host, i.e. localhost:27017")
+	dbDriver := flag.String("dbdriver", "mongo", "database driver, one of: mongo, sqlite, memory")
+	dbPath := flag.String("dbpath", "", "database file for the sqlite driver, or snapshot file for the memory driver, i.e. /app/uploads/whishper.db")
 	dbUser := flag.String("dbuser", "root", "database user")
 	dbPass := flag.String("dbpass", "example", "database password")
 	translationEndpoint := flag.String("translation", "translate:5000", "translation endpoint, i.e. localhost:5000")
+	bus := flag.String("bus", "local", "how updates reach the websocket clients, one of: local (this instance only), changefeed (every instance, needs a MongoDB replica set)")
+	trashRetention := flag.String("trashretention", "720h", "how long deleted transcriptions stay in the trash before they are purged, 0 to keep them until the trash is emptied")
+	workers := flag.Int("workers", 1, "how many transcriptions this instance runs at once")
+	deviceLimits := flag.String("devicelimits", "", "how many transcriptions run at once on each device, i.e. cuda=1,cpu=2")
+	modelLimits := flag.String("modellimits", "", "how many transcriptions run at once with each model size, i.e. large-v3=1")
+	retries := flag.Int("retries", 3, "how many times a transcription failing with a transient error, like an unreachable ASR service, is retried")
+	stalePolicy := flag.String("stalepolicy", "requeue", "what happens to running transcriptions whose worker stopped renewing their lease, one of: requeue (while retries are left), fail")
+	preprocess := flag.Bool("preprocess", true, "extract the audio of the media with ffmpeg and send only that to the asr service")
+	cacheDir := flag.String("cachedir", "", "directory the extracted audio is cached in, outside of the upload directory, which is served. Defaults to a folder of the system temporary directory")
+	noMigrate := flag.Bool("nomigrate", false, "don't run the database migrations on startup, use the migrate command instead")
 	dev := flag.Bool("dev", false, "development mode")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [flags] [command]\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Commands:\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  migrate\t\tapply the pending database migrations and exit\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  migrate-from-mongo\tcopy every transcription from MongoDB (-db, -dbuser, -dbpass) into the -dbdriver database and exit\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  export <file>\t\twrite every transcription, revision and media file to a backup archive, - for stdout\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  import <file>\t\trestore a backup archive, - for stdin\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Flags:\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	// Set environment variables
@@ -35,27 +67,66 @@ func main() {
 	if os.Getenv("ASR_ENDPOINT") == "" {
 		os.Setenv("ASR_ENDPOINT", *asrEndpoint)
 	}
+	if os.Getenv("ASR_ENDPOINTS") == "" {
+		os.Setenv("ASR_ENDPOINTS", *asrEndpoints)
+	}
 	if os.Getenv("TRANSLATION_ENDPOINT") == "" {
 		os.Setenv("TRANSLATION_ENDPOINT", *translationEndpoint)
 	}
 	if os.Getenv("DB_ENDPOINT") == "" {
 		os.Setenv("DB_ENDPOINT", *dbHost)
 	}
+	if os.Getenv("DB_DRIVER") == "" {
+		os.Setenv("DB_DRIVER", *dbDriver)
+	}
+	if os.Getenv("DB_PATH") == "" {
+		os.Setenv("DB_PATH", *dbPath)
+	}
 	if os.Getenv("DB_USER") == "" {
 		os.Setenv("DB_USER", *dbUser)
 	}
 	if os.Getenv("DB_PASS") == "" {
 		os.Setenv("DB_PASS", *dbPass)
 	}
-	if os.Getenv("DEV_MODE") == "" { 
-    	os.Setenv("DEV_MODE", strconv.FormatBool(*dev))
+	if os.Getenv("EVENT_BUS") == "" {
+		os.Setenv("EVENT_BUS", *bus)
+	}
+	if os.Getenv("TRASH_RETENTION") == "" {
+		os.Setenv("TRASH_RETENTION", *trashRetention)
+	}
+	if os.Getenv("WORKERS") == "" {
+		os.Setenv("WORKERS", strconv.Itoa(*workers))
+	}
+	if os.Getenv("DEVICE_LIMITS") == "" {
+		os.Setenv("DEVICE_LIMITS", *deviceLimits)
+	}
+	if os.Getenv("MODEL_LIMITS") == "" {
+		os.Setenv("MODEL_LIMITS", *modelLimits)
+	}
+	if os.Getenv("MAX_RETRIES") == "" {
+		os.Setenv("MAX_RETRIES", strconv.Itoa(*retries))
+	}
+	if os.Getenv("STALE_POLICY") == "" {
+		os.Setenv("STALE_POLICY", *stalePolicy)
+	}
+	if os.Getenv("PREPROCESS") == "" {
+		os.Setenv("PREPROCESS", strconv.FormatBool(*preprocess))
+	}
+	if os.Getenv("CACHE_DIR") == "" {
+		os.Setenv("CACHE_DIR", *cacheDir)
+	}
+	if os.Getenv("NO_MIGRATE") == "" {
+		os.Setenv("NO_MIGRATE", strconv.FormatBool(*noMigrate))
+	}
+	if os.Getenv("DEV_MODE") == "" {
+		os.Setenv("DEV_MODE", strconv.FormatBool(*dev))
 	}
 
-	// Configure dev mode
+	// Configure dev mode. Logs go to stderr, stdout may carry an export.
 	if os.Getenv("DEV_MODE") == "true" {
 		log.Logger = log.Output(
 			zerolog.ConsoleWriter{
-				Out:        os.Stdout,
+				Out:        os.Stderr,
 				TimeFormat: "15:04:05",
 			},
 		).With().Caller().Logger()
@@ -68,10 +139,252 @@ func main() {
 	log.Debug().Msgf("AsrEndpoint: %v", *asrEndpoint)
 	log.Debug().Msgf("TranslationEndpoint: %v", *translationEndpoint)
 	log.Debug().Msgf("DbHost: %v", *dbHost)
+	log.Debug().Msgf("DbDriver: %v", os.Getenv("DB_DRIVER"))
 
-	dabs := database.NewMongoDb()
-	server := api.NewServer(*listenAddr, dabs)
-	go monitor.StartMonitor(server)
+	retention, err := time.ParseDuration(os.Getenv("TRASH_RETENTION"))
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Invalid trash retention %q, use a duration like 720h", os.Getenv("TRASH_RETENTION"))
+	}
+
+	dabs, err := openDatabase(os.Getenv("DB_DRIVER"))
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error opening the %v database", os.Getenv("DB_DRIVER"))
+	}
+
+	switch flag.Arg(0) {
+	case "":
+		if os.Getenv("NO_MIGRATE") != "true" {
+			runMigrations(dabs)
+		} else if pending, err := migrations.Pending(context.Background(), dabs); err == nil && len(pending) > 0 {
+			log.Warn().Msgf("%v database migrations are pending, run the migrate command", len(pending))
+		}
+		ensureIndexes(dabs)
+		dropServedCache()
+	case "migrate":
+		runMigrations(dabs)
+		return
+	case "migrate-from-mongo":
+		migrateFromMongo(dabs)
+		return
+	case "export":
+		exportBackup(dabs, flag.Arg(1))
+		return
+	case "import":
+		importBackup(dabs, flag.Arg(1))
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	eventBus, err := openBus(os.Getenv("EVENT_BUS"), dabs)
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error opening the %v event bus", os.Getenv("EVENT_BUS"))
+	}
+
+	router := asr.NewRouter(asrEndpointList())
+	router.StartHealthChecks()
+	server := api.NewServer(*listenAddr, dabs, eventBus, router)
+	limits := monitorLimits()
+	monitor.StartRecovery(server, staleJobPolicy(), limits.Retries)
+	monitor.StartMonitor(server, limits)
+	monitor.StartScheduler(server)
+	monitor.StartPurger(server, retention)
 	server.NewTranscriptionCh <- true
 	server.Run()
 }
+
+// monitorLimits reads the worker pool limits set with -workers, -devicelimits,
+// -modellimits and -retries.
+func monitorLimits() monitor.Limits {
+	workers, err := strconv.Atoi(os.Getenv("WORKERS"))
+	if err != nil || workers < 1 {
+		log.Fatal().Msgf("Invalid number of workers %q, use a number of at least 1", os.Getenv("WORKERS"))
+	}
+	devices, err := monitor.ParseLimits(os.Getenv("DEVICE_LIMITS"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid device limits")
+	}
+	modelSizes, err := monitor.ParseLimits(os.Getenv("MODEL_LIMITS"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid model limits")
+	}
+	retries, err := strconv.Atoi(os.Getenv("MAX_RETRIES"))
+	if err != nil || retries < 0 {
+		log.Fatal().Msgf("Invalid number of retries %q, use a number of at least 0", os.Getenv("MAX_RETRIES"))
+	}
+	return monitor.Limits{Workers: workers, Devices: devices, ModelSizes: modelSizes, Retries: retries}
+}
+
+// staleJobPolicy reads the policy for stale jobs set with -stalepolicy.
+func staleJobPolicy() monitor.StalePolicy {
+	policy := monitor.StalePolicy(os.Getenv("STALE_POLICY"))
+	if policy != monitor.StaleRequeue && policy != monitor.StaleFail {
+		log.Fatal().Msgf("Invalid stale job policy %q, use requeue or fail", policy)
+	}
+	return policy
+}
+
+// asrEndpointList reads the transcription services set with -asrendpoints,
+// or the single one set with -asr when there's no list.
+func asrEndpointList() []asr.Endpoint {
+	spec := os.Getenv("ASR_ENDPOINTS")
+	if spec == "" {
+		return []asr.Endpoint{{Address: os.Getenv("ASR_ENDPOINT")}}
+	}
+	endpoints, err := asr.ParseEndpoints(spec)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid ASR endpoints")
+	}
+	for _, e := range endpoints {
+		log.Info().Msgf("ASR endpoint %v: devices %v, max model %q, concurrency %v", e.Address, e.Devices, e.MaxModel, e.Concurrency)
+	}
+	return endpoints
+}
+
+// openDatabase returns the Db implementation selected with -dbdriver.
+func openDatabase(driver string) (database.Db, error) {
+	switch driver {
+	case "mongo":
+		return database.NewMongoDb(), nil
+	case "sqlite":
+		path := os.Getenv("DB_PATH")
+		if path == "" {
+			path = filepath.Join(os.Getenv("UPLOAD_DIR"), "whishper.db")
+		}
+		return database.NewSqliteDb(path)
+	case "memory":
+		return database.NewMemoryDb(os.Getenv("DB_PATH"))
+	}
+	return nil, fmt.Errorf("unknown database driver %v", driver)
+}
+
+// openBus returns the events.Bus selected with -bus.
+func openBus(kind string, db database.Db) (events.Bus, error) {
+	switch kind {
+	case "local":
+		return events.NewLocal(), nil
+	case "changefeed":
+		watcher, ok := db.(events.Watcher)
+		if !ok {
+			return nil, fmt.Errorf("the %v database has no change feed", os.Getenv("DB_DRIVER"))
+		}
+		return events.NewChangeFeed(watcher), nil
+	}
+	return nil, fmt.Errorf("unknown event bus %v", kind)
+}
+
+// runMigrations brings the database schema up to date.
+func runMigrations(db database.Db) {
+	applied, err := migrations.Run(context.Background(), db)
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Database migrations stopped after %v migrations", applied)
+	}
+	if applied > 0 {
+		log.Info().Msgf("Applied %v database migrations, schema version is %v", applied, migrations.Latest())
+	}
+}
+
+// ensureIndexes creates the indexes the database queries rely on. Queries
+// still work without them, only slower, so failures are only logged.
+func ensureIndexes(db database.Db) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	start := time.Now()
+	if err := db.EnsureIndexes(ctx); err != nil {
+		log.Warn().Err(err).Msg("Error creating the database indexes, queries may be slow")
+		return
+	}
+	log.Debug().Msgf("Database indexes ensured in %v", time.Since(start))
+}
+
+// dropServedCache deletes the audio cache older versions kept in the upload
+// directory, where /api/video served it to anyone.
+func dropServedCache() {
+	dir := filepath.Join(os.Getenv("UPLOAD_DIR"), ".preprocessed")
+	if _, err := os.Stat(dir); err != nil {
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Warn().Err(err).Msgf("Error deleting the old audio cache %v", dir)
+		return
+	}
+	log.Info().Msgf("Deleted the old audio cache %v, the audio is now cached in %v", dir, utils.PreprocessedDir())
+}
+
+// migrateFromMongo copies every transcription stored in MongoDB into dst.
+func migrateFromMongo(dst database.Db) {
+	if os.Getenv("DB_DRIVER") == "mongo" {
+		log.Fatal().Msg("The target database is MongoDB already, select another one with -dbdriver")
+	}
+	log.Info().Msgf("Copying transcriptions from mongodb://%v into the %v database...", os.Getenv("DB_ENDPOINT"), os.Getenv("DB_DRIVER"))
+	copied, skipped, err := database.CopyTranscriptions(context.Background(), dst, database.NewMongoDb())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Migration stopped after copying %v transcriptions", copied)
+	}
+	log.Info().Msgf("Migration done: %v transcriptions copied, %v already present", copied, skipped)
+}
+
+// exportBackup writes a backup archive to path, or to stdout if path is "-".
+func exportBackup(db database.Db, path string) {
+	if path == "" {
+		log.Fatal().Msg("Give the archive to write, i.e. export whishper-backup.tar.gz")
+	}
+	stats, err := writeBackup(db, path)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Export failed")
+	}
+	log.Info().Msgf("Exported %v transcriptions, %v revisions and %v media files", stats.Transcriptions, stats.Revisions, stats.Media)
+	if stats.MissingMedia > 0 {
+		log.Warn().Msgf("%v transcriptions were exported without their media, which was missing", stats.MissingMedia)
+	}
+}
+
+// writeBackup writes the archive for exportBackup. It returns its errors
+// instead of exiting, so that the temporary file is always removed.
+func writeBackup(db database.Db, path string) (backup.Stats, error) {
+	if path == "-" {
+		return backup.Export(context.Background(), db, os.Getenv("UPLOAD_DIR"), os.Stdout)
+	}
+	// Written next to the target and renamed once complete.
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return backup.Stats{}, fmt.Errorf("creating %v: %w", path, err)
+	}
+	defer os.Remove(f.Name())
+	stats, err := backup.Export(context.Background(), db, os.Getenv("UPLOAD_DIR"), f)
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("writing %v: %w", path, cerr)
+	}
+	if err != nil {
+		return stats, err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return stats, fmt.Errorf("writing %v: %w", path, err)
+	}
+	return stats, nil
+}
+
+// importBackup restores the backup archive at path, or from stdin if path is
+// "-".
+func importBackup(db database.Db, path string) {
+	if path == "" {
+		log.Fatal().Msg("Give the archive to import, i.e. import whishper-backup.tar.gz")
+	}
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Error opening %v", path)
+		}
+		defer f.Close()
+		in = f
+	}
+	// The imported documents must fit the current schema.
+	runMigrations(db)
+	stats, err := backup.Import(context.Background(), db, os.Getenv("UPLOAD_DIR"), in)
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Import stopped after %v transcriptions", stats.Transcriptions)
+	}
+	log.Info().Msgf("Imported %v transcriptions, %v revisions and %v media files", stats.Transcriptions, stats.Revisions, stats.Media)
+}
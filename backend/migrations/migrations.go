@@ -0,0 +1,152 @@
+// Package migrations upgrades the data stored by older versions. Every
+// migration has a version; the database records the last one applied, so
+// each migration runs once, in order.
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+
+	"codeberg.org/pluja/whishper/database"
+	"codeberg.org/pluja/whishper/models"
+)
+
+// Migration is one step of the schema history. Up must be idempotent:
+// replicas starting together may run it at the same time, and the memory
+// database runs every migration again after a restart.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, db database.Db) error
+}
+
+// All is the ordered list of migrations. New migrations are appended with
+// the next version; released ones are never changed.
+var All = []Migration{
+	{1, "create indexes", createIndexes},
+	{2, "backfill words_count", backfillWordsCount},
+	{3, "add created_at and updated_at", addTimestamps},
+	{4, "move segments out of the transcription documents", moveSegmentsOut},
+	{5, "create revision indexes", createIndexes},
+}
+
+// Latest returns the version of the last migration.
+func Latest() int {
+	return All[len(All)-1].Version
+}
+
+// Pending returns the migrations not applied to db yet.
+func Pending(ctx context.Context, db database.Db) ([]Migration, error) {
+	current, err := db.SchemaVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current > Latest() {
+		return nil, fmt.Errorf("the database schema version %v is newer than this build (%v)", current, Latest())
+	}
+	var pending []Migration
+	for _, m := range All {
+		if m.Version > current {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Run applies the pending migrations in order, recording the version after
+// each one. It stops at the first error and returns how many were applied.
+func Run(ctx context.Context, db database.Db) (int, error) {
+	pending, err := Pending(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	for i, m := range pending {
+		log.Info().Msgf("Running migration %v: %v", m.Version, m.Name)
+		if err := m.Up(ctx, db); err != nil {
+			return i, fmt.Errorf("migration %v (%v): %w", m.Version, m.Name, err)
+		}
+		if err := db.SetSchemaVersion(ctx, m.Version); err != nil {
+			return i, err
+		}
+	}
+	return len(pending), nil
+}
+
+func createIndexes(ctx context.Context, db database.Db) error {
+	return db.EnsureIndexes(ctx)
+}
+
+// backfillWordsCount stores the words count of the results saved before it
+// was computed on write.
+func backfillWordsCount(ctx context.Context, db database.Db) error {
+	_, err := updateEach(ctx, db, func(t *models.Transcription) bool {
+		if t.WordsCount != 0 || t.Result.Text == "" {
+			return false
+		}
+		t.WordsCount = t.Result.WordsCount()
+		return true
+	})
+	return err
+}
+
+// addTimestamps dates the transcriptions created before they had timestamps
+// with the creation time held in their id.
+func addTimestamps(ctx context.Context, db database.Db) error {
+	_, err := updateEach(ctx, db, func(t *models.Transcription) bool {
+		if !t.CreatedAt.IsZero() {
+			return false
+		}
+		t.CreatedAt = t.ID.Timestamp().UTC()
+		return true
+	})
+	return err
+}
+
+// segmentsMover is implemented by the databases that keep the segments apart
+// from the transcription documents.
+type segmentsMover interface {
+	MoveSegmentsOut(ctx context.Context) (int, error)
+}
+
+func moveSegmentsOut(ctx context.Context, db database.Db) error {
+	mover, ok := db.(segmentsMover)
+	if !ok {
+		return nil
+	}
+	// The segments collection needs its index, which came with this
+	// migration.
+	if err := db.EnsureIndexes(ctx); err != nil {
+		return err
+	}
+	moved, err := mover.MoveSegmentsOut(ctx)
+	log.Info().Msgf("Moved the segments of %v transcriptions", moved)
+	return err
+}
+
+// updateEach saves every transcription changed by change, and returns how
+// many were written. Those change leaves as they were don't count.
+func updateEach(ctx context.Context, db database.Db, change func(t *models.Transcription) bool) (int, error) {
+	transcriptions, err := db.GetAllTranscriptions(ctx)
+	if err != nil {
+		return 0, err
+	}
+	updated := 0
+	for _, t := range transcriptions {
+		if !change(t) {
+			continue
+		}
+		_, err := db.UpdateTranscription(ctx, t)
+		if errors.Is(err, database.ErrNotModified) {
+			continue
+		}
+		if err != nil {
+			return updated, fmt.Errorf("updating transcription %v: %w", t.ID.Hex(), err)
+		}
+		updated++
+	}
+	log.Info().Msgf("Updated %v of %v transcriptions", updated, len(transcriptions))
+	return updated, nil
+}
@@ -0,0 +1,199 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"codeberg.org/pluja/whishper/database"
+	"codeberg.org/pluja/whishper/models"
+)
+
+// setMigrations replaces All with migrations for the length of the test.
+func setMigrations(t *testing.T, migrations []Migration) {
+	all := All
+	All = migrations
+	t.Cleanup(func() { All = all })
+}
+
+func newTestDb(t *testing.T) database.Db {
+	db, err := database.NewMemoryDb("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func versions(migrations []Migration) []int {
+	var v []int
+	for _, m := range migrations {
+		v = append(v, m.Version)
+	}
+	return v
+}
+
+func TestPending(t *testing.T) {
+	noop := func(context.Context, database.Db) error { return nil }
+	setMigrations(t, []Migration{{1, "a", noop}, {2, "b", noop}, {3, "c", noop}})
+	ctx := context.Background()
+	db := newTestDb(t)
+
+	for _, tt := range []struct {
+		current int
+		want    []int
+	}{
+		{0, []int{1, 2, 3}},
+		{1, []int{2, 3}},
+		{3, nil},
+	} {
+		if err := db.SetSchemaVersion(ctx, tt.current); err != nil {
+			t.Fatal(err)
+		}
+		pending, err := Pending(ctx, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := versions(pending); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("pending at version %v: %v, want %v", tt.current, got, tt.want)
+		}
+	}
+
+	if err := db.SetSchemaVersion(ctx, 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Pending(ctx, db); err == nil || !strings.Contains(err.Error(), "newer than this build") {
+		t.Errorf("pending at a newer version: got error %v", err)
+	}
+	if n, err := Run(ctx, db); n != 0 || err == nil {
+		t.Errorf("running at a newer version: applied %v, error %v", n, err)
+	}
+}
+
+// Run stops at the first failure, records the version of the last migration
+// applied, and picks up from there on the next run.
+func TestRunStopsAtFailure(t *testing.T) {
+	var ran []int
+	failing := errors.New("failing")
+	fail := true
+	step := func(version int) func(context.Context, database.Db) error {
+		return func(context.Context, database.Db) error {
+			if version == 2 && fail {
+				return failing
+			}
+			ran = append(ran, version)
+			return nil
+		}
+	}
+	setMigrations(t, []Migration{{1, "a", step(1)}, {2, "b", step(2)}, {3, "c", step(3)}})
+	ctx := context.Background()
+	db := newTestDb(t)
+
+	n, err := Run(ctx, db)
+	if n != 1 || !errors.Is(err, failing) {
+		t.Errorf("first run: applied %v, error %v, want 1 and the failure", n, err)
+	}
+	if v, _ := db.SchemaVersion(ctx); v != 1 {
+		t.Errorf("schema version %v after the failure, want 1", v)
+	}
+
+	fail = false
+	n, err = Run(ctx, db)
+	if n != 2 || err != nil {
+		t.Errorf("second run: applied %v, error %v, want 2", n, err)
+	}
+	if v, _ := db.SchemaVersion(ctx); v != 3 {
+		t.Errorf("schema version %v, want 3", v)
+	}
+	if fmt.Sprint(ran) != "[1 2 3]" {
+		t.Errorf("ran %v, want each migration once in order", ran)
+	}
+}
+
+// The data migrations only write the transcriptions they change, so running
+// them again writes nothing.
+func TestDataMigrationsIdempotent(t *testing.T) {
+	// A snapshot of a version from before the words count and the
+	// timestamps were stored.
+	path := filepath.Join(t.TempDir(), "db.jsonl")
+	snapshot := `{"_id":{"$oid":"650000000000000000000001"},"status":{"$numberInt":"2"},"result":{"text":"hello there world"}}` + "\n" +
+		`{"_id":{"$oid":"650000000000000000000002"},"status":{"$numberInt":"0"}}` + "\n"
+	if err := os.WriteFile(path, []byte(snapshot), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := database.NewMemoryDb(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, up := range []func(context.Context, database.Db) error{backfillWordsCount, addTimestamps} {
+		if err := up(ctx, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := db.GetAllTranscriptions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := before[0]
+	if done.WordsCount != 3 || !done.CreatedAt.Equal(done.ID.Timestamp()) {
+		t.Errorf("migrated %+v, want 3 words and the creation time of its id", done)
+	}
+	if before[1].WordsCount != 0 || before[1].CreatedAt.IsZero() {
+		t.Errorf("migrated %+v, want no words and a creation time", before[1])
+	}
+
+	for _, up := range []func(context.Context, database.Db) error{backfillWordsCount, addTimestamps} {
+		if err := up(ctx, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	after, err := db.GetAllTranscriptions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range after {
+		if after[i].Version != before[i].Version {
+			t.Errorf("transcription %v written again, at version %v from %v", after[i].ID.Hex(), after[i].Version, before[i].Version)
+		}
+	}
+}
+
+// updateEach doesn't count the transcriptions saved unchanged.
+func TestUpdateEachCount(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDb(t)
+	for _, text := range []string{"a", "b"} {
+		if _, err := db.NewTranscription(ctx, &models.Transcription{Result: models.WhisperResult{Text: text}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		change func(t *models.Transcription) bool
+		want   int
+	}{
+		{"none", func(*models.Transcription) bool { return false }, 0},
+		{"unchanged", func(*models.Transcription) bool { return true }, 0},
+		{"one", func(t *models.Transcription) bool {
+			if t.Result.Text != "a" {
+				return false
+			}
+			t.Result.Text = "c"
+			return true
+		}, 1},
+	} {
+		got, err := updateEach(ctx, db, tt.change)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%v: updated %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -5,7 +5,19 @@ const (
 	TranscriptionStatusRunning      = 1
 	TranscriptionStatusDone         = 2
 	TrannscriptionStatusTranslating = 3
+	TranscriptionStatusScheduled    = 4
 	TranscriptionStatusError        = -1
+	TranscriptionStatusCancelled    = -2
+
+	ErrorStageDownload   = "download"
+	ErrorStagePreprocess = "preprocess"
+	ErrorStagePrepare    = "prepare"
+	ErrorStageTranscribe = "transcribe"
+	ErrorStageSave       = "save"
+	ErrorStageWorker     = "worker"
+
+	AudioFilterHighpass = "highpass"
+	AudioFilterDenoise  = "denoise"
 
 	SourceTypeFile = "file"
 	SourceTypeURL  = "url"
@@ -0,0 +1,185 @@
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Revision is a saved state of the result and translations of a
+// transcription, taken right before a change replaced it. Author, CreatedAt
+// and Summary describe that change.
+type Revision struct {
+	ID              primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	TranscriptionID primitive.ObjectID `bson:"transcription_id" json:"transcriptionId"`
+	// Version is the version of the transcription the state was taken from.
+	Version      int64         `bson:"version" json:"version"`
+	Author       string        `bson:"author,omitempty" json:"author,omitempty"`
+	CreatedAt    time.Time     `bson:"created_at" json:"createdAt"`
+	Summary      string        `bson:"summary" json:"summary"`
+	Result       WhisperResult `bson:"result" json:"result"`
+	Translations []Translation `bson:"translations" json:"translations"`
+}
+
+// RevisionOf returns the current state of t as a revision.
+func RevisionOf(t *Transcription) Revision {
+	r := Revision{
+		TranscriptionID: t.ID,
+		Version:         t.Version,
+		Result:          t.Result,
+	}
+	if t.Translations != nil {
+		r.Translations = make([]Translation, len(t.Translations))
+		copy(r.Translations, t.Translations)
+	}
+	return r
+}
+
+// Kinds of SegmentChange.
+const (
+	SegmentAdded   = "added"
+	SegmentRemoved = "removed"
+	SegmentChanged = "changed"
+)
+
+// SegmentChange is a segment that differs between two revisions. Language is
+// empty for the result and holds the target language for translations.
+type SegmentChange struct {
+	Language  string   `json:"language,omitempty"`
+	SegmentID string   `json:"segmentId"`
+	Type      string   `json:"type"`
+	Before    *Segment `json:"before,omitempty"`
+	After     *Segment `json:"after,omitempty"`
+}
+
+// Diff returns the segments that changed from r to other, matched by id.
+func (r *Revision) Diff(other *Revision) []SegmentChange {
+	changes := diffSegments("", r.Result.Segments, other.Result.Segments)
+	for _, language := range translationLanguages(r, other) {
+		// A translation only one side has is all added or all removed.
+		var a, b []Segment
+		if tr := r.translation(language); tr != nil {
+			a = tr.Segments
+		}
+		if tr := other.translation(language); tr != nil {
+			b = tr.Segments
+		}
+		changes = append(changes, diffSegments(language, a, b)...)
+	}
+	return changes
+}
+
+// ChangeSummary describes the change from r to other in a few words, like
+// "edited 2 segments; added the es translation". It is empty if nothing
+// changed.
+func (r *Revision) ChangeSummary(other *Revision) string {
+	var parts []string
+	if s := resultSummary(&r.Result, &other.Result); s != "" {
+		parts = append(parts, s)
+	}
+	for _, language := range translationLanguages(r, other) {
+		a, b := r.translation(language), other.translation(language)
+		switch {
+		case a == nil:
+			parts = append(parts, fmt.Sprintf("added the %v translation", language))
+		case b == nil:
+			parts = append(parts, fmt.Sprintf("removed the %v translation", language))
+		default:
+			if s := resultSummary(a, b); s != "" {
+				parts = append(parts, fmt.Sprintf("%v in the %v translation", s, language))
+			}
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	summary := strings.Join(parts, "; ")
+	return strings.ToUpper(summary[:1]) + summary[1:]
+}
+
+// translation returns the result of the translation to language, or nil.
+func (r *Revision) translation(language string) *WhisperResult {
+	for i := range r.Translations {
+		if r.Translations[i].TargetLanguage == language {
+			return &r.Translations[i].Result
+		}
+	}
+	return nil
+}
+
+// translationLanguages returns the target languages of a and b, in order of
+// appearance.
+func translationLanguages(a, b *Revision) []string {
+	var languages []string
+	seen := map[string]bool{}
+	for _, r := range []*Revision{a, b} {
+		for _, tr := range r.Translations {
+			if !seen[tr.TargetLanguage] {
+				seen[tr.TargetLanguage] = true
+				languages = append(languages, tr.TargetLanguage)
+			}
+		}
+	}
+	return languages
+}
+
+func diffSegments(language string, a, b []Segment) []SegmentChange {
+	before := map[string]*Segment{}
+	for i := range a {
+		before[a[i].ID] = &a[i]
+	}
+	var changes []SegmentChange
+	seen := map[string]bool{}
+	for i := range b {
+		seg := &b[i]
+		seen[seg.ID] = true
+		old, ok := before[seg.ID]
+		switch {
+		case !ok:
+			changes = append(changes, SegmentChange{Language: language, SegmentID: seg.ID, Type: SegmentAdded, After: seg})
+		case !reflect.DeepEqual(*old, *seg):
+			changes = append(changes, SegmentChange{Language: language, SegmentID: seg.ID, Type: SegmentChanged, Before: old, After: seg})
+		}
+	}
+	for i := range a {
+		if !seen[a[i].ID] {
+			changes = append(changes, SegmentChange{Language: language, SegmentID: a[i].ID, Type: SegmentRemoved, Before: &a[i]})
+		}
+	}
+	return changes
+}
+
+// resultSummary describes the change from a to b, which may be nil.
+func resultSummary(a, b *WhisperResult) string {
+	if a == nil {
+		a = &WhisperResult{}
+	}
+	if b == nil {
+		b = &WhisperResult{}
+	}
+	counts := map[string]int{}
+	for _, c := range diffSegments("", a.Segments, b.Segments) {
+		counts[c.Type]++
+	}
+	var parts []string
+	for _, kind := range []struct{ name, verb string }{
+		{SegmentChanged, "edited"},
+		{SegmentAdded, "added"},
+		{SegmentRemoved, "removed"},
+	} {
+		switch n := counts[kind.name]; n {
+		case 0:
+		case 1:
+			parts = append(parts, kind.verb+" 1 segment")
+		default:
+			parts = append(parts, fmt.Sprintf("%v %v segments", kind.verb, n))
+		}
+	}
+	if len(parts) == 0 && a.Text != b.Text {
+		parts = append(parts, "edited the text")
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRevisionDiff(t *testing.T) {
+	segments := func(texts ...string) []Segment {
+		var segs []Segment
+		for i := 0; i < len(texts); i += 2 {
+			segs = append(segs, Segment{ID: texts[i], Text: texts[i+1]})
+		}
+		return segs
+	}
+	base := Revision{
+		Result:       WhisperResult{Text: "a b c", Segments: segments("1", "a", "2", "b", "3", "c")},
+		Translations: []Translation{{TargetLanguage: "es", Result: WhisperResult{Segments: segments("1", "x")}}},
+	}
+
+	type change struct{ language, id, kind string }
+	tests := []struct {
+		name    string
+		to      Revision
+		changes []change
+		summary string
+	}{
+		{
+			name:    "unchanged",
+			to:      base,
+			summary: "",
+		},
+		{
+			name: "result and translations",
+			to: Revision{
+				Result: WhisperResult{Segments: segments("1", "a", "2", "B", "4", "d")},
+				Translations: []Translation{
+					{TargetLanguage: "es", Result: WhisperResult{Segments: segments("1", "y")}},
+					{TargetLanguage: "fr", Result: WhisperResult{Segments: segments("1", "z")}},
+				},
+			},
+			changes: []change{
+				{"", "2", SegmentChanged},
+				{"", "4", SegmentAdded},
+				{"", "3", SegmentRemoved},
+				{"es", "1", SegmentChanged},
+				{"fr", "1", SegmentAdded},
+			},
+			summary: "Edited 1 segment, added 1 segment, removed 1 segment; edited 1 segment in the es translation; added the fr translation",
+		},
+		{
+			name: "several segments",
+			to: Revision{
+				Result:       WhisperResult{Text: "a b c", Segments: segments("1", "A", "2", "B", "3", "c")},
+				Translations: base.Translations,
+			},
+			changes: []change{{"", "1", SegmentChanged}, {"", "2", SegmentChanged}},
+			summary: "Edited 2 segments",
+		},
+		{
+			name: "text only",
+			to: Revision{
+				Result:       WhisperResult{Text: "a b c d", Segments: base.Result.Segments},
+				Translations: base.Translations,
+			},
+			summary: "Edited the text",
+		},
+		{
+			name:    "translation removed",
+			to:      Revision{Result: base.Result},
+			changes: []change{{"es", "1", SegmentRemoved}},
+			summary: "Removed the es translation",
+		},
+	}
+	for _, tt := range tests {
+		var got []change
+		for _, c := range base.Diff(&tt.to) {
+			got = append(got, change{c.Language, c.SegmentID, c.Type})
+			if (c.Before == nil) != (c.Type == SegmentAdded) || (c.After == nil) != (c.Type == SegmentRemoved) {
+				t.Errorf("%v: %v change of segment %v has before %v and after %v", tt.name, c.Type, c.SegmentID, c.Before, c.After)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.changes) {
+			t.Errorf("%v: diff %v, want %v", tt.name, got, tt.changes)
+		}
+		if got := base.ChangeSummary(&tt.to); got != tt.summary {
+			t.Errorf("%v: summary %q, want %q", tt.name, got, tt.summary)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package models
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	ltr "github.com/snakesel/libretranslate"
@@ -30,6 +31,80 @@ type Transcription struct {
 	WordsCount              int                `bson:"words_count,omitempty" json:"words_count,omitempty"`
 	Progress                float64            `bson:"progress,omitempty" json:"progress,omitempty"`
 	DownloadingModel        bool               `bson:"downloading_model,omitempty" json:"downloadingModel,omitempty"`
+	LeaseOwner              string             `bson:"lease_owner,omitempty" json:"leaseOwner,omitempty"`
+	LeaseExpiresAt          *time.Time         `bson:"lease_expires_at,omitempty" json:"leaseExpiresAt,omitempty"`
+	// Version is incremented on every write. Full updates must carry the
+	// version they were read at.
+	Version   int64     `bson:"version" json:"version"`
+	CreatedAt time.Time `bson:"created_at,omitempty" json:"createdAt"`
+	UpdatedAt time.Time `bson:"updated_at,omitempty" json:"updatedAt"`
+	// DeletedAt is set while the transcription is in the trash.
+	DeletedAt *time.Time `bson:"deleted_at,omitempty" json:"deletedAt,omitempty"`
+	// Error tells why the last attempt failed, while the job waits to be
+	// retried and once it has failed for good.
+	Error *JobError `bson:"error,omitempty" json:"error,omitempty"`
+	// Priority orders the queue: higher priorities run first, and equal ones
+	// in submission order.
+	Priority int `bson:"priority,omitempty" json:"priority"`
+	// NotBefore is when a scheduled job is released to the queue.
+	NotBefore *time.Time `bson:"not_before,omitempty" json:"notBefore,omitempty"`
+	// Normalize and AudioFilter tell how the audio is prepared before it is
+	// sent to the transcription service: Normalize evens out its loudness
+	// and AudioFilter is one of the AudioFilter constants, or empty for none.
+	Normalize   bool   `bson:"normalize,omitempty" json:"normalize,omitempty"`
+	AudioFilter string `bson:"audio_filter,omitempty" json:"audio_filter,omitempty"`
+}
+
+// ValidAudioFilter reports whether filter is an AudioFilter constant or empty.
+func ValidAudioFilter(filter string) bool {
+	return filter == "" || filter == AudioFilterHighpass || filter == AudioFilterDenoise
+}
+
+// JobError is the failure of an attempt at a transcription job.
+type JobError struct {
+	// Stage is the step that failed, one of the ErrorStage constants.
+	Stage   string `bson:"stage" json:"stage"`
+	Message string `bson:"message" json:"message"`
+	// Attempts counts the attempts made so far, this one included.
+	Attempts int       `bson:"attempts" json:"attempts"`
+	At       time.Time `bson:"at" json:"at"`
+}
+
+// Clone returns a deep copy of t, which shares no slice or pointer with it.
+func (t *Transcription) Clone() *Transcription {
+	c := *t
+	c.Hotwords = cloneSlice(t.Hotwords)
+	c.VadThreshold = clonePtr(t.VadThreshold)
+	c.VadMinSpeechDurationMS = clonePtr(t.VadMinSpeechDurationMS)
+	c.VadMinSilenceDurationMS = clonePtr(t.VadMinSilenceDurationMS)
+	c.Result = t.Result.Clone()
+	if t.Translations != nil {
+		c.Translations = make([]Translation, len(t.Translations))
+		for i, tr := range t.Translations {
+			tr.Result = tr.Result.Clone()
+			c.Translations[i] = tr
+		}
+	}
+	c.LeaseExpiresAt = clonePtr(t.LeaseExpiresAt)
+	c.DeletedAt = clonePtr(t.DeletedAt)
+	c.Error = clonePtr(t.Error)
+	c.NotBefore = clonePtr(t.NotBefore)
+	return &c
+}
+
+func cloneSlice[T any](s []T) []T {
+	if s == nil {
+		return nil
+	}
+	return append(make([]T, 0, len(s)), s...)
+}
+
+func clonePtr[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
 }
 
 type TranscriptionListItem struct {
@@ -51,7 +126,13 @@ type TranscriptionListItem struct {
 	Duration                float64               `json:"duration"`
 	WordsCount              int                   `json:"words_count"`
 	Progress                float64               `json:"progress,omitempty"`
+	Priority                int                   `json:"priority"`
+	NotBefore               *time.Time            `json:"notBefore,omitempty"`
+	Normalize               bool                  `json:"normalize,omitempty"`
+	AudioFilter             string                `json:"audio_filter,omitempty"`
 	DownloadingModel        bool                  `json:"downloadingModel,omitempty"`
+	DeletedAt               *time.Time            `json:"deletedAt,omitempty"`
+	Error                   *JobError             `json:"error,omitempty"`
 	Translations            []TranslationListItem `json:"translations"`
 }
 
@@ -1,10 +1,47 @@
 package models
 
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
 type WhisperResult struct {
 	Language string    `json:"language"`
 	Duration float64   `json:"duration"`
 	Segments []Segment `json:"segments"`
 	Text     string    `json:"text"`
+	// SegmentsID points to the segments when the database keeps them apart
+	// from the document. It is never set on a loaded result.
+	SegmentsID primitive.ObjectID `bson:"segments_id,omitempty" json:"-"`
+}
+
+// Clone returns a deep copy of r.
+func (r WhisperResult) Clone() WhisperResult {
+	if r.Segments != nil {
+		segments := make([]Segment, len(r.Segments))
+		for i, seg := range r.Segments {
+			seg.Words = cloneSlice(seg.Words)
+			segments[i] = seg
+		}
+		r.Segments = segments
+	}
+	return r
+}
+
+// WordsCount returns the number of words of the result text.
+func (r WhisperResult) WordsCount() int {
+	return len(strings.Fields(r.Text))
+}
+
+// SegmentsText returns the text of the segments joined like the
+// transcription service joins them into the result text.
+func (r WhisperResult) SegmentsText() string {
+	texts := make([]string, len(r.Segments))
+	for i, seg := range r.Segments {
+		texts[i] = seg.Text
+	}
+	return strings.Join(strings.Fields(strings.Join(texts, " ")), " ")
 }
 
 type Segment struct {
@@ -1,82 +1,192 @@
 package monitor
 
 import (
-	"bytes"
-	"io"
-	"mime/multipart"
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
 	"codeberg.org/pluja/whishper/api"
+	"codeberg.org/pluja/whishper/database"
 	"codeberg.org/pluja/whishper/models"
 	"codeberg.org/pluja/whishper/utils"
 )
 
-func StartMonitor(s *api.Server) {
-	log.Info().Msg("Starting monitor!")
+// leaseDuration is how long a claimed job stays leased to this worker
+// without a heartbeat.
+const leaseDuration = 2 * time.Minute
+
+// workerID identifies this process as the lease owner of the jobs it runs.
+var workerID = newWorkerID()
+
+func newWorkerID() string {
+	if id := os.Getenv("WORKER_ID"); id != "" {
+		return id
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "whishper"
+	}
+	return fmt.Sprintf("%v-%v", host, os.Getpid())
+}
+
+// StartMonitor claims and runs the pending jobs, up to the given limits at
+// once.
+func StartMonitor(s *api.Server, limits Limits) {
+	ctx := context.Background()
+	p := newPool(s, limits)
+	log.Info().Msgf("Starting monitor as worker %v with %v workers!", workerID, p.limits.Workers)
 	go func() {
+		// Jobs submitted to other instances sharing the database wake up
+		// nothing here, so the queue is also checked periodically.
+		ticker := time.NewTicker(leaseDuration / 3)
+		defer ticker.Stop()
 		for {
-			// Wait for new transcription to be added to the database
-			// notification will be received through the NewTranscriptionCh channel
-			<-s.NewTranscriptionCh
-			pendingTranscriptions := s.Db.GetPendingTranscriptions()
-			log.Debug().Msgf("Pending transcriptions: %v", len(pendingTranscriptions))
-			for _, pt := range pendingTranscriptions {
-				log.Debug().Msgf("Taking pending transcription %v", pt.ID)
-				if pt.Status == models.TranscriptionStatusPending {
-					err := transcribe(s, pt)
-					if err != nil {
-						log.Error().Err(err).Msg("Error transcribing")
-						pt.Status = models.TranscriptionStatusError
-						pt.DownloadingModel = false
-						ut, err := s.Db.UpdateTranscription(pt)
-						if err != nil {
-							log.Error().Err(err).Msg("Error updating transcription")
-						}
-						s.BroadcastTranscription(ut)
-						continue
-					}
-				}
+			// Wait for new transcription to be added to the database, or for
+			// a job to finish and free its slot. The notification for new
+			// jobs is received through the NewTranscriptionCh channel.
+			select {
+			case <-s.NewTranscriptionCh:
+			case <-p.finished:
+			case <-ticker.C:
 			}
+			// Claim pending jobs until the pool is full or the queue is
+			// empty. The claim is atomic, so other workers never get the
+			// same job.
+			p.fill(ctx)
 		}
 	}()
 }
 
-func transcribe(s *api.Server, t *models.Transcription) error {
-	// Update transcription status
-	t.Status = models.TranscriptionStatusRunning
-	log.Debug().Msgf("Updating transcription %v", t)
-	_, err := s.Db.UpdateTranscription(t)
+// runJob transcribes the claimed job t. A transient failure schedules the job
+// again with a growing delay, up to retries times, so it gives its slot back
+// while it waits; other failures mark it failed at once. The job stops early
+// when it is cancelled or loses its lease.
+func runJob(ctx context.Context, s *api.Server, t *models.Transcription, retries int) {
+	id := t.ID.Hex()
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	defer s.TrackJob(id, stop)()
+	go keepLease(ctx, s, id, stop)
+
+	s.BroadcastTranscription(t)
+	// Attempts made before a retry or a restart count too.
+	attempts := 1
+	if t.Error != nil {
+		attempts += t.Error.Attempts
+	}
+	err := transcribe(ctx, s, t)
+	if err == nil {
+		return
+	}
+	if ctx.Err() != nil || errors.Is(err, database.ErrLeaseLost) {
+		// Whoever stopped it has updated it already.
+		log.Info().Msgf("Stopped transcription %v", id)
+		return
+	}
+
+	outcome := database.JobOutcome{Error: jobError(err, attempts)}
+	wait := backoff(attempts)
+	if transient(err) && attempts <= retries {
+		log.Warn().Err(err).Msgf("Attempt %v at transcription %v failed, retrying in %v", attempts, id, wait)
+		retryAt := time.Now().Add(wait)
+		outcome.RetryAt = &retryAt
+	} else {
+		log.Error().Err(err).Msgf("Error transcribing, attempt %v", attempts)
+	}
+	ut, err := s.Db.FinishJob(ctx, id, workerID, outcome)
+	if errors.Is(err, database.ErrLeaseLost) {
+		log.Info().Msgf("Stopped transcription %v", id)
+		return
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("Error updating transcription")
-		return err
+		return
 	}
-	s.BroadcastTranscription(t)
+	s.BroadcastTranscription(ut)
+	if outcome.RetryAt != nil {
+		// Release it on time rather than at the next scheduler check.
+		time.AfterFunc(wait, func() { releaseScheduled(context.Background(), s) })
+	}
+}
+
+// keepLease renews the lease of the job id until ctx is done, so that the job
+// isn't taken for abandoned while it runs. It calls stop when the lease is
+// lost, which happens when the job is cancelled from another instance.
+func keepLease(ctx context.Context, s *api.Server, id string, stop context.CancelFunc) {
+	ticker := time.NewTicker(leaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.Db.RenewLease(ctx, id, workerID, time.Now().Add(leaseDuration))
+			if errors.Is(err, database.ErrLeaseLost) {
+				log.Warn().Msgf("Lost the lease of transcription %v, stopping it", id)
+				stop()
+				return
+			}
+			if err != nil {
+				log.Warn().Err(err).Msgf("Error renewing the lease of transcription %v", id)
+			}
+		}
+	}
+}
 
-	if t.SourceUrl != "" {
-		// Download media
-		fn, err := utils.DownloadMedia(t)
+func transcribe(ctx context.Context, s *api.Server, t *models.Transcription) error {
+	if t.SourceUrl != "" && t.FileName == "" {
+		// Download media, unless an earlier attempt did.
+		fn, err := utils.DownloadMedia(ctx, t)
 		if err != nil {
 			log.Error().Err(err).Msg("Error downloading media")
-			return err
+			return failed(models.ErrorStageDownload, err)
 		}
-		t.FileName = fn
+		ut, err := s.Db.RenameFile(ctx, t.ID.Hex(), fn)
+		if err != nil {
+			log.Error().Err(err).Msg("Error updating transcription file name")
+			return failed(models.ErrorStageDownload, err)
+		}
+		*t = *ut
 		s.BroadcastTranscription(t)
 	}
 
-	// Prepare multipart form data
-	body, writer, err := prepareMultipartFormData(t)
+	// Extract the audio, which is all the transcription service needs.
+	mediaPath, err := preprocess(ctx, t)
 	if err != nil {
-		log.Error().Err(err).Msg("Error preparing multipart form data")
-		return err
+		log.Error().Err(err).Msg("Error preprocessing media")
+		return failed(models.ErrorStagePreprocess, err)
 	}
 
+	// Open the media, which is streamed to the transcription service.
+	media, err := os.Open(mediaPath)
+	if err != nil {
+		log.Error().Err(err).Msg("Error opening media file")
+		return failed(models.ErrorStagePrepare, err)
+	}
+	defer media.Close()
+
+	// Pick the transcription service for the device and model size of the
+	// job, waiting for one to have room.
+	endpoint, release, err := s.ASR.Acquire(ctx, t.Device, t.ModelSize)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Error().Err(err).Msgf("No transcription service for transcription %v", t.ID.Hex())
+		return failed(models.ErrorStageTranscribe, err)
+	}
+	defer release()
+	log.Info().Msgf("Sending transcription %v to %v", t.ID.Hex(), endpoint)
+
 	// Send transcription request to transcription service. We use the
 	// streaming endpoint so we can report progress while it runs.
 	var lastBroadcast float64
-	res, err := utils.SendTranscriptionRequestStream(t, body, writer, func(progress float64) {
+	res, err := utils.SendTranscriptionRequestStream(ctx, endpoint, t, media, filepath.Base(mediaPath), func(progress float64) {
 		// Once real progress arrives the model is loaded, so clear the
 		// downloading flag (force a broadcast on this transition).
 		downloadingCleared := t.DownloadingModel
@@ -87,7 +197,7 @@ func transcribe(s *api.Server, t *models.Transcription) error {
 		lastBroadcast = progress
 		t.Progress = progress
 		t.DownloadingModel = false
-		if _, uerr := s.Db.UpdateTranscription(t); uerr != nil {
+		if _, uerr := s.Db.SetProgress(ctx, t.ID.Hex(), progress, false); uerr != nil {
 			log.Error().Err(uerr).Msg("Error updating transcription progress")
 			return
 		}
@@ -97,7 +207,7 @@ func transcribe(s *api.Server, t *models.Transcription) error {
 		log.Info().Msgf("Downloading model %v for transcription %v", model, t.ID.Hex())
 		t.DownloadingModel = true
 		t.Progress = 0
-		if _, uerr := s.Db.UpdateTranscription(t); uerr != nil {
+		if _, uerr := s.Db.SetProgress(ctx, t.ID.Hex(), 0, true); uerr != nil {
 			log.Error().Err(uerr).Msg("Error updating transcription download state")
 			return
 		}
@@ -105,53 +215,28 @@ func transcribe(s *api.Server, t *models.Transcription) error {
 	})
 	if err != nil {
 		log.Error().Err(err).Msg("Error sending transcription request")
-		return err
+		if ctx.Err() == nil && unreachable(err) {
+			// Send the next attempts elsewhere until it is back.
+			s.ASR.MarkDown(endpoint, err)
+		}
+		return failed(models.ErrorStageTranscribe, err)
 	}
 
-	t.Result = *res
-	t.Translations = []models.Translation{}
-	t.Status = models.TranscriptionStatusDone
-	t.Progress = 1.0
-	t.DownloadingModel = false
-	_, err = s.Db.UpdateTranscription(t)
-	if err != nil {
-		log.Error().Err(err).Msg("Error updating transcription")
+	if err := ctx.Err(); err != nil {
+		// Cancelled as the result came in.
 		return err
 	}
-	s.BroadcastTranscription(t)
-	return nil
-}
-
-func prepareMultipartFormData(t *models.Transcription) (*bytes.Buffer, *multipart.Writer, error) {
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-
-	part, err := writer.CreateFormFile("file", t.FileName)
-	if err != nil {
-		log.Error().Err(err).Msg("Error creating form file")
-		return nil, nil, err
-	}
-
-	// Read file from disk
-	filePath := filepath.Join(os.Getenv("UPLOAD_DIR"), t.FileName)
-	file, err := os.Open(filePath)
-	if err != nil {
-		log.Error().Err(err).Msg("Error opening file")
-		return nil, nil, err
-	}
-	defer file.Close()
-
-	_, err = io.Copy(part, file)
-	if err != nil {
-		log.Error().Err(err).Msg("Error copying file")
-		return nil, nil, err
+	// The result is only saved while the job is still ours: it may have been
+	// cancelled or taken over since the last lease renewal.
+	ut, err := s.Db.FinishJob(ctx, t.ID.Hex(), workerID, database.JobOutcome{Result: *res})
+	if errors.Is(err, database.ErrLeaseLost) {
+		return err
 	}
-
-	err = writer.Close()
 	if err != nil {
-		log.Error().Err(err).Msg("Error closing writer")
-		return nil, nil, err
+		log.Error().Err(err).Msg("Error saving transcription result")
+		return failed(models.ErrorStageSave, err)
 	}
-
-	return body, writer, nil
+	*t = *ut
+	s.BroadcastTranscription(t)
+	return nil
 }
@@ -0,0 +1,238 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/pluja/whishper/api"
+	"codeberg.org/pluja/whishper/asr"
+	"codeberg.org/pluja/whishper/database"
+	"codeberg.org/pluja/whishper/events"
+	"codeberg.org/pluja/whishper/models"
+)
+
+// stubASR answers the streaming endpoint like the transcription service,
+// with some progress and then a result of a single segment. beforeResult, if
+// any, is called in between.
+func stubASR(t *testing.T, beforeResult func()) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/transcribe-stream/" {
+			http.NotFound(w, r)
+			return
+		}
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		fmt.Fprintln(w, `{"type":"progress","progress":0.5}`)
+		if beforeResult != nil {
+			beforeResult()
+		}
+		fmt.Fprintln(w, `{"type":"result","result":{"language":"en","duration":1.5,"text":"hello world","segments":[{"id":"1","start":0,"end":1.5,"text":"hello world"}]}}`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestMonitorRunsJob(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("UPLOAD_DIR", dir)
+	t.Setenv("PREPROCESS", "false")
+	if err := os.WriteFile(filepath.Join(dir, "a.mp3"), []byte("media"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := database.NewMemoryDb("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	asrSrv := stubASR(t, nil)
+	router := asr.NewRouter([]asr.Endpoint{{Address: strings.TrimPrefix(asrSrv.URL, "http://")}})
+	s := api.NewServer(":0", db, events.NewLocal(), router)
+
+	ctx := context.Background()
+	tr, err := db.NewTranscription(ctx, &models.Transcription{
+		Status:    models.TranscriptionStatusPending,
+		FileName:  "a.mp3",
+		ModelSize: "tiny",
+		Device:    "cpu",
+		Task:      "transcribe",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	StartMonitor(s, Limits{Workers: 1})
+	s.NewTranscriptionCh <- true
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		got, err := db.GetTranscription(ctx, tr.ID.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status == models.TranscriptionStatusDone {
+			if got.Result.Text != "hello world" || len(got.Result.Segments) != 1 || got.WordsCount != 2 {
+				t.Errorf("result %+v with %v words, want the one of the service", got.Result, got.WordsCount)
+			}
+			if got.Progress != 1 || got.Error != nil || got.LeaseOwner != "" {
+				t.Errorf("done job has progress %v, error %v and lease owner %q", got.Progress, got.Error, got.LeaseOwner)
+			}
+			return
+		}
+		if got.Status == models.TranscriptionStatusError {
+			t.Fatalf("job failed: %+v", got.Error)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job still has status %v", got.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A job cancelled while the service works on it, here by another instance
+// so the worker isn't stopped, keeps its status and doesn't get the result.
+func TestRunJobCancelled(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("UPLOAD_DIR", dir)
+	t.Setenv("PREPROCESS", "false")
+	if err := os.WriteFile(filepath.Join(dir, "a.mp3"), []byte("media"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		cancel bool
+		status int
+		text   string
+	}{
+		{name: "finished", status: models.TranscriptionStatusDone, text: "hello world"},
+		{name: "cancelled", cancel: true, status: models.TranscriptionStatusCancelled},
+	}
+	for _, tt := range tests {
+		db, err := database.NewMemoryDb("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		tr, err := db.NewTranscription(ctx, &models.Transcription{
+			Status:    models.TranscriptionStatusPending,
+			FileName:  "a.mp3",
+			ModelSize: "tiny",
+			Device:    "cpu",
+			Task:      "transcribe",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := tr.ID.Hex()
+		var beforeResult func()
+		if tt.cancel {
+			beforeResult = func() {
+				if _, err := db.CancelTranscription(ctx, id); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+		asrSrv := stubASR(t, beforeResult)
+		router := asr.NewRouter([]asr.Endpoint{{Address: strings.TrimPrefix(asrSrv.URL, "http://")}})
+		s := api.NewServer(":0", db, events.NewLocal(), router)
+
+		claimed, err := db.ClaimNextPending(ctx, database.ClaimRequest{WorkerID: workerID, Lease: leaseDuration})
+		if err != nil {
+			t.Fatal(err)
+		}
+		runJob(ctx, s, claimed, 0)
+
+		got, err := db.GetTranscription(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != tt.status || got.Result.Text != tt.text {
+			t.Errorf("%v: status %v with result %q, want %v with %q", tt.name, got.Status, got.Result.Text, tt.status, tt.text)
+		}
+		if got.LeaseOwner != "" || got.Error != nil {
+			t.Errorf("%v: lease owner %q and error %v left", tt.name, got.LeaseOwner, got.Error)
+		}
+	}
+}
+
+// A job failing with a transient error gives its slot back and waits as
+// scheduled for its retry, until it runs out of retries.
+func TestRunJobRetry(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("UPLOAD_DIR", dir)
+	t.Setenv("PREPROCESS", "false")
+	if err := os.WriteFile(filepath.Join(dir, "a.mp3"), []byte("media"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	asrSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(asrSrv.Close)
+
+	tests := []struct {
+		name     string
+		earlier  int
+		status   int
+		attempts int
+	}{
+		{name: "first failure", status: models.TranscriptionStatusScheduled, attempts: 1},
+		{name: "out of retries", earlier: 1, status: models.TranscriptionStatusError, attempts: 2},
+	}
+	for _, tt := range tests {
+		db, err := database.NewMemoryDb("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		tr := &models.Transcription{
+			Status:    models.TranscriptionStatusPending,
+			FileName:  "a.mp3",
+			ModelSize: "tiny",
+			Device:    "cpu",
+			Task:      "transcribe",
+		}
+		if tt.earlier > 0 {
+			tr.Error = &models.JobError{Stage: models.ErrorStageTranscribe, Message: "busy", Attempts: tt.earlier}
+		}
+		tr, err = db.NewTranscription(ctx, tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		router := asr.NewRouter([]asr.Endpoint{{Address: strings.TrimPrefix(asrSrv.URL, "http://")}})
+		s := api.NewServer(":0", db, events.NewLocal(), router)
+
+		claimed, err := db.ClaimNextPending(ctx, database.ClaimRequest{WorkerID: workerID, Lease: leaseDuration})
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		runJob(ctx, s, claimed, 1)
+		if took := time.Since(start); took >= retryBackoff {
+			t.Errorf("%v: runJob took %v, it waited for the retry", tt.name, took)
+		}
+
+		got, err := db.GetTranscription(ctx, tr.ID.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != tt.status || got.Error == nil || got.Error.Attempts != tt.attempts {
+			t.Errorf("%v: status %v with error %+v, want %v after %v attempts", tt.name, got.Status, got.Error, tt.status, tt.attempts)
+		}
+		if got.LeaseOwner != "" {
+			t.Errorf("%v: lease owner %q left", tt.name, got.LeaseOwner)
+		}
+		if tt.status == models.TranscriptionStatusScheduled && (got.NotBefore == nil || !got.NotBefore.After(start)) {
+			t.Errorf("%v: retry scheduled at %v, want after %v", tt.name, got.NotBefore, start)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"codeberg.org/pluja/whishper/api"
+	"codeberg.org/pluja/whishper/database"
+	"codeberg.org/pluja/whishper/models"
+)
+
+// Limits caps how many jobs this worker runs at once: in total, and for each
+// device and model size. Devices and model sizes without a limit are only
+// capped by the total.
+type Limits struct {
+	Workers    int
+	Devices    map[string]int
+	ModelSizes map[string]int
+	// Retries is how many times a job failing with a transient error is
+	// tried again.
+	Retries int
+}
+
+// ParseLimits reads a list of limits like "cuda=1,cpu=2".
+func ParseLimits(spec string) (map[string]int, error) {
+	limits := map[string]int{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || err != nil || n < 1 || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid limit %q, expected name=number with a number of at least 1", part)
+		}
+		limits[strings.TrimSpace(name)] = n
+	}
+	return limits, nil
+}
+
+// pool runs the claimed jobs, as many at once as the limits allow.
+type pool struct {
+	s      *api.Server
+	limits Limits
+	// finished is signalled whenever a job ends, to claim the next one.
+	finished chan struct{}
+
+	mu       sync.Mutex
+	running  int
+	byDevice map[string]int
+	byModel  map[string]int
+}
+
+func newPool(s *api.Server, limits Limits) *pool {
+	if limits.Workers < 1 {
+		limits.Workers = 1
+	}
+	return &pool{
+		s:        s,
+		limits:   limits,
+		finished: make(chan struct{}, 1),
+		byDevice: make(map[string]int),
+		byModel:  make(map[string]int),
+	}
+}
+
+// fill claims pending jobs and starts them until the pool is full or no job
+// it can take is pending.
+func (p *pool) fill(ctx context.Context) {
+	for {
+		req, ok := p.claimRequest()
+		if !ok {
+			return
+		}
+		t, err := p.s.Db.ClaimNextPending(ctx, req)
+		if errors.Is(err, database.ErrNotFound) {
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Error claiming pending transcription")
+			return
+		}
+		log.Debug().Msgf("Claimed pending transcription %v", t.ID.Hex())
+		p.start(ctx, t)
+	}
+}
+
+// claimRequest returns the request for the next job, skipping the devices and
+// model sizes at their limit. It returns false if the pool is full.
+func (p *pool) claimRequest() (database.ClaimRequest, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	req := database.ClaimRequest{WorkerID: workerID, Lease: leaseDuration}
+	if p.running >= p.limits.Workers {
+		return req, false
+	}
+	req.SkipDevices = atLimit(p.byDevice, p.limits.Devices)
+	req.SkipModelSizes = atLimit(p.byModel, p.limits.ModelSizes)
+	return req, true
+}
+
+// atLimit returns the names whose count reached their limit, sorted.
+func atLimit(counts map[string]int, limits map[string]int) []string {
+	var full []string
+	for name, limit := range limits {
+		if counts[name] >= limit {
+			full = append(full, name)
+		}
+	}
+	sort.Strings(full)
+	return full
+}
+
+// start runs the claimed job t in its own goroutine.
+func (p *pool) start(ctx context.Context, t *models.Transcription) {
+	device, model := t.Device, t.ModelSize
+	p.mu.Lock()
+	p.running++
+	p.byDevice[device]++
+	p.byModel[model]++
+	p.mu.Unlock()
+
+	go func() {
+		defer func() {
+			p.mu.Lock()
+			p.running--
+			p.byDevice[device]--
+			p.byModel[model]--
+			p.mu.Unlock()
+			select {
+			case p.finished <- struct{}{}:
+			default:
+				// A wake up is pending already.
+			}
+		}()
+		runJob(ctx, p.s, t, p.limits.Retries)
+	}()
+}
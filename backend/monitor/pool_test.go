@@ -0,0 +1,109 @@
+package monitor
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLimits(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    map[string]int
+		wantErr bool
+	}{
+		{spec: "", want: map[string]int{}},
+		{spec: "cuda=1", want: map[string]int{"cuda": 1}},
+		{spec: " cuda = 1 , cpu=2,", want: map[string]int{"cuda": 1, "cpu": 2}},
+		{spec: "cuda=1,cuda=3", want: map[string]int{"cuda": 3}},
+		{spec: "cuda", wantErr: true},
+		{spec: "cuda=", wantErr: true},
+		{spec: "=1", wantErr: true},
+		{spec: "cuda=0", wantErr: true},
+		{spec: "cuda=-1", wantErr: true},
+		{spec: "cuda=one", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLimits(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseLimits(%q) error %v, want error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseLimits(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestClaimRequest(t *testing.T) {
+	limits := Limits{
+		Workers:    3,
+		Devices:    map[string]int{"cuda": 1, "cpu": 2},
+		ModelSizes: map[string]int{"large-v2": 1},
+	}
+	tests := []struct {
+		name       string
+		limits     Limits
+		running    int
+		byDevice   map[string]int
+		byModel    map[string]int
+		ok         bool
+		skipDevice []string
+		skipModel  []string
+	}{
+		{name: "idle", limits: limits, ok: true},
+		{
+			name:     "below the limits",
+			limits:   limits,
+			running:  1,
+			byDevice: map[string]int{"cpu": 1},
+			byModel:  map[string]int{"small": 1},
+			ok:       true,
+		},
+		{
+			name:       "device and model size full",
+			limits:     limits,
+			running:    2,
+			byDevice:   map[string]int{"cuda": 1, "cpu": 1},
+			byModel:    map[string]int{"large-v2": 1, "small": 1},
+			ok:         true,
+			skipDevice: []string{"cuda"},
+			skipModel:  []string{"large-v2"},
+		},
+		{
+			name:       "every device full",
+			limits:     limits,
+			running:    2,
+			byDevice:   map[string]int{"cuda": 1, "cpu": 2},
+			ok:         true,
+			skipDevice: []string{"cpu", "cuda"},
+		},
+		{name: "pool full", limits: limits, running: 3},
+		// Without workers, the pool runs one job at a time.
+		{name: "no workers", running: 0, ok: true},
+		{name: "no workers, one running", running: 1},
+	}
+	for _, tt := range tests {
+		p := newPool(nil, tt.limits)
+		p.running = tt.running
+		if tt.byDevice != nil {
+			p.byDevice = tt.byDevice
+		}
+		if tt.byModel != nil {
+			p.byModel = tt.byModel
+		}
+		req, ok := p.claimRequest()
+		if ok != tt.ok {
+			t.Errorf("%v: claimRequest() ok %v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if req.WorkerID != workerID || req.Lease != leaseDuration {
+			t.Errorf("%v: request for worker %q with lease %v", tt.name, req.WorkerID, req.Lease)
+		}
+		if !ok {
+			continue
+		}
+		if !reflect.DeepEqual(req.SkipDevices, tt.skipDevice) || !reflect.DeepEqual(req.SkipModelSizes, tt.skipModel) {
+			t.Errorf("%v: skips devices %v and model sizes %v, want %v and %v", tt.name, req.SkipDevices, req.SkipModelSizes, tt.skipDevice, tt.skipModel)
+		}
+	}
+}
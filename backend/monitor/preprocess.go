@@ -0,0 +1,118 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"codeberg.org/pluja/whishper/models"
+	"codeberg.org/pluja/whishper/utils"
+)
+
+// audioFilters are the ffmpeg filters of the models.AudioFilter constants.
+var audioFilters = map[string]string{
+	models.AudioFilterHighpass: "highpass=f=100",
+	models.AudioFilterDenoise:  "highpass=f=100,afftdn",
+}
+
+// preprocessing reports whether the audio is extracted with ffmpeg before it
+// is sent, which -preprocess turns off.
+func preprocessing() bool {
+	return os.Getenv("PREPROCESS") != "false"
+}
+
+// preprocess extracts the audio of the media of t with ffmpeg, as the 16kHz
+// mono that Whisper works on, normalized and filtered as t asks. It returns
+// the path of the file to send: the extracted audio, or the media itself when
+// preprocessing is off or ffmpeg isn't installed. The audio is cached, so
+// retries and re-runs with the same preprocessing don't extract it again.
+func preprocess(ctx context.Context, t *models.Transcription) (string, error) {
+	mediaPath := filepath.Join(os.Getenv("UPLOAD_DIR"), t.FileName)
+	if !preprocessing() {
+		return mediaPath, nil
+	}
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		log.Warn().Err(err).Msgf("ffmpeg not found, sending the whole media of transcription %v", t.ID.Hex())
+		return mediaPath, nil
+	}
+
+	media, err := os.Stat(mediaPath)
+	if err != nil {
+		return "", err
+	}
+	dir := utils.PreprocessedDir()
+	audioPath := filepath.Join(dir, t.ID.Hex()+"."+preprocessKey(t)+".flac")
+	if audio, err := os.Stat(audioPath); err == nil && !audio.ModTime().Before(media.ModTime()) {
+		log.Debug().Msgf("Using the cached audio %v", audioPath)
+		return audioPath, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	// ffmpeg writes to a temporary file, so that a stopped run leaves no
+	// partial audio in the cache.
+	tmp, err := os.CreateTemp(dir, t.ID.Hex()+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	args := []string{"-nostdin", "-hide_banner", "-loglevel", "error", "-y", "-i", mediaPath, "-vn", "-ac", "1"}
+	if chain := audioFilterChain(t); chain != "" {
+		args = append(args, "-af", chain)
+	}
+	args = append(args, "-ar", "16000", "-sample_fmt", "s16", "-c:a", "flac", "-f", "flac", tmp.Name())
+
+	log.Info().Msgf("Extracting the audio of transcription %v", t.ID.Hex())
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			lines := strings.Split(msg, "\n")
+			return "", fmt.Errorf("ffmpeg: %v", lines[len(lines)-1])
+		}
+		return "", fmt.Errorf("ffmpeg: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), audioPath); err != nil {
+		return "", err
+	}
+	if audio, err := os.Stat(audioPath); err == nil {
+		log.Info().Msgf("Extracted the audio of transcription %v: %v MB instead of %v MB", t.ID.Hex(), audio.Size()>>20, media.Size()>>20)
+	}
+	return audioPath, nil
+}
+
+// audioFilterChain returns the ffmpeg filters for the preprocessing of t.
+func audioFilterChain(t *models.Transcription) string {
+	var filters []string
+	if f, ok := audioFilters[t.AudioFilter]; ok {
+		filters = append(filters, f)
+	}
+	if t.Normalize {
+		filters = append(filters, "loudnorm")
+	}
+	return strings.Join(filters, ",")
+}
+
+// preprocessKey names the preprocessing of t in the cached audio file name,
+// so that each one is cached apart.
+func preprocessKey(t *models.Transcription) string {
+	key := "16k"
+	if t.AudioFilter != "" {
+		key += "-" + t.AudioFilter
+	}
+	if t.Normalize {
+		key += "-loudnorm"
+	}
+	return key
+}
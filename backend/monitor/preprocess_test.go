@@ -0,0 +1,94 @@
+package monitor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"codeberg.org/pluja/whishper/models"
+	"codeberg.org/pluja/whishper/utils"
+)
+
+// stubFfmpeg puts an ffmpeg on the PATH that writes its output file and
+// records each run, and returns a function counting the runs.
+func stubFfmpeg(t *testing.T) func() int {
+	if runtime.GOOS == "windows" {
+		t.Skip("the ffmpeg stub is a shell script")
+	}
+	bin := t.TempDir()
+	runs := filepath.Join(bin, "runs")
+	script := "#!/bin/sh\necho run >> " + runs + "\nfor arg; do out=$arg; done\necho audio > \"$out\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "ffmpeg"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return func() int {
+		b, _ := os.ReadFile(runs)
+		return strings.Count(string(b), "run")
+	}
+}
+
+// The extracted audio is cached out of the served upload directory, and
+// extracted again when the preprocessing or the media change.
+func TestPreprocessCache(t *testing.T) {
+	runs := stubFfmpeg(t)
+	uploads, cache := t.TempDir(), t.TempDir()
+	t.Setenv("UPLOAD_DIR", uploads)
+	t.Setenv("CACHE_DIR", cache)
+	t.Setenv("PREPROCESS", "true")
+	media := filepath.Join(uploads, "a.mp4")
+	if err := os.WriteFile(media, []byte("media"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// The media is older than the audio extracted from it.
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(media, past, past); err != nil {
+		t.Fatal(err)
+	}
+	tr := &models.Transcription{ID: primitive.NewObjectID(), FileName: "a.mp4"}
+	ctx := context.Background()
+
+	steps := []struct {
+		name   string
+		change func()
+		runs   int
+	}{
+		{"first run", func() {}, 1},
+		{"cached", func() {}, 1},
+		{"normalized", func() { tr.Normalize = true }, 2},
+		{"normalized cached", func() {}, 2},
+		{"first preprocessing still cached", func() { tr.Normalize = false }, 2},
+		{"media replaced", func() {
+			if err := os.Chtimes(media, time.Now().Add(time.Hour), time.Now().Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+		}, 3},
+	}
+	for _, step := range steps {
+		step.change()
+		path, err := preprocess(ctx, tr)
+		if err != nil {
+			t.Fatalf("%v: %v", step.name, err)
+		}
+		if filepath.Dir(path) != utils.PreprocessedDir() || !strings.HasPrefix(path, cache) {
+			t.Errorf("%v: audio at %v, want it in the cache directory", step.name, path)
+		}
+		if got := runs(); got != step.runs {
+			t.Errorf("%v: ffmpeg ran %v times, want %v", step.name, got, step.runs)
+		}
+	}
+
+	entries, err := os.ReadDir(uploads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("upload directory holds %v entries, want the media only", len(entries))
+	}
+}
@@ -0,0 +1,37 @@
+package monitor
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"codeberg.org/pluja/whishper/api"
+)
+
+// purgeInterval is how often the trash is checked for expired transcriptions.
+const purgeInterval = time.Hour
+
+// StartPurger deletes for good, every purgeInterval, the transcriptions that
+// have been in the trash for longer than retention. With a retention of 0 the
+// trash is only emptied by hand.
+func StartPurger(s *api.Server, retention time.Duration) {
+	if retention <= 0 {
+		log.Info().Msg("Trash retention is 0, the trash is only emptied by hand")
+		return
+	}
+	log.Info().Msgf("Starting trash purger, retention is %v", retention)
+	go func() {
+		ticker := time.NewTicker(purgeInterval)
+		defer ticker.Stop()
+		for {
+			purged, err := s.PurgeTrash(context.Background(), time.Now().Add(-retention))
+			if err != nil {
+				log.Error().Err(err).Msg("Error purging the trash")
+			} else if purged > 0 {
+				log.Info().Msgf("Purged %v transcriptions from the trash", purged)
+			}
+			<-ticker.C
+		}
+	}()
+}
@@ -0,0 +1,111 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"codeberg.org/pluja/whishper/api"
+	"codeberg.org/pluja/whishper/database"
+	"codeberg.org/pluja/whishper/models"
+)
+
+// StalePolicy tells what happens to a running job whose worker stopped
+// renewing its lease, because it crashed or was restarted.
+type StalePolicy string
+
+const (
+	// StaleRequeue queues the job again, as long as it has retries left.
+	StaleRequeue StalePolicy = "requeue"
+	// StaleFail marks the job failed.
+	StaleFail StalePolicy = "fail"
+)
+
+// StartRecovery takes the running jobs whose lease expired back from their
+// worker, once before the monitor starts and then every leaseDuration.
+// Depending on policy they are queued again, up to retries times, or failed.
+func StartRecovery(s *api.Server, policy StalePolicy, retries int) {
+	log.Info().Msgf("Recovering stale jobs with the %v policy", policy)
+	// This worker just started, so the jobs leased to its id belong to a
+	// previous run of it.
+	recoverStale(context.Background(), s, policy, retries, true)
+	go func() {
+		ticker := time.NewTicker(leaseDuration)
+		defer ticker.Stop()
+		for range ticker.C {
+			recoverStale(context.Background(), s, policy, retries, false)
+		}
+	}()
+}
+
+// recoverStale recovers the stale running jobs. On startup, the jobs leased
+// to this worker are stale too.
+func recoverStale(ctx context.Context, s *api.Server, policy StalePolicy, retries int, startup bool) {
+	running, err := s.Db.GetRunningTranscription(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Error getting running transcriptions")
+		return
+	}
+	requeued := false
+	now := time.Now()
+	for _, t := range running {
+		ownJob := startup && t.LeaseOwner == workerID
+		if t.LeaseExpiresAt != nil && t.LeaseExpiresAt.After(now) && !ownJob {
+			continue
+		}
+
+		attempts := 1
+		if t.Error != nil {
+			attempts = t.Error.Attempts + 1
+		}
+		jobErr := &models.JobError{
+			Stage:    models.ErrorStageWorker,
+			Message:  staleReason(t),
+			Attempts: attempts,
+			At:       now.UTC(),
+		}
+		status := models.TranscriptionStatusError
+		if policy == StaleRequeue && attempts <= retries {
+			status = models.TranscriptionStatusPending
+		}
+
+		ut, err := s.Db.RecoverTranscription(ctx, t.ID.Hex(), t.Version, status, jobErr)
+		if errors.Is(err, database.ErrConflict) {
+			// Its worker is alive after all, or someone else recovered it.
+			continue
+		}
+		if err != nil {
+			log.Error().Err(err).Msgf("Error recovering stale transcription %v", t.ID.Hex())
+			continue
+		}
+		if status == models.TranscriptionStatusPending {
+			log.Warn().Msgf("Requeued stale transcription %v: %v", t.ID.Hex(), jobErr.Message)
+			requeued = true
+		} else {
+			log.Warn().Msgf("Failed stale transcription %v: %v", t.ID.Hex(), jobErr.Message)
+		}
+		s.BroadcastTranscription(ut)
+	}
+	if requeued {
+		select {
+		case s.NewTranscriptionCh <- true:
+		default:
+			// A wake up is pending already.
+		}
+	}
+}
+
+// staleReason explains why the running job t was taken from its worker.
+func staleReason(t *models.Transcription) string {
+	switch {
+	case t.LeaseOwner == "" || t.LeaseExpiresAt == nil:
+		return "the job was left running without a lease"
+	case t.LeaseOwner == workerID:
+		return fmt.Sprintf("worker %v restarted while running the job", t.LeaseOwner)
+	default:
+		return fmt.Sprintf("worker %v stopped renewing its lease, which expired at %v", t.LeaseOwner, t.LeaseExpiresAt.UTC().Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,85 @@
+package monitor
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/pluja/whishper/api"
+	"codeberg.org/pluja/whishper/database"
+	"codeberg.org/pluja/whishper/events"
+	"codeberg.org/pluja/whishper/models"
+)
+
+func TestRecoverStale(t *testing.T) {
+	expired := time.Now().Add(-time.Minute)
+	live := time.Now().Add(time.Hour)
+	tests := []struct {
+		name     string
+		owner    string
+		expires  *time.Time
+		attempts int // Attempts made before, 0 for none.
+		policy   StalePolicy
+		startup  bool
+		// want is the status after the recovery, and message a part of the
+		// error recorded, if the job is recovered.
+		want    int
+		message string
+	}{
+		{name: "expired", owner: "other", expires: &expired, policy: StaleRequeue, want: models.TranscriptionStatusPending, message: "stopped renewing"},
+		{name: "expired last retry", owner: "other", expires: &expired, attempts: 1, policy: StaleRequeue, want: models.TranscriptionStatusPending, message: "stopped renewing"},
+		{name: "expired out of retries", owner: "other", expires: &expired, attempts: 2, policy: StaleRequeue, want: models.TranscriptionStatusError, message: "stopped renewing"},
+		{name: "expired fail policy", owner: "other", expires: &expired, policy: StaleFail, want: models.TranscriptionStatusError, message: "stopped renewing"},
+		{name: "no lease", policy: StaleRequeue, want: models.TranscriptionStatusPending, message: "without a lease"},
+		{name: "live lease", owner: "other", expires: &live, policy: StaleRequeue, startup: true, want: models.TranscriptionStatusRunning},
+		{name: "own live lease", owner: workerID, expires: &live, policy: StaleRequeue, want: models.TranscriptionStatusRunning},
+		{name: "own lease on startup", owner: workerID, expires: &live, policy: StaleRequeue, startup: true, want: models.TranscriptionStatusPending, message: "restarted"},
+	}
+	const retries = 2
+	for _, tt := range tests {
+		db, err := database.NewMemoryDb("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := api.NewServer(":0", db, events.NewLocal(), nil)
+		ctx := context.Background()
+		job := &models.Transcription{Status: models.TranscriptionStatusRunning, LeaseOwner: tt.owner, LeaseExpiresAt: tt.expires}
+		if tt.attempts > 0 {
+			job.Error = &models.JobError{Stage: models.ErrorStageTranscribe, Attempts: tt.attempts}
+		}
+		job, err = db.NewTranscription(ctx, job)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recoverStale(ctx, s, tt.policy, retries, tt.startup)
+
+		got, err := db.GetTranscription(ctx, job.ID.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != tt.want {
+			t.Errorf("%v: status %v, want %v", tt.name, got.Status, tt.want)
+		}
+		wakeUps := 0
+		if tt.want == models.TranscriptionStatusPending {
+			wakeUps = 1
+		}
+		if len(s.NewTranscriptionCh) != wakeUps {
+			t.Errorf("%v: %v wake ups, want %v", tt.name, len(s.NewTranscriptionCh), wakeUps)
+		}
+		if tt.want == models.TranscriptionStatusRunning {
+			if got.Version != job.Version || got.LeaseOwner != tt.owner {
+				t.Errorf("%v: job %+v written, want it left to its worker", tt.name, got)
+			}
+			continue
+		}
+		if got.LeaseOwner != "" || got.LeaseExpiresAt != nil {
+			t.Errorf("%v: lease %v until %v kept", tt.name, got.LeaseOwner, got.LeaseExpiresAt)
+		}
+		if got.Error == nil || got.Error.Stage != models.ErrorStageWorker || got.Error.Attempts != tt.attempts+1 || !strings.Contains(got.Error.Message, tt.message) {
+			t.Errorf("%v: error %+v, want attempt %v of the worker stage mentioning %q", tt.name, got.Error, tt.attempts+1, tt.message)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package monitor
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"time"
+
+	"codeberg.org/pluja/whishper/asr"
+	"codeberg.org/pluja/whishper/models"
+	"codeberg.org/pluja/whishper/utils"
+)
+
+// retryBackoff is how long the first retry of a failed job waits. Every
+// further retry waits twice as long, up to maxRetryBackoff.
+const (
+	retryBackoff    = 10 * time.Second
+	maxRetryBackoff = 10 * time.Minute
+)
+
+// stageError is an error of transcribe with the step it happened at.
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return e.stage + ": " + e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+// failed marks err as happening at stage.
+func failed(stage string, err error) error {
+	return &stageError{stage: stage, err: err}
+}
+
+// jobError describes the failure of attempt number attempts with err.
+func jobError(err error, attempts int) *models.JobError {
+	e := &models.JobError{
+		Stage:    models.ErrorStageTranscribe,
+		Message:  err.Error(),
+		Attempts: attempts,
+		At:       time.Now().UTC(),
+	}
+	var se *stageError
+	if errors.As(err, &se) {
+		e.Stage = se.stage
+		e.Message = se.err.Error()
+	}
+	return e
+}
+
+// transient reports whether err may go away on its own, so the job is worth
+// retrying: the transcription service was unreachable, dropped the connection
+// or failed with a 5xx or 429 status, or every service able to run the job
+// was down. Errors about the job itself, like a
+// media file yt-dlp can't download or the transcription service can't decode,
+// aren't.
+func transient(err error) bool {
+	var se *stageError
+	if errors.As(err, &se) && se.stage != models.ErrorStageTranscribe {
+		return false
+	}
+	if errors.Is(err, asr.ErrUnavailable) {
+		return true
+	}
+	var statusErr *utils.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == 429
+	}
+	return unreachable(err)
+}
+
+// unreachable reports whether err comes from the transcription service being
+// unreachable or dropping the connection, rather than from an answer of it.
+func unreachable(err error) bool {
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// backoff is how long to wait before the next attempt after attempts failed.
+func backoff(attempts int) time.Duration {
+	wait := retryBackoff
+	for i := 1; i < attempts && wait < maxRetryBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxRetryBackoff {
+		wait = maxRetryBackoff
+	}
+	return wait
+}
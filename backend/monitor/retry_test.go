@@ -0,0 +1,81 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"codeberg.org/pluja/whishper/asr"
+	"codeberg.org/pluja/whishper/models"
+	"codeberg.org/pluja/whishper/utils"
+)
+
+func TestTransient(t *testing.T) {
+	refused := &url.Error{Op: "Post", URL: "http://asr:8000", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"unreachable", refused, true},
+		{"unreachable while transcribing", failed(models.ErrorStageTranscribe, refused), true},
+		{"dropped connection", io.ErrUnexpectedEOF, true},
+		{"no service up", fmt.Errorf("routing: %w", asr.ErrUnavailable), true},
+		{"server error", &utils.StatusError{StatusCode: 502}, true},
+		{"too many requests", &utils.StatusError{StatusCode: 429}, true},
+		{"bad request", &utils.StatusError{StatusCode: 400, Body: "can't decode"}, false},
+		{"not found", &utils.StatusError{StatusCode: 404}, false},
+		{"invalid answer", errors.New("invalid character '<'"), false},
+		{"download", failed(models.ErrorStageDownload, refused), false},
+		{"preprocess", failed(models.ErrorStagePreprocess, errors.New("exit status 1")), false},
+	}
+	for _, tt := range tests {
+		if got := transient(tt.err); got != tt.want {
+			t.Errorf("%v: transient(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 10 * time.Second},
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{6, 320 * time.Second},
+		{7, 10 * time.Minute},
+		{8, 10 * time.Minute},
+		{1000, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%v) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestJobError(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		stage   string
+		message string
+	}{
+		{"plain", errors.New("boom"), models.ErrorStageTranscribe, "boom"},
+		{"with stage", failed(models.ErrorStageDownload, errors.New("404")), models.ErrorStageDownload, "404"},
+		{"wrapped", fmt.Errorf("job: %w", failed(models.ErrorStageSave, errors.New("disk full"))), models.ErrorStageSave, "disk full"},
+	}
+	for _, tt := range tests {
+		got := jobError(tt.err, 2)
+		if got.Stage != tt.stage || got.Message != tt.message || got.Attempts != 2 || got.At.IsZero() {
+			t.Errorf("%v: jobError = %+v, want stage %q and message %q after 2 attempts", tt.name, got, tt.stage, tt.message)
+		}
+	}
+}
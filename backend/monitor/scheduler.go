@@ -0,0 +1,45 @@
+package monitor
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"codeberg.org/pluja/whishper/api"
+)
+
+// scheduleInterval is how often scheduled jobs are checked for release.
+const scheduleInterval = 30 * time.Second
+
+// StartScheduler queues the scheduled jobs once their time has come, checking
+// every scheduleInterval, and wakes the monitor up for them.
+func StartScheduler(s *api.Server) {
+	log.Info().Msg("Starting scheduler")
+	go func() {
+		ticker := time.NewTicker(scheduleInterval)
+		defer ticker.Stop()
+		for {
+			releaseScheduled(context.Background(), s)
+			<-ticker.C
+		}
+	}()
+}
+
+func releaseScheduled(ctx context.Context, s *api.Server) {
+	released, err := s.Db.ReleaseScheduled(ctx, time.Now())
+	if err != nil {
+		log.Error().Err(err).Msg("Error releasing scheduled transcriptions")
+	}
+	for _, t := range released {
+		log.Info().Msgf("Released scheduled transcription %v to the queue", t.ID.Hex())
+		s.BroadcastTranscription(t)
+	}
+	if len(released) > 0 {
+		select {
+		case s.NewTranscriptionCh <- true:
+		default:
+			// A wake up is pending already.
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package monitor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"codeberg.org/pluja/whishper/api"
+	"codeberg.org/pluja/whishper/database"
+	"codeberg.org/pluja/whishper/events"
+	"codeberg.org/pluja/whishper/models"
+)
+
+func TestReleaseScheduledWakesMonitor(t *testing.T) {
+	tests := []struct {
+		name string
+		// due and later are how many scheduled jobs are due and how many
+		// are for later.
+		due, later int
+		// pending is how many wake ups are waiting already, full whether
+		// they fill the channel.
+		pending int
+		full    bool
+		// wakeUps is how many wake ups the release adds.
+		wakeUps int
+	}{
+		{name: "nothing due", later: 1},
+		{name: "due", due: 2, later: 1, wakeUps: 1},
+		{name: "wake up pending", due: 1, pending: 1, wakeUps: 1},
+		{name: "wake ups full", due: 1, full: true},
+	}
+	for _, tt := range tests {
+		db, err := database.NewMemoryDb("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := api.NewServer(":0", db, events.NewLocal(), nil)
+		ctx := context.Background()
+		for i := 0; i < tt.due+tt.later; i++ {
+			notBefore := time.Now().Add(-time.Minute)
+			if i >= tt.due {
+				notBefore = time.Now().Add(time.Hour)
+			}
+			if _, err := db.NewTranscription(ctx, &models.Transcription{Status: models.TranscriptionStatusScheduled, NotBefore: &notBefore}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		pending := tt.pending
+		if tt.full {
+			pending = cap(s.NewTranscriptionCh)
+		}
+		for i := 0; i < pending; i++ {
+			s.NewTranscriptionCh <- true
+		}
+
+		done := make(chan struct{})
+		go func() {
+			releaseScheduled(ctx, s)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: releasing blocked on the wake up", tt.name)
+		}
+		if got := len(s.NewTranscriptionCh); got != pending+tt.wakeUps {
+			t.Errorf("%v: %v wake ups, want %v", tt.name, got, pending+tt.wakeUps)
+		}
+		queued, err := db.GetPendingTranscriptions(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(queued) != tt.due {
+			t.Errorf("%v: %v jobs queued, want %v", tt.name, len(queued), tt.due)
+		}
+	}
+}
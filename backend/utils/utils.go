@@ -2,7 +2,6 @@ package utils
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -34,7 +33,9 @@ func SanitizeFilename(filename string) string {
 	return filename
 }
 
-func DownloadMedia(t *models.Transcription) (string, error) {
+// DownloadMedia downloads the media at the source URL of t with yt-dlp into the
+// upload directory and returns its file name. Cancelling ctx stops yt-dlp.
+func DownloadMedia(ctx context.Context, t *models.Transcription) (string, error) {
 	if t.SourceUrl == "" {
 		log.Debug().Msg("Source URL is empty")
 		return "", fmt.Errorf("source URL is empty")
@@ -46,13 +47,13 @@ func DownloadMedia(t *models.Transcription) (string, error) {
 	}
 
 	goutubedl.Path = "yt-dlp"
-	result, err := goutubedl.New(context.Background(), t.SourceUrl, goutubedl.Options{})
+	result, err := goutubedl.New(ctx, t.SourceUrl, goutubedl.Options{})
 	if err != nil {
 		log.Debug().Err(err).Msg("Error creating goutubedl")
 		return "", err
 	}
 
-	downloadResult, err := result.Download(context.Background(), "best")
+	downloadResult, err := result.Download(ctx, "best")
 	if err != nil {
 		log.Debug().Err(err).Msg("Error downloading media")
 		return "", err
@@ -68,106 +69,78 @@ func DownloadMedia(t *models.Transcription) (string, error) {
 		return "", err
 	}
 	defer f.Close()
-	io.Copy(f, downloadResult)
+	if _, err := io.Copy(f, downloadResult); err != nil {
+		log.Debug().Err(err).Msg("Error writing downloaded media")
+		os.Remove(f.Name())
+		return "", err
+	}
 
 	return filename, nil
 }
 
-func SendTranscriptionRequest(t *models.Transcription, body *bytes.Buffer, writer *multipart.Writer) (*models.WhisperResult, error) {
-	// 1. PREPARE URL PARAMETERS (Query String)
-	// We use Query Params because FastAPI expects them there by default.
-	baseUrl := fmt.Sprintf("http://%v/transcribe/", os.Getenv("ASR_ENDPOINT"))
+// PreprocessedDir is where the audio extracted from the media is cached: in
+// CACHE_DIR, or the temporary directory if it is empty. It is kept out of
+// UPLOAD_DIR, which is served to anyone.
+func PreprocessedDir() string {
+	dir := os.Getenv("CACHE_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "whishper")
+	}
+	return filepath.Join(dir, "preprocessed")
+}
 
-	params := url.Values{}
-	params.Add("model_size", t.ModelSize)
-	params.Add("task", t.Task)
-	params.Add("language", t.Language)
-	params.Add("device", t.Device) // This ensures 'cuda' is passed cleanly
+// StatusError is returned when the transcription service answers with another
+// status than 200 OK.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
 
-	if t.BeamSize > 0 {
-		params.Add("beam_size", fmt.Sprintf("%d", t.BeamSize))
-	}
-	if t.InitialPrompt != "" {
-		params.Add("initial_prompt", t.InitialPrompt)
+func (e *StatusError) Error() string {
+	body := strings.TrimSpace(e.Body)
+	if len(body) > 500 {
+		body = body[:500] + "..."
 	}
-	if len(t.Hotwords) > 0 {
-		params.Add("hotwords", strings.Join(t.Hotwords, ","))
+	if body == "" {
+		return fmt.Sprintf("invalid status %v", e.StatusCode)
 	}
-	// VAD parameters
-	if t.VadFilter {
-		params.Add("vad_filter", "true")
-		if t.VadThreshold != nil {
-			params.Add("vad_threshold", fmt.Sprintf("%f", *t.VadThreshold))
+	return fmt.Sprintf("invalid status %v: %v", e.StatusCode, body)
+}
+
+// multipartMedia returns a multipart form with media as its file field, and
+// its content type. The form is written through a pipe as the request reads
+// it, so the media is streamed from disk instead of being held in memory. The
+// request closing the form stops the writing.
+func multipartMedia(media io.Reader, fileName string) (io.ReadCloser, string) {
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		part, err := writer.CreateFormFile("file", fileName)
+		if err == nil {
+			_, err = io.Copy(part, media)
 		}
-		if t.VadMinSpeechDurationMS != nil {
-			params.Add("vad_min_speech_duration_ms", fmt.Sprintf("%d", *t.VadMinSpeechDurationMS))
+		if err == nil {
+			// This writes the final boundary. Without it, the server gets a
+			// corrupted body and returns EOF.
+			err = writer.Close()
 		}
-		if t.VadMinSilenceDurationMS != nil {
-			params.Add("vad_min_silence_duration_ms", fmt.Sprintf("%d", *t.VadMinSilenceDurationMS))
+		if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			log.Debug().Err(err).Msg("Error writing multipart form")
 		}
-	}
-
-	// Attach parameters to URL
-	fullUrl := fmt.Sprintf("%s?%s", baseUrl, params.Encode())
-
-	// 2. CRITICAL: CLOSE THE WRITER
-	// This writes the final boundary to the 'body' buffer.
-	// If you don't do this, the server gets a corrupted body and returns EOF.
-	err := writer.Close()
-	if err != nil {
-		log.Debug().Err(err).Msg("Error closing multipart writer")
-		return nil, err
-	}
-
-	// 3. SEND REQUEST
-	req, err := http.NewRequest("POST", fullUrl, body)
-	if err != nil {
-		log.Debug().Err(err).Msg("Error creating request to transcription service")
-		return nil, err
-	}
-
-	// Set the Content-Type with the boundary
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	req.Header.Set("Accept", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Error().Err(err).Msg("Error sending request")
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Error().Err(err).Msg("Error reading response body")
-		return nil, err
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		log.Error().Msgf("Response from %v: %v", fullUrl, string(b))
-		log.Error().Err(err).Msgf("Invalid response status %v:", resp.StatusCode)
-		return nil, errors.New("invalid status")
-	}
-
-	var asrResponse *models.WhisperResult
-	if err := json.Unmarshal(b, &asrResponse); err != nil {
-		log.Error().Err(err).Msg("Error decoding response")
-		log.Error().Msgf("ASR Response: %+v\n", b)
-		return nil, err
-	}
-
-	return asrResponse, nil
+		pw.CloseWithError(err)
+	}()
+	return pr, writer.FormDataContentType()
 }
 
-// SendTranscriptionRequestStream sends the transcription request to the
-// streaming endpoint and consumes the NDJSON event stream. For every progress
+// SendTranscriptionRequestStream sends media, the media file of t named
+// fileName, to the streaming endpoint of the transcription service and consumes the NDJSON event stream. For every progress
 // event it invokes onProgress with a value between 0.0 and 1.0. When the
 // transcription service needs to download the model first, it invokes
 // onModelDownload with the model name. It returns the final WhisperResult once
-// the stream is complete.
-func SendTranscriptionRequestStream(t *models.Transcription, body *bytes.Buffer, writer *multipart.Writer, onProgress func(progress float64), onModelDownload func(model string)) (*models.WhisperResult, error) {
-	baseUrl := fmt.Sprintf("http://%v/transcribe-stream/", os.Getenv("ASR_ENDPOINT"))
+// the stream is complete. Cancelling ctx aborts the request. The request goes
+// to the transcription service at endpoint, its host and port.
+func SendTranscriptionRequestStream(ctx context.Context, endpoint string, t *models.Transcription, media io.Reader, fileName string, onProgress func(progress float64), onModelDownload func(model string)) (*models.WhisperResult, error) {
+	baseUrl := fmt.Sprintf("http://%v/transcribe-stream/", endpoint)
 
 	params := url.Values{}
 	params.Add("model_size", t.ModelSize)
@@ -199,17 +172,14 @@ func SendTranscriptionRequestStream(t *models.Transcription, body *bytes.Buffer,
 
 	fullUrl := fmt.Sprintf("%s?%s", baseUrl, params.Encode())
 
-	if err := writer.Close(); err != nil {
-		log.Debug().Err(err).Msg("Error closing multipart writer")
-		return nil, err
-	}
-
-	req, err := http.NewRequest("POST", fullUrl, body)
+	body, contentType := multipartMedia(media, fileName)
+	req, err := http.NewRequestWithContext(ctx, "POST", fullUrl, body)
 	if err != nil {
+		body.Close()
 		log.Debug().Err(err).Msg("Error creating request to transcription service")
 		return nil, err
 	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Content-Type", contentType)
 	req.Header.Set("Accept", "application/x-ndjson")
 
 	client := &http.Client{}
@@ -223,7 +193,7 @@ func SendTranscriptionRequestStream(t *models.Transcription, body *bytes.Buffer,
 	if resp.StatusCode != http.StatusOK {
 		b, _ := io.ReadAll(resp.Body)
 		log.Error().Msgf("Response from %v: %v", fullUrl, string(b))
-		return nil, errors.New("invalid status")
+		return nil, &StatusError{StatusCode: resp.StatusCode, Body: string(b)}
 	}
 
 	// streamEvent matches the NDJSON lines emitted by the transcription API.
@@ -273,8 +243,11 @@ func SendTranscriptionRequestStream(t *models.Transcription, body *bytes.Buffer,
 	}
 	return finalResult, nil
 }
-func CheckTranscriptionServiceHealth() (ok bool, message string) {
-	url := "http://" + os.Getenv("ASR_ENDPOINT") + "/healthcheck"
+
+// CheckTranscriptionServiceHealth asks the transcription service at endpoint,
+// its host and port, whether it is healthy.
+func CheckTranscriptionServiceHealth(endpoint string) (ok bool, message string) {
+	url := "http://" + endpoint + "/healthcheck"
 
 	client := &http.Client{
 		Timeout: 10 * time.Second,
@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/pluja/whishper/models"
+)
+
+// failingReader returns data, then err.
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// received is what the stub transcription service got.
+type received struct {
+	fileName string
+	media    []byte
+	err      error
+}
+
+// stubService answers the transcription requests whose form it can read
+// with a result, and reports what it got to the returned channel.
+func stubService(t *testing.T) (string, <-chan received) {
+	got := make(chan received, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			got <- received{err: err}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		media, err := io.ReadAll(file)
+		got <- received{fileName: header.Filename, media: media, err: err}
+		fmt.Fprintln(w, `{"type":"progress","progress":0.5}`)
+		fmt.Fprintln(w, `{"type":"result","result":{"text":"hello"}}`)
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://"), got
+}
+
+func within(t *testing.T, got <-chan received) received {
+	t.Helper()
+	select {
+	case r := <-got:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("the service got no request")
+		return received{}
+	}
+}
+
+// The media reaches the service whole, as the file of the form, while the
+// form is streamed.
+func TestSendMedia(t *testing.T) {
+	endpoint, got := stubService(t)
+	media := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(media)
+
+	var progress []float64
+	res, err := SendTranscriptionRequestStream(context.Background(), endpoint, &models.Transcription{}, bytes.NewReader(media), "a b.mp3", func(p float64) {
+		progress = append(progress, p)
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != "hello" || len(progress) != 1 {
+		t.Errorf("got result %+v and progress %v", res, progress)
+	}
+	r := within(t, got)
+	if r.err != nil || r.fileName != "a b.mp3" || !bytes.Equal(r.media, media) {
+		t.Errorf("service got file %q with %v bytes, error %v, want %q with %v bytes", r.fileName, len(r.media), r.err, "a b.mp3", len(media))
+	}
+}
+
+// A media read error fails the request instead of sending a truncated form,
+// and ends the form with that error rather than hanging.
+func TestSendMediaReadError(t *testing.T) {
+	failing := errors.New("disk failure")
+
+	body, _ := multipartMedia(&failingReader{data: []byte("partial"), err: failing}, "a.mp3")
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(body)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, failing) {
+			t.Errorf("reading the form: got error %v, want %v", err, failing)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reading the form hung")
+	}
+
+	endpoint, got := stubService(t)
+	_, err := SendTranscriptionRequestStream(context.Background(), endpoint, &models.Transcription{}, &failingReader{data: []byte("partial"), err: failing}, "a.mp3", nil, nil)
+	if !errors.Is(err, failing) {
+		t.Errorf("sending failing media: got error %v, want %v", err, failing)
+	}
+	select {
+	case r := <-got:
+		if r.err == nil {
+			t.Errorf("service read a whole form with %q", r.media)
+		}
+	case <-time.After(100 * time.Millisecond):
+		// The request was aborted before the handler ran.
+	}
+}